@@ -0,0 +1,297 @@
+package autopilot
+
+import (
+	"circular/node"
+	"circular/rebalance"
+	"circular/rebalance/parallel"
+	"circular/util"
+	"encoding/json"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TARGETS_KEY        = "autopilot_targets"
+	DEFAULT_INTERVAL   = 60      // minutes
+	DEFAULT_MIN_RATIO  = 20      // percent
+	DEFAULT_MAX_RATIO  = 80      // percent
+	DEFAULT_MAX_AMOUNT = 2000000 // sats per run
+	DEFAULT_MAX_PPM    = 100
+	DEFAULT_MAX_JOBS   = 2
+	PULL               = "pull"
+	PUSH               = "push"
+	NONE               = "none"
+)
+
+var (
+	singleton *Autopilot
+	once      sync.Once
+)
+
+// Config contains the global budgets of the autopilot and the default target range
+type Config struct {
+	MinRatio    uint64 `json:"min_ratio"`
+	MaxRatio    uint64 `json:"max_ratio"`
+	MaxAmount   uint64 `json:"max_amount"`
+	MaxPPM      uint64 `json:"max_ppm"`
+	MaxJobs     int    `json:"max_jobs"`
+	SplitAmount uint64 `json:"split_amount"`
+}
+
+// Target is the range of local balance, in percent, that a channel should stay in
+type Target struct {
+	MinRatio uint64 `json:"min_ratio"`
+	MaxRatio uint64 `json:"max_ratio"`
+}
+
+// Autopilot periodically checks the balance of our channels and starts
+// circular-pull and circular-push jobs to bring them back inside their target range
+type Autopilot struct {
+	Node    *node.Node
+	Enabled bool
+	Config  *Config
+	Targets map[string]*Target
+	// Jobs maps a short channel id to the job the autopilot started for it
+	Jobs    map[string]uint64
+	LastRun int64
+	lock    *sync.Mutex
+}
+
+func GetAutopilot() *Autopilot {
+	once.Do(func() {
+		singleton = newAutopilot()
+	})
+	return singleton
+}
+
+func newAutopilot() *Autopilot {
+	return &Autopilot{
+		Targets: make(map[string]*Target),
+		Jobs:    make(map[string]uint64),
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (a *Autopilot) Init(options map[string]glightning.Option) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.Node = node.GetNode()
+	a.Enabled = options["circular-autopilot"].GetValue().(bool)
+	a.Config = &Config{
+		MinRatio:    uint64(options["circular-autopilot-min-ratio"].GetValue().(int)),
+		MaxRatio:    uint64(options["circular-autopilot-max-ratio"].GetValue().(int)),
+		MaxAmount:   uint64(options["circular-autopilot-max-amount"].GetValue().(int)),
+		MaxPPM:      uint64(options["circular-autopilot-max-ppm"].GetValue().(int)),
+		MaxJobs:     options["circular-autopilot-max-jobs"].GetValue().(int),
+		SplitAmount: parallel.DEFAULT_SPLIT_AMOUNT,
+	}
+	if err := validateRatios(a.Config.MinRatio, a.Config.MaxRatio); err != nil {
+		log.Fatalln(err)
+	}
+	a.loadTargets()
+
+	interval := options["circular-autopilot-interval"].GetValue().(int)
+	a.Node.AddCronJob(strconv.Itoa(interval)+"m", a.Run)
+	a.Node.Logf(glightning.Info, "autopilot initialized, enabled: %t, interval: %d minutes", a.Enabled, interval)
+}
+
+func (a *Autopilot) loadTargets() {
+	value, err := a.Node.DB.Get(TARGETS_KEY)
+	if err == badger.ErrKeyNotFound {
+		return
+	}
+	if err != nil {
+		a.Node.Logln(glightning.Unusual, err)
+		return
+	}
+	if err = json.Unmarshal(value, &a.Targets); err != nil {
+		a.Node.Logln(glightning.Unusual, err)
+	}
+}
+
+// saveTargets assumes that the lock is held
+func (a *Autopilot) saveTargets() error {
+	value, err := json.Marshal(a.Targets)
+	if err != nil {
+		return err
+	}
+	return a.Node.DB.SetPermanent(TARGETS_KEY, value)
+}
+
+// getTarget assumes that the lock is held
+func (a *Autopilot) getTarget(scid string) *Target {
+	if target, ok := a.Targets[scid]; ok {
+		return target
+	}
+	return &Target{
+		MinRatio: a.Config.MinRatio,
+		MaxRatio: a.Config.MaxRatio,
+	}
+}
+
+// candidate is a channel that is outside its target range
+type candidate struct {
+	scid   string
+	action string
+	// amount is how much we need to move to bring the channel to the middle of its range, in sats
+	amount uint64
+	// deviation is how far the channel is from its range, in percent
+	deviation uint64
+}
+
+// Run checks every channel and starts jobs for the ones that are outside their target range
+func (a *Autopilot) Run() {
+	defer util.TimeTrack(time.Now(), "autopilot.Run", a.Node.Logf)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.Enabled || a.Node.Stopped {
+		return
+	}
+	a.LastRun = time.Now().Unix()
+
+	running := a.pruneJobs()
+	// the splits of new jobs would all fail until some of the budget is freed
+	if a.Node.Budget.Exhausted() {
+		a.Node.Logln(glightning.Info, "autopilot: the fee budget is exhausted, not starting new jobs")
+		return
+	}
+	candidates := a.findCandidates()
+	a.Node.Logf(glightning.Debug, "autopilot: %d jobs running, %d channels out of range", running, len(candidates))
+
+	budget := a.Config.MaxAmount
+	for _, c := range candidates {
+		if running >= a.Config.MaxJobs {
+			break
+		}
+		if _, ok := a.Jobs[c.scid]; ok {
+			continue
+		}
+
+		// amount must be a multiple of the split amount
+		amount := util.Min(c.amount, budget)
+		amount -= amount % a.Config.SplitAmount
+		if amount == 0 {
+			continue
+		}
+
+		jobId, err := a.startJob(c, amount)
+		if err != nil {
+			a.Node.Logf(glightning.Info, "autopilot: unable to %s %d sats on %s: %v", c.action, amount, c.scid, err)
+			continue
+		}
+		a.Node.Logf(glightning.Info, "autopilot: started job %d to %s %d sats on %s", jobId, c.action, amount, c.scid)
+		a.Jobs[c.scid] = jobId
+		budget -= amount
+		running++
+	}
+}
+
+// pruneJobs forgets the jobs that are over and returns how many are still running.
+// It assumes that the lock is held
+func (a *Autopilot) pruneJobs() int {
+	running := 0
+	for scid, id := range a.Jobs {
+		job, err := a.Node.GetJob(id)
+		if err != nil || job.Status != node.JOB_RUNNING {
+			delete(a.Jobs, scid)
+			continue
+		}
+		running++
+	}
+	return running
+}
+
+// findCandidates returns the channels that are outside their target range, the most unbalanced first.
+// It assumes that the lock is held
+func (a *Autopilot) findCandidates() []*candidate {
+	a.Node.PeersLock.RLock()
+	defer a.Node.PeersLock.RUnlock()
+
+	candidates := make([]*candidate, 0)
+	for _, peer := range a.Node.Peers {
+		if !peer.Connected {
+			continue
+		}
+		for _, channel := range peer.Channels {
+			if channel.State != rebalance.NORMAL || channel.TotalMsat.MSat() == 0 {
+				continue
+			}
+			if c := a.checkChannel(channel); c != nil {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].deviation > candidates[j].deviation
+	})
+	return candidates
+}
+
+// checkChannel assumes that the lock is held
+func (a *Autopilot) checkChannel(channel *glightning.PeerChannel) *candidate {
+	total := channel.TotalMsat.MSat()
+	toUs := channel.ToUsMsat.MSat()
+	target := a.getTarget(channel.ShortChannelId)
+	ratio := toUs * 100 / total
+	middle := total * (target.MinRatio + target.MaxRatio) / 200
+
+	if ratio < target.MinRatio {
+		return &candidate{
+			scid:      channel.ShortChannelId,
+			action:    PULL,
+			amount:    (middle - toUs) / 1000,
+			deviation: target.MinRatio - ratio,
+		}
+	}
+	if ratio > target.MaxRatio {
+		return &candidate{
+			scid:      channel.ShortChannelId,
+			action:    PUSH,
+			amount:    (toUs - middle) / 1000,
+			deviation: ratio - target.MaxRatio,
+		}
+	}
+	return nil
+}
+
+// startJob assumes that the lock is held
+func (a *Autopilot) startJob(c *candidate, amount uint64) (uint64, error) {
+	var (
+		result jrpc2.Result
+		err    error
+	)
+	if c.action == PULL {
+		pull := &parallel.RebalancePull{
+			InScid:            c.scid,
+			Amount:            amount,
+			MaxPPM:            a.Config.MaxPPM,
+			SplitAmount:       a.Config.SplitAmount,
+			Async:             true,
+			AbstractRebalance: parallel.AbstractRebalance{Node: a.Node},
+		}
+		result, err = pull.Call()
+	} else {
+		push := &parallel.RebalancePush{
+			OutScid:           c.scid,
+			Amount:            amount,
+			MaxPPM:            a.Config.MaxPPM,
+			SplitAmount:       a.Config.SplitAmount,
+			Async:             true,
+			AbstractRebalance: parallel.AbstractRebalance{Node: a.Node},
+		}
+		result, err = push.Call()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.(*node.JobStarted).Id, nil
+}
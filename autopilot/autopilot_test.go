@@ -0,0 +1,203 @@
+package autopilot
+
+import (
+	"circular/node"
+	"circular/simnet"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newTestAutopilot returns an enabled autopilot with the default range, on a node backed by network
+func newTestAutopilot(t *testing.T, network *simnet.Network) *Autopilot {
+	n, err := node.New(network, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	network.OnSendPaySuccess = n.OnPaymentSuccess
+	network.OnSendPayFailure = n.OnPaymentFailure
+	network.OnHtlcAccepted = n.OnHtlcAccepted
+
+	a := newAutopilot()
+	a.Node = n
+	a.Enabled = true
+	a.Config = &Config{
+		MinRatio:    DEFAULT_MIN_RATIO,
+		MaxRatio:    DEFAULT_MAX_RATIO,
+		MaxAmount:   DEFAULT_MAX_AMOUNT,
+		MaxPPM:      500,
+		MaxJobs:     1,
+		SplitAmount: 100000,
+	}
+	return a
+}
+
+// newTestNetwork returns a network where bob's channel needs a pull, alice's channel needs a push
+// and carol's channel is balanced. Alice and carol can forward to bob
+func newTestNetwork() *simnet.Network {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 850000, 0, 100)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 50000, 0, 100)
+	network.AddChannel("4x4x4", "self", "carol", 1000000, 500000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 900000, 0, 10)
+	network.AddChannel("5x5x5", "carol", "bob", 1000000, 900000, 0, 10)
+	return network
+}
+
+// waitForJobs waits until the jobs started by the autopilot are over
+func waitForJobs(t *testing.T, a *Autopilot) {
+	assert.Eventually(t, func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.pruneJobs() == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func newTestPeerChannel(scid string, toUs, total uint64) *glightning.PeerChannel {
+	return &glightning.PeerChannel{
+		State:          simnet.NORMAL,
+		ShortChannelId: scid,
+		ToUsMsat:       glightning.AmountFromMSat(toUs),
+		TotalMsat:      glightning.AmountFromMSat(total),
+	}
+}
+
+func TestAutopilot_CheckChannel(t *testing.T) {
+	a := newTestAutopilot(t, newTestNetwork())
+	a.Targets["9x9x9"] = &Target{MinRatio: 40, MaxRatio: 60}
+
+	tests := []struct {
+		name      string
+		scid      string
+		toUs      uint64
+		action    string
+		amount    uint64
+		deviation uint64
+	}{
+		{"below the range", "1x1x1", 100000000, PULL, 400000, 10},
+		{"at the lower bound", "1x1x1", 200000000, NONE, 0, 0},
+		{"inside the range", "1x1x1", 500000000, NONE, 0, 0},
+		{"at the upper bound", "1x1x1", 800000000, NONE, 0, 0},
+		{"above the range", "1x1x1", 950000000, PUSH, 450000, 15},
+		{"empty", "1x1x1", 0, PULL, 500000, 20},
+		{"full", "1x1x1", 1000000000, PUSH, 500000, 20},
+		{"inside the default range, below its own", "9x9x9", 300000000, PULL, 200000, 10},
+		{"inside the default range, above its own", "9x9x9", 700000000, PUSH, 200000, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := a.checkChannel(newTestPeerChannel(test.scid, test.toUs, 1000000000))
+			if test.action == NONE {
+				assert.Nil(t, c)
+				return
+			}
+			if assert.NotNil(t, c) {
+				assert.Equal(t, test.action, c.action)
+				assert.Equal(t, test.amount, c.amount)
+				assert.Equal(t, test.deviation, c.deviation)
+			}
+		})
+	}
+}
+
+func TestAutopilot_FindCandidates(t *testing.T) {
+	a := newTestAutopilot(t, newTestNetwork())
+
+	// bob is further from its range than alice, carol is inside it
+	candidates := a.findCandidates()
+	if assert.Len(t, candidates, 2) {
+		assert.Equal(t, "2x2x2", candidates[0].scid)
+		assert.Equal(t, PULL, candidates[0].action)
+		assert.Equal(t, "1x1x1", candidates[1].scid)
+		assert.Equal(t, PUSH, candidates[1].action)
+	}
+
+	// disconnected peers are skipped
+	a.Node.PeersLock.Lock()
+	a.Node.Peers["bob"].Connected = false
+	a.Node.PeersLock.Unlock()
+	candidates = a.findCandidates()
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "1x1x1", candidates[0].scid)
+	}
+}
+
+func TestAutopilot_RunStartsTheMostUnbalancedFirst(t *testing.T) {
+	network := newTestNetwork()
+	a := newTestAutopilot(t, network)
+
+	a.Run()
+	assert.NotZero(t, a.LastRun)
+	if assert.Len(t, a.Jobs, 1) {
+		assert.Contains(t, a.Jobs, "2x2x2")
+	}
+	job, err := a.Node.GetJob(a.Jobs["2x2x2"])
+	assert.NoError(t, err)
+	assert.Equal(t, "circular-pull", job.Method)
+	waitForJobs(t, a)
+
+	// 450k sats bring bob to the middle of the range, 400k are a multiple of the split amount
+	assert.Equal(t, uint64(450000000), network.Balance("2x2x2", "self"))
+	job, err = a.Node.GetJob(job.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, node.JOB_COMPLETED, job.Status, job.Error)
+}
+
+func TestAutopilot_RunRespectsMaxJobs(t *testing.T) {
+	a := newTestAutopilot(t, newTestNetwork())
+	a.Config.MaxJobs = 2
+
+	a.Run()
+	assert.Len(t, a.Jobs, 2)
+	waitForJobs(t, a)
+}
+
+func TestAutopilot_RunRespectsMaxAmount(t *testing.T) {
+	network := newTestNetwork()
+	a := newTestAutopilot(t, network)
+	a.Config.MaxAmount = 250000
+
+	// the amount is rounded down to a multiple of the split amount
+	a.Run()
+	waitForJobs(t, a)
+	assert.Equal(t, uint64(250000000), network.Balance("2x2x2", "self"))
+}
+
+func TestAutopilot_Disabled(t *testing.T) {
+	network := newTestNetwork()
+	a := newTestAutopilot(t, network)
+	a.Enabled = false
+
+	a.Run()
+	assert.Empty(t, a.Jobs)
+	assert.Zero(t, a.LastRun)
+
+	a.Enabled = true
+	a.Node.Stopped = true
+	a.Run()
+	assert.Empty(t, a.Jobs)
+}
+
+func TestAutopilot_FeeBudget(t *testing.T) {
+	network := newTestNetwork()
+	a := newTestAutopilot(t, network)
+	// a split pays about 11 sats of fees, the budget allows for two of them
+	a.Node.Budget.Limits[node.DAY] = 25000
+
+	a.Run()
+	waitForJobs(t, a)
+	assert.Equal(t, uint64(250000000), network.Balance("2x2x2", "self"))
+	day := a.Node.GetBudgetStatus().Windows[1]
+	assert.Equal(t, node.DAY, day.Window)
+	assert.LessOrEqual(t, day.Spent, day.Limit)
+
+	// once the budget is exhausted, no job is started
+	a.Node.Budget.Limits[node.DAY] = day.Spent
+	a.Run()
+	assert.Empty(t, a.Jobs)
+	assert.Equal(t, uint64(250000000), network.Balance("2x2x2", "self"))
+}
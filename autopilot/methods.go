@@ -0,0 +1,200 @@
+package autopilot
+
+import (
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+)
+
+type Enable struct {
+	MinRatio  uint64 `json:"minratio,omitempty"`
+	MaxRatio  uint64 `json:"maxratio,omitempty"`
+	MaxAmount uint64 `json:"maxamount,omitempty"`
+	MaxPPM    uint64 `json:"maxppm,omitempty"`
+	MaxJobs   int    `json:"maxjobs,omitempty"`
+}
+
+func (e *Enable) Name() string {
+	return "circular-autopilot-enable"
+}
+
+func (e *Enable) New() interface{} {
+	return &Enable{}
+}
+
+func (e *Enable) Call() (jrpc2.Result, error) {
+	a := GetAutopilot()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	config := *a.Config
+	if e.MinRatio != 0 {
+		config.MinRatio = e.MinRatio
+	}
+	if e.MaxRatio != 0 {
+		config.MaxRatio = e.MaxRatio
+	}
+	if e.MaxAmount != 0 {
+		config.MaxAmount = e.MaxAmount
+	}
+	if e.MaxPPM != 0 {
+		config.MaxPPM = e.MaxPPM
+	}
+	if e.MaxJobs != 0 {
+		config.MaxJobs = e.MaxJobs
+	}
+	if err := validateRatios(config.MinRatio, config.MaxRatio); err != nil {
+		return nil, err
+	}
+
+	a.Config = &config
+	a.Enabled = true
+	a.Node.Logf(glightning.Info, "autopilot enabled: %+v", config)
+	return a.status(), nil
+}
+
+type Disable struct{}
+
+func (d *Disable) Name() string {
+	return "circular-autopilot-disable"
+}
+
+func (d *Disable) New() interface{} {
+	return &Disable{}
+}
+
+func (d *Disable) Call() (jrpc2.Result, error) {
+	a := GetAutopilot()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// jobs that are already running are not affected, use circular-job-cancel to stop them
+	a.Enabled = false
+	a.Node.Logln(glightning.Info, "autopilot disabled")
+	return a.status(), nil
+}
+
+// SetTarget sets the target range of a channel. If both ratios are 0, the channel goes back to the default range
+type SetTarget struct {
+	Scid     string `json:"scid"`
+	MinRatio uint64 `json:"minratio,omitempty"`
+	MaxRatio uint64 `json:"maxratio,omitempty"`
+}
+
+func (s *SetTarget) Name() string {
+	return "circular-autopilot-set"
+}
+
+func (s *SetTarget) New() interface{} {
+	return &SetTarget{}
+}
+
+func (s *SetTarget) Call() (jrpc2.Result, error) {
+	if s.Scid == "" {
+		return nil, util.ErrNoRequiredParameter
+	}
+
+	a := GetAutopilot()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if s.MinRatio == 0 && s.MaxRatio == 0 {
+		delete(a.Targets, s.Scid)
+	} else {
+		if err := validateRatios(s.MinRatio, s.MaxRatio); err != nil {
+			return nil, err
+		}
+		a.Targets[s.Scid] = &Target{
+			MinRatio: s.MinRatio,
+			MaxRatio: s.MaxRatio,
+		}
+	}
+
+	if err := a.saveTargets(); err != nil {
+		return nil, err
+	}
+	return a.status(), nil
+}
+
+func validateRatios(minRatio, maxRatio uint64) error {
+	if minRatio >= maxRatio || maxRatio > 100 {
+		return util.ErrInvalidTargetRatio
+	}
+	return nil
+}
+
+type ChannelStatus struct {
+	Scid     string `json:"scid"`
+	Ratio    uint64 `json:"ratio"`
+	MinRatio uint64 `json:"min_ratio"`
+	MaxRatio uint64 `json:"max_ratio"`
+	Action   string `json:"action"`
+	JobId    uint64 `json:"job_id,omitempty"`
+}
+
+type Status struct {
+	Enabled  bool               `json:"enabled"`
+	LastRun  int64              `json:"last_run"`
+	Config   *Config            `json:"config"`
+	Targets  map[string]*Target `json:"targets"`
+	Channels []*ChannelStatus   `json:"channels"`
+}
+
+func (s *Status) Name() string {
+	return "circular-autopilot-status"
+}
+
+func (s *Status) New() interface{} {
+	return &Status{}
+}
+
+func (s *Status) Call() (jrpc2.Result, error) {
+	a := GetAutopilot()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.status(), nil
+}
+
+// status assumes that the lock is held
+func (a *Autopilot) status() *Status {
+	a.pruneJobs()
+
+	a.Node.PeersLock.RLock()
+	defer a.Node.PeersLock.RUnlock()
+
+	channels := make([]*ChannelStatus, 0)
+	for _, peer := range a.Node.Peers {
+		for _, channel := range peer.Channels {
+			if channel.TotalMsat.MSat() == 0 {
+				continue
+			}
+			target := a.getTarget(channel.ShortChannelId)
+			action := NONE
+			if c := a.checkChannel(channel); c != nil {
+				action = c.action
+			}
+			channels = append(channels, &ChannelStatus{
+				Scid:     channel.ShortChannelId,
+				Ratio:    channel.ToUsMsat.MSat() * 100 / channel.TotalMsat.MSat(),
+				MinRatio: target.MinRatio,
+				MaxRatio: target.MaxRatio,
+				Action:   action,
+				JobId:    a.Jobs[channel.ShortChannelId],
+			})
+		}
+	}
+
+	targets := make(map[string]*Target, len(a.Targets))
+	for scid, target := range a.Targets {
+		targets[scid] = target
+	}
+
+	return &Status{
+		Enabled:  a.Enabled,
+		LastRun:  a.LastRun,
+		Config:   a.Config,
+		Targets:  targets,
+		Channels: channels,
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"circular/autopilot"
 	"circular/node"
 	"fmt"
 	"github.com/elementsproject/glightning/glightning"
 	"github.com/virtuald/go-paniclog"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -35,7 +38,10 @@ func onInit(plugin *glightning.Plugin, options map[string]glightning.Option, con
 		log.Fatalln("error starting plugin: ", err)
 	}
 
+	registerJobResumers(node.GetNode())
 	node.GetNode().Init(lightning, plugin, options, config)
+	autopilot.GetAutopilot().Init(options)
+	node.GetNode().ResumeJobs()
 	log.Printf("circular successfully init'd!\n")
 }
 
@@ -46,7 +52,18 @@ func main() {
 	registerSubscriptions(plugin)
 	registerHooks(plugin)
 
+	// glightning can't subscribe to the shutdown notification, so we shut down
+	// when lightningd terminates us or closes our stdin
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		node.GetNode().Shutdown(node.SHUTDOWN_TIMEOUT)
+		os.Exit(0)
+	}()
+
 	err := plugin.Start(os.Stdin, os.Stdout)
+	node.GetNode().Shutdown(node.SHUTDOWN_TIMEOUT)
 	if err != nil {
 		log.Fatalln(err)
 	}
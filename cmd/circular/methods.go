@@ -1,6 +1,7 @@
 package main
 
 import (
+	"circular/autopilot"
 	"circular/node"
 	"circular/rebalance"
 	"circular/rebalance/parallel"
@@ -28,8 +29,13 @@ func registerMethods(p *glightning.Plugin) {
 	rpcRebalancePush.Category = "utility"
 	p.RegisterMethod(rpcRebalancePush)
 
+	rpcRebalanceFlow := glightning.NewRpcMethod(&parallel.RebalanceFlow{}, "Move liquidity from many sources to many sinks in parallel")
+	rpcRebalanceFlow.LongDesc = "Rebalance the channels in `sinks` from the channels in `sources` concurrently, sharing one amount and one fee budget"
+	rpcRebalanceFlow.Category = "utility"
+	p.RegisterMethod(rpcRebalanceFlow)
+
 	rpcStats := glightning.NewRpcMethod(&node.Stats{}, "Get stats")
-	rpcStats.LongDesc = "Get the stats of the usage of circular"
+	rpcStats.LongDesc = "Get the stats of the rebalances done by circular, optionally filtered by `from`, `to`, `peer`, `scid`, `status`, `minppm` and `maxppm`. Use `raw=true` to get the matching records too"
 	rpcStats.Category = "utility"
 	p.RegisterMethod(rpcStats)
 
@@ -48,4 +54,65 @@ func registerMethods(p *glightning.Plugin) {
 	rpcResume.Category = "utility"
 	p.RegisterMethod(rpcResume)
 
+	rpcBudget := glightning.NewRpcMethod(&node.BudgetStatus{}, "Show the fee budget")
+	rpcBudget.LongDesc = "Show the fees spent on rebalances and what is left of the budget in the last hour, day and week, and for every peer in the last day"
+	rpcBudget.Category = "utility"
+	p.RegisterMethod(rpcBudget)
+
+	rpcBlocklistAdd := glightning.NewRpcMethod(&node.BlocklistAdd{}, "Add nodes and channels to the blocklist")
+	rpcBlocklistAdd.LongDesc = "Keep every rebalance away from the node ids in `nodes` and the short channel ids in `channels`. The blocklist survives restarts"
+	rpcBlocklistAdd.Category = "utility"
+	p.RegisterMethod(rpcBlocklistAdd)
+
+	rpcBlocklistRemove := glightning.NewRpcMethod(&node.BlocklistRemove{}, "Remove nodes and channels from the blocklist")
+	rpcBlocklistRemove.LongDesc = "Allow rebalances through the node ids in `nodes` and the short channel ids in `channels` again"
+	rpcBlocklistRemove.Category = "utility"
+	p.RegisterMethod(rpcBlocklistRemove)
+
+	rpcBlocklistList := glightning.NewRpcMethod(&node.BlocklistList{}, "List the blocklist")
+	rpcBlocklistList.LongDesc = "List the nodes and the channels that no rebalance goes through"
+	rpcBlocklistList.Category = "utility"
+	p.RegisterMethod(rpcBlocklistList)
+
+	rpcJobs := glightning.NewRpcMethod(&node.ListJobs{}, "List jobs")
+	rpcJobs.LongDesc = "List the rebalances that have been started with `async=true` and their progress"
+	rpcJobs.Category = "utility"
+	p.RegisterMethod(rpcJobs)
+
+	rpcJobStatus := glightning.NewRpcMethod(&node.JobStatus{}, "Get the status of a job")
+	rpcJobStatus.LongDesc = "Get the progress of the job `id`, or its result if it is over"
+	rpcJobStatus.Category = "utility"
+	p.RegisterMethod(rpcJobStatus)
+
+	rpcJobCancel := glightning.NewRpcMethod(&node.JobCancel{}, "Cancel a job")
+	rpcJobCancel.LongDesc = "Stop the job `id` from firing new htlcs. Htlcs in flight will be completed"
+	rpcJobCancel.Category = "utility"
+	p.RegisterMethod(rpcJobCancel)
+
+	rpcAutopilotEnable := glightning.NewRpcMethod(&autopilot.Enable{}, "Enable the autopilot")
+	rpcAutopilotEnable.LongDesc = "Enable the autopilot, optionally overriding `minratio`, `maxratio`, `maxamount`, `maxppm` and `maxjobs`"
+	rpcAutopilotEnable.Category = "utility"
+	p.RegisterMethod(rpcAutopilotEnable)
+
+	rpcAutopilotDisable := glightning.NewRpcMethod(&autopilot.Disable{}, "Disable the autopilot")
+	rpcAutopilotDisable.LongDesc = "Stop the autopilot from starting new jobs. Running jobs are not affected"
+	rpcAutopilotDisable.Category = "utility"
+	p.RegisterMethod(rpcAutopilotDisable)
+
+	rpcAutopilotSet := glightning.NewRpcMethod(&autopilot.SetTarget{}, "Set the target range of a channel")
+	rpcAutopilotSet.LongDesc = "Keep the local balance of `scid` between `minratio` and `maxratio` percent. Omit both to use the default range"
+	rpcAutopilotSet.Category = "utility"
+	p.RegisterMethod(rpcAutopilotSet)
+
+	rpcAutopilotStatus := glightning.NewRpcMethod(&autopilot.Status{}, "Get the status of the autopilot")
+	rpcAutopilotStatus.LongDesc = "Get the configuration of the autopilot, the target range of every channel and the jobs it started"
+	rpcAutopilotStatus.Category = "utility"
+	p.RegisterMethod(rpcAutopilotStatus)
+}
+
+// registerJobResumers tells the node how to resume the jobs that were interrupted by a restart
+func registerJobResumers(n *node.Node) {
+	n.RegisterJobResumer((&parallel.RebalancePull{}).Name(), parallel.ResumePull)
+	n.RegisterJobResumer((&parallel.RebalancePush{}).Name(), parallel.ResumePush)
+	n.RegisterJobResumer((&parallel.RebalanceFlow{}).Name(), parallel.ResumeFlow)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"circular/autopilot"
 	"circular/graph"
 	"circular/node"
 	"github.com/elementsproject/glightning/glightning"
@@ -23,16 +24,128 @@ func registerOptions(p *glightning.Plugin) {
 	}
 
 	if err := p.RegisterNewIntOption("circular-liquidity-refresh",
-		"The period of time after which the liquidity is reset (minutes)",
+		"The period of time after which the liquidity is reset, when circular-liquidity-decay is none (minutes)",
 		node.DEFAULT_LIQUIDITY_RESET_INTERVAL); err != nil {
 
 		log.Fatalln("error registering option circular-liquidity-reset:", err)
 	}
 
+	if err := p.RegisterNewIntOption("circular-stats-retention",
+		"How long successes, failures and routes are kept in the database (days). 0 means forever",
+		node.DEFAULT_STATS_RETENTION); err != nil {
+
+		log.Fatalln("error registering option circular-stats-retention:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-final-cltv",
+		"The cltv delta of the last hop of a rebalance, the one that pays us (blocks)",
+		graph.DEFAULT_FINAL_DELAY); err != nil {
+
+		log.Fatalln("error registering option circular-final-cltv:", err)
+	}
+
+	if err := p.RegisterNewOption("circular-liquidity-decay",
+		"How liquidity beliefs decay towards the prior over time (none, linear, exponential)",
+		graph.DEFAULT_LIQUIDITY_DECAY); err != nil {
+
+		log.Fatalln("error registering option circular-liquidity-decay:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-liquidity-half-life",
+		"The period of time after which half of a liquidity belief is forgotten (minutes)",
+		graph.DEFAULT_LIQUIDITY_HALF_LIFE); err != nil {
+
+		log.Fatalln("error registering option circular-liquidity-half-life:", err)
+	}
+
+	if err := p.RegisterNewBoolOption("circular-autopilot",
+		"Whether the autopilot is enabled at startup",
+		false); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-autopilot-interval",
+		"How often the autopilot checks the channels (minutes)",
+		autopilot.DEFAULT_INTERVAL); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot-interval:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-autopilot-min-ratio",
+		"The default minimum local balance of a channel before the autopilot pulls liquidity into it (percent)",
+		autopilot.DEFAULT_MIN_RATIO); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot-min-ratio:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-autopilot-max-ratio",
+		"The default maximum local balance of a channel before the autopilot pushes liquidity out of it (percent)",
+		autopilot.DEFAULT_MAX_RATIO); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot-max-ratio:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-autopilot-max-amount",
+		"The maximum amount the autopilot rebalances on every run (sats)",
+		autopilot.DEFAULT_MAX_AMOUNT); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot-max-amount:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-autopilot-max-ppm",
+		"The maximum ppm the autopilot is willing to pay",
+		autopilot.DEFAULT_MAX_PPM); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot-max-ppm:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-autopilot-max-jobs",
+		"The maximum number of jobs started by the autopilot that can run at the same time",
+		autopilot.DEFAULT_MAX_JOBS); err != nil {
+
+		log.Fatalln("error registering option circular-autopilot-max-jobs:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-budget-hour",
+		"The maximum amount of fees that can be spent on rebalances in the last hour (sats). 0 means no limit",
+		0); err != nil {
+
+		log.Fatalln("error registering option circular-budget-hour:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-budget-day",
+		"The maximum amount of fees that can be spent on rebalances in the last day (sats). 0 means no limit",
+		0); err != nil {
+
+		log.Fatalln("error registering option circular-budget-day:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-budget-week",
+		"The maximum amount of fees that can be spent on rebalances in the last week (sats). 0 means no limit",
+		0); err != nil {
+
+		log.Fatalln("error registering option circular-budget-week:", err)
+	}
+
+	if err := p.RegisterNewIntOption("circular-budget-peer",
+		"The maximum amount of fees that can be spent in the last day on rebalances involving a single peer (sats). 0 means no limit",
+		0); err != nil {
+
+		log.Fatalln("error registering option circular-budget-peer:", err)
+	}
+
 	if err := p.RegisterNewBoolOption("circular-save-stats",
 		"Whether circular should save stats in the database",
 		true); err != nil {
 
 		log.Fatalln("error registering option circular-liquidity-reset:", err)
 	}
+
+	if err := p.RegisterNewBoolOption("circular-resume-jobs",
+		"Whether the circular-pull, circular-push and circular-flow jobs interrupted by a restart are resumed. Otherwise they are marked aborted",
+		false); err != nil {
+
+		log.Fatalln("error registering option circular-resume-jobs:", err)
+	}
 }
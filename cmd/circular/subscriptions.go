@@ -5,15 +5,17 @@ import (
 	"github.com/elementsproject/glightning/glightning"
 )
 
-// TODO: listen for `channel_state_changed` and `channel_opened`
-// 		so we don't have to refresh peer list every time
-// TODO: listen for `shutdown`
+// TODO: listen for `channel_state_changed` once glightning can subscribe to it,
+// 		until then state changes are only detected when refreshing peers
+// TODO: listen for `shutdown` once glightning can subscribe to it,
+// 		until then node.Shutdown is called from main when lightningd terminates us
 
 func registerSubscriptions(p *glightning.Plugin) {
 	p.SubscribeSendPayFailure(OnSendPayFailure)
 	p.SubscribeSendPaySuccess(OnSendPaySuccess)
 	p.SubscribeConnect(OnConnect)
 	p.SubscribeDisconnect(OnDisconnect)
+	p.SubscribeChannelOpened(OnChannelOpened)
 }
 
 func OnSendPayFailure(sf *glightning.SendPayFailure) {
@@ -31,3 +33,7 @@ func OnConnect(c *glightning.ConnectEvent) {
 func OnDisconnect(d *glightning.DisconnectEvent) {
 	node.GetNode().OnDisconnect(d)
 }
+
+func OnChannelOpened(c *glightning.ChannelOpened) {
+	node.GetNode().OnChannelOpened(c)
+}
@@ -1,28 +1,44 @@
 package graph
 
 import (
+	"circular/util"
 	"github.com/elementsproject/glightning/glightning"
 	"time"
 )
 
+// Channel is a directed channel of the graph.
+// We don't know exactly how much liquidity a channel has, but we keep track of
+// a lower and an upper bound: the liquidity is believed to be uniformly distributed between them.
+// The bounds were learned at Timestamp and they decay towards [0, capacity] as time goes by
 type Channel struct {
 	*glightning.Channel `json:"channel"`
-	Liquidity           uint64 `json:"liquidity"`
+	LowerBound          uint64 `json:"lower_bound"`
+	UpperBound          uint64 `json:"upper_bound"`
 	Timestamp           int64  `json:"timestamp"`
 	maxHtlcMsat         uint64
 	minHtlcMsat         uint64
+	decay               *LiquidityDecay
 }
 
-func NewChannel(channel *glightning.Channel, liquidity uint64, timestamp int64) *Channel {
+func NewChannel(channel *glightning.Channel, lowerBound, upperBound uint64, timestamp int64) *Channel {
 	return &Channel{
 		Channel:     channel,
-		Liquidity:   liquidity,
+		LowerBound:  lowerBound,
+		UpperBound:  upperBound,
 		Timestamp:   timestamp,
 		maxHtlcMsat: channel.HtlcMaximumMilliSatoshis.MSat(),
 		minHtlcMsat: channel.HtlcMinimumMilliSatoshis.MSat(),
 	}
 }
 
+// updated returns a copy of the channel with new gossip applied, keeping what we learned about its liquidity.
+// The channel itself is left untouched: routes and rebalances read it without holding the graph lock
+func (c *Channel) updated(channel *glightning.Channel) *Channel {
+	result := NewChannel(channel, c.LowerBound, c.UpperBound, c.Timestamp)
+	result.decay = c.decay
+	return result
+}
+
 func (c *Channel) ComputeFee(amount uint64) uint64 {
 	result := c.BaseFeeMillisatoshi
 	// get the ceiling of the integer division
@@ -56,14 +72,61 @@ func (c *Channel) GetDirection() uint32 {
 	return 1
 }
 
+// Bounds returns the liquidity bounds of the channel after applying the decay
+func (c *Channel) Bounds() (uint64, uint64) {
+	return c.boundsAt(time.Now().Unix())
+}
+
+// boundsAt returns the liquidity bounds of the channel at time now
+func (c *Channel) boundsAt(now int64) (uint64, uint64) {
+	confidence := c.decay.Confidence(now - c.Timestamp)
+	if confidence >= 1 {
+		return c.LowerBound, c.UpperBound
+	}
+	capacity := c.AmountMsat.MSat()
+	lower := uint64(float64(c.LowerBound) * confidence)
+	upper := c.UpperBound + uint64(float64(capacity-util.Min(capacity, c.UpperBound))*(1-confidence))
+	return lower, upper
+}
+
 func (c *Channel) CanForward(amount uint64) bool {
+	_, upper := c.Bounds()
+	return c.canForward(amount, upper)
+}
+
+func (c *Channel) canForward(amount, upper uint64) bool {
 	return c.IsActive &&
-		c.Liquidity >= amount &&
+		upper >= amount &&
 		c.maxHtlcMsat >= amount &&
 		c.minHtlcMsat <= amount
 }
 
+// SuccessProbability returns the probability that the channel is able to forward amount,
+// assuming that the liquidity is uniformly distributed between the lower and the upper bound
+func (c *Channel) SuccessProbability(amount uint64) float64 {
+	lower, upper := c.Bounds()
+	return successProbability(amount, lower, upper)
+}
+
+func successProbability(amount, lower, upper uint64) float64 {
+	if amount <= lower {
+		return 1
+	}
+	if amount > upper {
+		return 0
+	}
+	return float64(upper+1-amount) / float64(upper+1-lower)
+}
+
+// ExpectedLiquidity returns the mean of the liquidity distribution of the channel
+func (c *Channel) ExpectedLiquidity() uint64 {
+	lower, upper := c.Bounds()
+	return lower + (upper-lower)/2
+}
+
+// ResetLiquidity forgets what we learned about the channel: the liquidity can be anywhere in [0, capacity]
 func (c *Channel) ResetLiquidity() {
-	c.Liquidity = uint64(0.5 * float64(c.AmountMsat.MSat()))
+	c.LowerBound = 0
+	c.UpperBound = c.AmountMsat.MSat()
 	c.Timestamp = time.Now().Unix()
 }
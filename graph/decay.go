@@ -0,0 +1,50 @@
+package graph
+
+import (
+	"circular/util"
+	"math"
+	"time"
+)
+
+const (
+	DECAY_NONE                  = "none"
+	DECAY_LINEAR                = "linear"
+	DECAY_EXPONENTIAL           = "exponential"
+	DEFAULT_LIQUIDITY_DECAY     = DECAY_EXPONENTIAL
+	DEFAULT_LIQUIDITY_HALF_LIFE = 60 // minutes
+)
+
+// LiquidityDecay describes how fast we forget what we learned about the liquidity of a channel.
+// As time goes by, the liquidity bounds of a channel move towards the prior [0, capacity]
+type LiquidityDecay struct {
+	Model    string
+	HalfLife time.Duration
+}
+
+func NewLiquidityDecay(model string, halfLife time.Duration) (*LiquidityDecay, error) {
+	switch model {
+	case DECAY_NONE, DECAY_LINEAR, DECAY_EXPONENTIAL:
+	default:
+		return nil, util.ErrInvalidDecayModel
+	}
+	if model != DECAY_NONE && halfLife <= 0 {
+		return nil, util.ErrInvalidHalfLife
+	}
+	return &LiquidityDecay{
+		Model:    model,
+		HalfLife: halfLife,
+	}, nil
+}
+
+// Confidence returns how much we trust a belief that is elapsed seconds old:
+// 1 means that the belief is fresh, 0 means that it has been forgotten
+func (d *LiquidityDecay) Confidence(elapsed int64) float64 {
+	if d == nil || d.Model == DECAY_NONE || elapsed <= 0 {
+		return 1
+	}
+	halfLives := float64(elapsed) / d.HalfLife.Seconds()
+	if d.Model == DECAY_LINEAR {
+		return math.Max(0, 1-halfLives/2)
+	}
+	return math.Pow(0.5, halfLives)
+}
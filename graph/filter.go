@@ -0,0 +1,103 @@
+package graph
+
+import (
+	"circular/util"
+)
+
+// Filter restricts the routes that the pathfinding can return. A nil filter allows every route
+type Filter struct {
+	ExcludeNodes    map[string]bool
+	ExcludeChannels map[string]bool // short channel ids, both directions are excluded
+	ViaNodes        []string        // nodes that the route must go through, in this order
+}
+
+// NewFilter returns the filter of the nodes and channels given to a rebalance, or nil if there are none
+func NewFilter(excludeNodes, excludeChannels, viaNodes []string) (*Filter, error) {
+	if len(excludeNodes) == 0 && len(excludeChannels) == 0 && len(viaNodes) == 0 {
+		return nil, nil
+	}
+	filter := &Filter{
+		ExcludeNodes:    make(map[string]bool, len(excludeNodes)),
+		ExcludeChannels: make(map[string]bool, len(excludeChannels)),
+		ViaNodes:        viaNodes,
+	}
+	for _, id := range excludeNodes {
+		filter.ExcludeNodes[id] = true
+	}
+	for _, scid := range excludeChannels {
+		filter.ExcludeChannels[scid] = true
+	}
+
+	seen := make(map[string]bool, len(viaNodes))
+	for _, id := range viaNodes {
+		if seen[id] || filter.ExcludeNodes[id] {
+			return nil, util.ErrInvalidViaNodes
+		}
+		seen[id] = true
+	}
+	return filter, nil
+}
+
+// Excludes tells whether the channel scid can't be used by the routes
+func (f *Filter) Excludes(scid string) bool {
+	return f != nil && f.ExcludeChannels[scid]
+}
+
+// SetBlocklist replaces the nodes and channels that the pathfinding never uses
+func (g *Graph) SetBlocklist(nodes, channels []string) {
+	g.channelsLock.Lock()
+	defer g.channelsLock.Unlock()
+
+	g.blockedNodes = make(map[string]bool, len(nodes))
+	for _, id := range nodes {
+		g.blockedNodes[id] = true
+	}
+	g.blockedChannels = make(map[string]bool, len(channels))
+	for _, scid := range channels {
+		g.blockedChannels[scid] = true
+	}
+}
+
+// Blocked tells whether the node or the channel id is in the blocklist
+func (g *Graph) Blocked(id string) bool {
+	g.channelsLock.RLock()
+	defer g.channelsLock.RUnlock()
+
+	return g.blockedNodes[id] || g.blockedChannels[id]
+}
+
+// excludedChannels flags the channels excluded by filter and the ones in the blocklist, or returns nil
+// if there are none. It assumes that the read lock on channels is held
+func (g *Graph) excludedChannels(idx *index, filter *Filter) []bool {
+	if len(g.blockedChannels) == 0 && (filter == nil || len(filter.ExcludeChannels) == 0) {
+		return nil
+	}
+	excluded := make([]bool, len(idx.channels))
+	for i, channel := range idx.channels {
+		excluded[i] = g.blockedChannels[channel.ShortChannelId] || filter.Excludes(channel.ShortChannelId)
+	}
+	return excluded
+}
+
+// stops returns the nodes that the route goes through in order, src and dst included.
+// Via nodes that are src or dst are already on the route and are skipped
+func (idx *index) stops(src, dst string, filter *Filter) ([]int32, error) {
+	srcIndex, dstIndex, err := idx.endpoints(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	stops := []int32{srcIndex}
+	if filter != nil {
+		for _, id := range filter.ViaNodes {
+			if id == src || id == dst {
+				continue
+			}
+			i, ok := idx.ids[id]
+			if !ok {
+				return nil, util.ErrNoSuchNode
+			}
+			stops = append(stops, i)
+		}
+	}
+	return append(stops, dstIndex), nil
+}
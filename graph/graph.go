@@ -11,6 +11,7 @@ const (
 	FILE                                = "graph.json"
 	DEFAULT_GRAPH_REFRESH_INTERVAL      = 10      // minutes
 	PRUNING_INTERVAL               uint = 1209600 // 14 days
+	NODE_PENALTY_DURATION               = 600     // seconds
 )
 
 // Edge contains All the SCIDs of the channels going from nodeA to nodeB
@@ -26,6 +27,13 @@ type Graph struct {
 	Channels          map[string]*Channel        `json:"channels"`
 	Inbound           map[string]map[string]Edge `json:"-"`
 	Aliases           map[string]string          `json:"-"`
+	Reputation        map[string]*Reputation     `json:"reputation"`
+	penalizedNodes    map[string]int64
+	blockedNodes      map[string]bool
+	blockedChannels   map[string]bool
+	decay             *LiquidityDecay
+	index             *index
+	indexLock         *sync.Mutex
 	adjacencyListLock *sync.RWMutex
 	channelsLock      *sync.RWMutex
 	aliasesLock       *sync.RWMutex
@@ -36,6 +44,9 @@ func NewGraph() *Graph {
 		Channels:          make(map[string]*Channel),
 		Inbound:           make(map[string]map[string]Edge),
 		Aliases:           make(map[string]string),
+		Reputation:        make(map[string]*Reputation),
+		penalizedNodes:    make(map[string]int64),
+		indexLock:         &sync.Mutex{},
 		adjacencyListLock: &sync.RWMutex{},
 		channelsLock:      &sync.RWMutex{},
 		aliasesLock:       &sync.RWMutex{},
@@ -81,27 +92,68 @@ func (g *Graph) AddChannel(c *Channel) {
 	if c.minHtlcMsat == 0 {
 		c.minHtlcMsat = c.HtlcMinimumMilliSatoshis.MSat()
 	}
+	// graphs saved before liquidity bounds were introduced don't have them
+	if c.LowerBound == 0 && c.UpperBound == 0 {
+		c.UpperBound = c.AmountMsat.MSat()
+	}
+	c.decay = g.decay
+	g.invalidateIndex()
 }
 
-func (g *Graph) RefreshChannels(channelList []*glightning.Channel) {
+// SetLiquidityDecay sets how fast the liquidity beliefs of every channel decay
+func (g *Graph) SetLiquidityDecay(decay *LiquidityDecay) {
+	g.channelsLock.Lock()
+	defer g.channelsLock.Unlock()
+
+	g.decay = decay
+	for _, c := range g.Channels {
+		c.decay = decay
+	}
+}
+
+// RefreshChannels applies the gossip in channelList to the graph and returns how many channels
+// were updated and how many were added. Only channels whose last update or state changed are touched:
+// they are replaced by a copy that keeps the liquidity we learned
+func (g *Graph) RefreshChannels(channelList []*glightning.Channel) (int, int) {
+	// find what changed holding only the read lock, so that pathfinding can go on in the meantime
+	g.channelsLock.RLock()
+	changed := make([]*glightning.Channel, 0)
+	for _, c := range channelList {
+		old, ok := g.Channels[c.ShortChannelId+"/"+util.GetDirection(c.Source, c.Destination)]
+		if !ok || old.LastUpdate != c.LastUpdate || old.IsActive != c.IsActive {
+			changed = append(changed, c)
+		}
+	}
+	g.channelsLock.RUnlock()
+
+	if len(changed) == 0 {
+		return 0, 0
+	}
+
 	g.channelsLock.Lock()
 	g.adjacencyListLock.Lock()
 	defer g.channelsLock.Unlock()
 	defer g.adjacencyListLock.Unlock()
 
-	// we need to do NewChannel and not only update the liquidity because of gossip updates
-	for _, c := range channelList {
-		var channel *Channel
+	added := 0
+	for _, c := range changed {
 		channelId := c.ShortChannelId + "/" + util.GetDirection(c.Source, c.Destination)
-		// if the channel did not exist prior to this refresh estimate its initial liquidity to be 50/50
-		if _, ok := g.Channels[channelId]; !ok {
-			channel = NewChannel(c, uint64(0.5*float64(c.AmountMsat.MSat())), 0)
-			g.AddChannel(channel)
-		} else {
-			channel = NewChannel(c, g.Channels[channelId].Liquidity, g.Channels[channelId].Timestamp)
+		if old, ok := g.Channels[channelId]; ok {
+			g.Channels[channelId] = old.updated(c)
+			continue
 		}
+		// the channel did not exist prior to this refresh: its liquidity can be anywhere between 0 and the capacity
+		channel := NewChannel(c, 0, c.AmountMsat.MSat(), 0)
+		g.AddChannel(channel)
 		g.Channels[channelId] = channel
+		added++
 	}
+
+	// channels have been replaced or added, the pathfinding must see the new ones
+	g.indexLock.Lock()
+	g.index = newIndex(g.Channels)
+	g.indexLock.Unlock()
+	return len(changed) - added, added
 }
 
 func (g *Graph) RefreshAliases(nodes []*glightning.Node) {
@@ -140,6 +192,7 @@ func (g *Graph) DeleteChannel(c *Channel) {
 			break
 		}
 	}
+	g.invalidateIndex()
 }
 
 // assumes valid input
@@ -158,22 +211,98 @@ func (g *Graph) GetAlias(id string) string {
 	return id
 }
 
+// UpdateChannel records that channelId was not able to forward more than amount.
+// This means that the opposite channel has at least capacity - amount liquidity
 func (g *Graph) UpdateChannel(channelId, oppositeChannelId string, amount uint64) {
 	g.channelsLock.Lock()
 	defer g.channelsLock.Unlock()
 
 	now := time.Now().Unix()
 
-	if _, ok := g.Channels[channelId]; ok {
-		g.Channels[channelId].Liquidity = amount
-		g.Channels[channelId].Timestamp = now
+	if channel, ok := g.Channels[channelId]; ok {
+		channel.LowerBound, channel.UpperBound = channel.Bounds()
+		channel.UpperBound = util.Min(channel.UpperBound, amount)
+		channel.LowerBound = util.Min(channel.LowerBound, channel.UpperBound)
+		channel.Timestamp = now
 	}
 
-	if _, ok := g.Channels[oppositeChannelId]; ok {
-		g.Channels[oppositeChannelId].Liquidity =
-			g.Channels[oppositeChannelId].AmountMsat.MSat() - amount
-		g.Channels[oppositeChannelId].Timestamp = now
+	if channel, ok := g.Channels[oppositeChannelId]; ok {
+		channel.LowerBound, channel.UpperBound = channel.Bounds()
+		capacity := channel.AmountMsat.MSat()
+		channel.LowerBound = util.Max(channel.LowerBound, capacity-util.Min(capacity, amount))
+		channel.UpperBound = util.Max(channel.UpperBound, channel.LowerBound)
+		channel.Timestamp = now
+	}
+}
+
+// UpdateChannelSuccess records that channelId successfully forwarded amount.
+// The channel had at least amount liquidity, which has now moved to the opposite channel
+func (g *Graph) UpdateChannelSuccess(channelId, oppositeChannelId string, amount uint64) {
+	g.channelsLock.Lock()
+	defer g.channelsLock.Unlock()
+
+	now := time.Now().Unix()
+
+	channel, ok := g.Channels[channelId]
+	if ok {
+		channel.LowerBound, channel.UpperBound = channel.Bounds()
+		channel.LowerBound = util.Max(channel.LowerBound, amount) - amount
+		channel.UpperBound = util.Max(channel.UpperBound, amount) - amount
+		channel.Timestamp = now
+	}
+
+	if opposite, ok := g.Channels[oppositeChannelId]; ok {
+		opposite.LowerBound, opposite.UpperBound = opposite.Bounds()
+		capacity := opposite.AmountMsat.MSat()
+		opposite.LowerBound = util.Min(capacity, opposite.LowerBound+amount)
+		opposite.UpperBound = util.Min(capacity, opposite.UpperBound+amount)
+		// the opposite channel holds whatever the channel doesn't
+		if channel != nil {
+			opposite.LowerBound = util.Max(opposite.LowerBound, capacity-util.Min(capacity, channel.UpperBound))
+			opposite.UpperBound = util.Min(opposite.UpperBound, capacity-util.Min(capacity, channel.LowerBound))
+		}
+		opposite.UpperBound = util.Max(opposite.UpperBound, opposite.LowerBound)
+		opposite.Timestamp = now
+	}
+}
+
+// DisableChannel marks a channel as inactive until gossip tells us otherwise
+func (g *Graph) DisableChannel(channelId string) {
+	g.channelsLock.Lock()
+	defer g.channelsLock.Unlock()
+
+	if channel, ok := g.Channels[channelId]; ok {
+		channel.IsActive = false
+		channel.Timestamp = time.Now().Unix()
+	}
+}
+
+// RemoveChannel deletes both directions of a channel from the graph
+func (g *Graph) RemoveChannel(scid string) {
+	g.channelsLock.Lock()
+	g.adjacencyListLock.Lock()
+	defer g.channelsLock.Unlock()
+	defer g.adjacencyListLock.Unlock()
+
+	for _, direction := range []string{"0", "1"} {
+		if channel, ok := g.Channels[scid+"/"+direction]; ok {
+			g.DeleteChannel(channel)
+		}
+	}
+}
+
+// PenalizeNode makes the pathfinding ignore a node for NODE_PENALTY_DURATION seconds
+func (g *Graph) PenalizeNode(id string) {
+	g.channelsLock.Lock()
+	defer g.channelsLock.Unlock()
+
+	now := time.Now().Unix()
+	for node, until := range g.penalizedNodes {
+		if until < now {
+			delete(g.penalizedNodes, node)
+		}
 	}
+	g.penalizedNodes[id] = now + NODE_PENALTY_DURATION
 }
 
 func (g *Graph) GetChannel(id string) (*Channel, error) {
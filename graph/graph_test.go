@@ -0,0 +1,146 @@
+package graph
+
+import (
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGraph_UpdateChannelSuccess(t *testing.T) {
+	g := NewGraph()
+	addTestChannel(g, newTestChannel("A", "B", "1x1x1", 1000000, 0))
+	addTestChannel(g, newTestChannel("B", "A", "1x1x1", 1000000, 0))
+
+	// A -> B forwarded 300k: A had at least 300k, now B has at least 300k
+	g.UpdateChannelSuccess("1x1x1/0", "1x1x1/1", 300000)
+	assert.Equal(t, uint64(0), g.Channels["1x1x1/0"].LowerBound)
+	assert.Equal(t, uint64(700000), g.Channels["1x1x1/0"].UpperBound)
+	assert.Equal(t, uint64(300000), g.Channels["1x1x1/1"].LowerBound)
+	assert.Equal(t, uint64(1000000), g.Channels["1x1x1/1"].UpperBound)
+
+	// A -> B failed with 500k: B has at least 500k
+	g.UpdateChannel("1x1x1/0", "1x1x1/1", 500000)
+	assert.Equal(t, uint64(500000), g.Channels["1x1x1/0"].UpperBound)
+	assert.Equal(t, uint64(500000), g.Channels["1x1x1/1"].LowerBound)
+}
+
+func TestGraph_PenalizeNode(t *testing.T) {
+	g := NewGraph()
+	addTestChannel(g, newTestChannel("A", "B", "1x1x1", 1000000000, 1))
+	addTestChannel(g, newTestChannel("B", "D", "2x1x1", 1000000000, 1))
+	addTestChannel(g, newTestChannel("A", "C", "3x1x1", 1000000000, 100))
+	addTestChannel(g, newTestChannel("C", "D", "4x1x1", 1000000000, 100))
+
+	g.PenalizeNode("B")
+	route, err := g.GetRoute("A", "D", 100000000, nil, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C", route.Hops[0].Destination)
+
+	g.RemoveChannel("4x1x1")
+	_, err = g.GetRoute("A", "D", 100000000, nil, 4, 0, 0)
+	assert.Equal(t, util.ErrNoRoute, err)
+}
+
+func TestChannel_Bounds(t *testing.T) {
+	c := newTestChannel("A", "B", "1x1x1", 1000000, 0)
+	c.LowerBound = 400000
+	c.UpperBound = 600000
+	c.Timestamp = time.Now().Unix() - 3600
+
+	// no decay: the bounds stay where they are
+	lower, upper := c.Bounds()
+	assert.Equal(t, uint64(400000), lower)
+	assert.Equal(t, uint64(600000), upper)
+
+	// after one half-life, half of the belief is forgotten
+	decay, err := NewLiquidityDecay(DECAY_EXPONENTIAL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.decay = decay
+	lower, upper = c.Bounds()
+	assert.InDelta(t, 200000, lower, 100)
+	assert.InDelta(t, 800000, upper, 100)
+
+	decay, err = NewLiquidityDecay(DECAY_LINEAR, 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.decay = decay
+	lower, upper = c.Bounds()
+	assert.Equal(t, uint64(0), lower)
+	assert.Equal(t, uint64(1000000), upper)
+
+	_, err = NewLiquidityDecay("step", time.Hour)
+	assert.Equal(t, util.ErrInvalidDecayModel, err)
+}
+
+func TestGraph_RefreshChannels(t *testing.T) {
+	g := NewGraph()
+	gossip := []*glightning.Channel{
+		newTestChannel("A", "B", "1x1x1", 1000000, 10).Channel,
+		newTestChannel("B", "A", "1x1x1", 1000000, 10).Channel,
+	}
+	updated, added := g.RefreshChannels(gossip)
+	assert.Equal(t, 0, updated)
+	assert.Equal(t, 2, added)
+
+	// what we learn about the liquidity survives the next refreshes
+	g.UpdateChannel("1x1x1/0", "1x1x1/1", 500000)
+	channel := g.Channels["1x1x1/0"]
+	updated, added = g.RefreshChannels(gossip)
+	assert.Equal(t, 0, updated)
+	assert.Equal(t, 0, added)
+
+	newer := *gossip[0]
+	newer.LastUpdate++
+	newer.FeePerMillionth = 20
+	updated, added = g.RefreshChannels([]*glightning.Channel{&newer, gossip[1]})
+	assert.Equal(t, 1, updated)
+	assert.Equal(t, 0, added)
+	// the channel is replaced, the one that routes may still be using doesn't change under them
+	assert.Equal(t, uint64(10), channel.FeePerMillionth)
+	channel = g.Channels["1x1x1/0"]
+	assert.Equal(t, uint64(20), channel.FeePerMillionth)
+	assert.Equal(t, uint64(500000), channel.UpperBound)
+
+	route, err := g.GetRoute("A", "B", 100000, nil, 3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1x1x1", route.Hops[0].ShortChannelId)
+
+	// a channel that gets disabled is updated even if its gossip has the same timestamp
+	disabled := newer
+	disabled.IsActive = false
+	updated, added = g.RefreshChannels([]*glightning.Channel{&disabled, gossip[1]})
+	assert.Equal(t, 1, updated)
+	assert.Equal(t, 0, added)
+	assert.True(t, channel.IsActive)
+	channel = g.Channels["1x1x1/0"]
+	_, err = g.GetRoute("A", "B", 100000, nil, 3, 0, 0)
+	assert.Equal(t, util.ErrNoRoute, err)
+
+	// new channels are added next to the known ones and can be used right away
+	gossip = []*glightning.Channel{
+		&disabled,
+		gossip[1],
+		newTestChannel("A", "C", "2x2x2", 1000000, 10).Channel,
+		newTestChannel("C", "B", "3x3x3", 1000000, 10).Channel,
+	}
+	updated, added = g.RefreshChannels(gossip)
+	assert.Equal(t, 0, updated)
+	assert.Equal(t, 2, added)
+	assert.Len(t, g.Channels, 4)
+	assert.Same(t, channel, g.Channels["1x1x1/0"])
+	route, err = g.GetRoute("A", "B", 100000, nil, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2x2x2", route.Hops[0].ShortChannelId)
+	assert.Equal(t, "3x3x3", route.Hops[1].ShortChannelId)
+}
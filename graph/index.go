@@ -0,0 +1,79 @@
+package graph
+
+// inboundEdge is a channel flowing into a node of the index
+type inboundEdge struct {
+	from    int32
+	channel int32
+}
+
+// index is a compact layout of the graph used by the pathfinding.
+// Nodes and channels are identified by their position in contiguous slices,
+// so that Dijkstra doesn't need to hash strings for every edge it relaxes.
+// It is derived from g.Channels and must be rebuilt when channels are added, removed or replaced
+type index struct {
+	nodes    []string
+	ids      map[string]int32
+	channels []*Channel
+	inbound  [][]inboundEdge
+}
+
+func newIndex(channels map[string]*Channel) *index {
+	idx := &index{
+		nodes:    make([]string, 0, len(channels)/4),
+		ids:      make(map[string]int32, len(channels)/4),
+		channels: make([]*Channel, 0, len(channels)),
+		inbound:  make([][]inboundEdge, 0, len(channels)/4),
+	}
+	for _, c := range channels {
+		from := idx.addNode(c.Source)
+		to := idx.addNode(c.Destination)
+		idx.inbound[to] = append(idx.inbound[to], inboundEdge{
+			from:    from,
+			channel: int32(len(idx.channels)),
+		})
+		idx.channels = append(idx.channels, c)
+	}
+	return idx
+}
+
+func (idx *index) addNode(id string) int32 {
+	if i, ok := idx.ids[id]; ok {
+		return i
+	}
+	i := int32(len(idx.nodes))
+	idx.ids[id] = i
+	idx.nodes = append(idx.nodes, id)
+	idx.inbound = append(idx.inbound, nil)
+	return i
+}
+
+// nodeSet converts a set of node ids into a slice of flags indexed like the nodes of the index
+func (idx *index) nodeSet(set map[string]bool) []bool {
+	result := make([]bool, len(idx.nodes))
+	for id, ok := range set {
+		if i, found := idx.ids[id]; found && ok {
+			result[i] = true
+		}
+	}
+	return result
+}
+
+// getIndex returns the index of the graph, building it if the graph changed.
+// It assumes that at least the read locks on channels and adjacency list are held
+func (g *Graph) getIndex() *index {
+	g.indexLock.Lock()
+	defer g.indexLock.Unlock()
+
+	if g.index == nil {
+		g.index = newIndex(g.Channels)
+	}
+	return g.index
+}
+
+// invalidateIndex assumes that the write lock on channels is held
+func (g *Graph) invalidateIndex() {
+	g.indexLock.Lock()
+	defer g.indexLock.Unlock()
+
+	g.index = nil
+}
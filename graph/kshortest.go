@@ -0,0 +1,167 @@
+package graph
+
+import (
+	"circular/util"
+	"sort"
+	"time"
+)
+
+const (
+	MAX_ROUTE_OVERLAP = 0.5 // a route that has this share of its channels in common with a better one is skipped
+	MAX_SPURRED_PATHS = 4   // how many paths per route are used to find candidates, before giving up
+)
+
+// kPath is a candidate path of Yen's algorithm
+type kPath struct {
+	channels []int32
+	cost     int
+}
+
+// GetRoutes looks for up to k routes from src to dst, the best first, with Yen's k-shortest loopless paths.
+// A route that shares at least MAX_ROUTE_OVERLAP of its channels with a better one is skipped, so that
+// the routes rely on different liquidity. Routes are ranked and filtered the same way as GetRoute does.
+// If the filter has via nodes, only the best route is returned
+func (g *Graph) GetRoutes(src, dst string, amount uint64, filter *Filter, maxHops int, maxPPM uint64, maxDelay uint, k int) ([]*Route, error) {
+	maxFee := amount * maxPPM / 1000000
+	paths, err := g.kShortestPaths(src, dst, amount, maxFee, filter, maxHops-2, maxDelay, k) // -2 because we already know the source and destination
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]*Route, len(paths))
+	for i, hops := range paths {
+		routes[i] = NewRoute(src, dst, amount, hops, g)
+	}
+	return routes, nil
+}
+
+func (g *Graph) kShortestPaths(src, dst string, amount, maxFee uint64, filter *Filter, maxHops int, maxDelay uint, k int) ([][]RouteHop, error) {
+	g.channelsLock.RLock()
+	g.adjacencyListLock.RLock()
+	defer g.channelsLock.RUnlock()
+	defer g.adjacencyListLock.RUnlock()
+
+	idx := g.getIndex()
+	stops, err := idx.stops(src, dst, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	excluded := g.excludedNodes(idx, filter, now)
+	blocked := g.excludedChannels(idx, filter)
+	nodeCosts := g.reputationCosts(idx, maxFee, now)
+	first := idx.viaPath(stops, amount, maxFee, excluded, blocked, nodeCosts, maxHops, maxDelay, now)
+	if first == nil {
+		return nil, util.ErrNoRoute
+	}
+	if len(stops) > 2 {
+		return [][]RouteHop{idx.hops(first, amount)}, nil
+	}
+	dstIndex := stops[1]
+
+	// found are the paths of the result, spurred are all the paths that were used to find new candidates
+	found := []kPath{{channels: first}}
+	spurred := [][]int32{first}
+	candidates := make([]kPath, 0)
+	seen := map[string]bool{pathKey(first): true}
+
+	// similar paths are skipped, so more of them than k may be needed
+	for len(found) < k && len(spurred) <= MAX_SPURRED_PATHS*k {
+		previous := spurred[len(spurred)-1]
+		for i := range previous {
+			spurNode := idx.ids[idx.channels[previous[i]].Source]
+			root := previous[:i]
+
+			// the spur path can't continue like a known path with the same root
+			excludedChannels := make([]bool, len(idx.channels))
+			copy(excludedChannels, blocked)
+			for _, path := range spurred {
+				if len(path) > i && samePath(path[:i], root) {
+					excludedChannels[path[i]] = true
+				}
+			}
+			// and can't go back through the root, so that the path stays loopless
+			spurExcluded := make([]bool, len(excluded))
+			copy(spurExcluded, excluded)
+			for _, channel := range root {
+				spurExcluded[idx.ids[idx.channels[channel].Source]] = true
+			}
+
+			spur := idx.shortestPath(spurNode, dstIndex, amount, maxFee, spurExcluded, excludedChannels, nodeCosts, maxHops-i, maxDelay, now)
+			if spur == nil {
+				continue
+			}
+			path := make([]int32, 0, len(root)+len(spur))
+			path = append(append(path, root...), spur...)
+			if seen[pathKey(path)] {
+				continue
+			}
+			seen[pathKey(path)] = true
+
+			// the fees of the root depend on the spur, so the whole path is checked again
+			if cost, ok := idx.pathCost(path, amount, maxFee, nodeCosts, maxDelay, now); ok {
+				candidates = append(candidates, kPath{channels: path, cost: cost})
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].cost < candidates[j].cost
+		})
+		best := candidates[0]
+		candidates = candidates[1:]
+		spurred = append(spurred, best.channels)
+
+		if !overlaps(best.channels, found) {
+			found = append(found, best)
+		}
+	}
+
+	result := make([][]RouteHop, len(found))
+	for i, path := range found {
+		result[i] = idx.hops(path.channels, amount)
+	}
+	return result, nil
+}
+
+// overlaps tells whether path shares at least MAX_ROUTE_OVERLAP of its channels with one of paths
+func overlaps(path []int32, paths []kPath) bool {
+	for _, other := range paths {
+		shared := 0
+		for _, a := range path {
+			for _, b := range other.channels {
+				if a == b {
+					shared++
+					break
+				}
+			}
+		}
+		if float64(shared) >= MAX_ROUTE_OVERLAP*float64(len(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func samePath(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func pathKey(path []int32) string {
+	key := make([]byte, 0, len(path)*4)
+	for _, channel := range path {
+		key = append(key, byte(channel>>24), byte(channel>>16), byte(channel>>8), byte(channel))
+	}
+	return string(key)
+}
@@ -3,12 +3,21 @@ package graph
 import (
 	"circular/util"
 	"container/heap"
-	"log"
-	"strings"
+	"math"
+	"time"
 )
 
-func (g *Graph) GetRoute(src, dst string, amount uint64, exclude map[string]bool, maxHops int) (*Route, error) {
-	hops, err := g.dijkstra(src, dst, amount, exclude, maxHops-2) // -2 because we already know the source and destination
+// GetRoute looks for the route from src to dst that maximizes the expected value of the payment.
+// We consider maxFee (derived from maxPPM) to be the value of succeeding, so the expected value
+// of a route is P(success) * (maxFee - fee). This is approximated by minimizing the additive cost
+// fee + maxFee * -log(P(success)), pruning every path that costs more than maxFee.
+// Nodes with a bad reputation add to the cost as if they lowered the probability of success.
+// If maxPPM is 0, there is no fee limit and the cheapest route is returned.
+// Paths whose delays add up to more than maxDelay blocks are pruned, unless maxDelay is 0.
+// The route avoids the blocklist and follows filter, which can be nil.
+func (g *Graph) GetRoute(src, dst string, amount uint64, filter *Filter, maxHops int, maxPPM uint64, maxDelay uint) (*Route, error) {
+	maxFee := amount * maxPPM / 1000000
+	hops, err := g.dijkstra(src, dst, amount, maxFee, filter, maxHops-2, maxDelay) // -2 because we already know the source and destination
 	if err != nil {
 		return nil, err
 	}
@@ -17,34 +26,141 @@ func (g *Graph) GetRoute(src, dst string, amount uint64, exclude map[string]bool
 	return route, nil
 }
 
-func (g *Graph) dijkstra(src, dst string, amount uint64, exclude map[string]bool, maxHops int) ([]RouteHop, error) {
-	// start from the destination and find the source so that we can compute fees
-	// TODO: consider that 32bits fees can be a problem but the api does it in that way
+func (g *Graph) dijkstra(src, dst string, amount, maxFee uint64, filter *Filter, maxHops int, maxDelay uint) ([]RouteHop, error) {
 	g.channelsLock.RLock()
 	g.adjacencyListLock.RLock()
 	defer g.channelsLock.RUnlock()
 	defer g.adjacencyListLock.RUnlock()
 
-	if _, ok := g.Inbound[dst]; !ok {
-		return nil, util.ErrNoSuchNode
+	idx := g.getIndex()
+	stops, err := idx.stops(src, dst, filter)
+	if err != nil {
+		return nil, err
 	}
-	if _, ok := g.Inbound[src]; !ok {
-		return nil, util.ErrNoSuchNode
+
+	now := time.Now().Unix()
+	path := idx.viaPath(stops, amount, maxFee, g.excludedNodes(idx, filter, now), g.excludedChannels(idx, filter), g.reputationCosts(idx, maxFee, now), maxHops, maxDelay, now)
+	if path == nil {
+		return nil, util.ErrNoRoute
+	}
+	return idx.hops(path, amount), nil
+}
+
+// endpoints returns the positions of src and dst in the index
+func (idx *index) endpoints(src, dst string) (int32, int32, error) {
+	srcIndex, ok := idx.ids[src]
+	if !ok {
+		return 0, 0, util.ErrNoSuchNode
+	}
+	dstIndex, ok := idx.ids[dst]
+	if !ok {
+		return 0, 0, util.ErrNoSuchNode
+	}
+	return srcIndex, dstIndex, nil
+}
+
+// excludedNodes flags the nodes excluded by filter, the ones in the blocklist and the ones that are
+// still penalized. It assumes that the read lock on channels is held
+func (g *Graph) excludedNodes(idx *index, filter *Filter, now int64) []bool {
+	excluded := idx.nodeSet(g.blockedNodes)
+	if filter != nil {
+		for id, ok := range filter.ExcludeNodes {
+			if i, found := idx.ids[id]; found && ok {
+				excluded[i] = true
+			}
+		}
+	}
+	for id, until := range g.penalizedNodes {
+		if i, ok := idx.ids[id]; ok && until >= now {
+			excluded[i] = true
+		}
+	}
+	return excluded
+}
+
+// viaPath returns the path from the first stop to the last one through the others, in order.
+// The legs are found from the last one, since the fees of a leg depend on the amount that the
+// following ones forward. Each leg is the cheapest with what is left of the fee, hop and delay
+// budgets, and it can't go through the other stops or the nodes of the legs already found
+func (idx *index) viaPath(stops []int32, amount, maxFee uint64, excluded, excludedChannels []bool, nodeCosts []int, maxHops int, maxDelay uint, now int64) []int32 {
+	if len(stops) == 2 {
+		return idx.shortestPath(stops[0], stops[1], amount, maxFee, excluded, excludedChannels, nodeCosts, maxHops, maxDelay, now)
+	}
+
+	// the stops are only allowed in their own legs, unless they are excluded
+	for _, stop := range stops[:len(stops)-1] {
+		if excluded[stop] {
+			return nil
+		}
+	}
+	legExcluded := make([]bool, len(excluded))
+	copy(legExcluded, excluded)
+	for _, stop := range stops {
+		legExcluded[stop] = true
+	}
+
+	target := amount
+	var delay uint
+	path := make([]int32, 0, 10)
+	for i := len(stops) - 2; i >= 0; i-- {
+		// each of the i legs left needs at least a hop
+		legMaxHops := maxHops - len(path) - i
+		if legMaxHops < 1 {
+			return nil
+		}
+		var legMaxFee uint64
+		if maxFee > 0 {
+			if amount-target >= maxFee {
+				return nil
+			}
+			legMaxFee = maxFee - (amount - target)
+		}
+		var legMaxDelay uint
+		if maxDelay > 0 {
+			if delay >= maxDelay {
+				return nil
+			}
+			legMaxDelay = maxDelay - delay
+		}
+
+		legExcluded[stops[i]] = false
+		leg := idx.shortestPath(stops[i], stops[i+1], amount, legMaxFee, legExcluded, excludedChannels, nodeCosts, legMaxHops, legMaxDelay, now)
+		legExcluded[stops[i]] = true
+		if leg == nil {
+			return nil
+		}
+
+		hops := idx.hops(leg, amount)
+		amount = hops[0].MilliSatoshi
+		delay += hops[0].Delay
+		for _, channel := range leg {
+			legExcluded[idx.ids[idx.channels[channel].Source]] = true
+		}
+		path = append(leg, path...)
 	}
+	return path
+}
 
-	// initialize data structures
-	distance := make(map[string]int)
+// shortestPath returns the channels of the cheapest path from src to dst, as positions in the index,
+// or nil if there is none. Channels flagged in excludedChannels are not used, excludedChannels may be nil.
+// Going through a node adds its cost in nodeCosts, which may be nil too
+func (idx *index) shortestPath(srcIndex, dstIndex int32, amount, maxFee uint64, excluded, excludedChannels []bool, nodeCosts []int, maxHops int, maxDelay uint, now int64) []int32 {
+	// start from the destination and find the source so that we can compute fees
+	// TODO: consider that 32bits fees can be a problem but the api does it in that way
+	target := amount
 	maxDistance := 1 << 31
-	for u := range g.Inbound {
+	distance := make([]int, len(idx.nodes))
+	for u := range distance {
 		distance[u] = maxDistance
 	}
-	distance[dst] = 0
-	hop := make(map[string]RouteHop)
+	distance[dstIndex] = 0
+	// hop[v] is the channel used to go from v towards the destination
+	hop := make([]int32, len(idx.nodes))
 
 	// initialize priority queue, put destination in
 	pq := make(PriorityQueue, 1, 16)
 	pq[0] = &Item{value: &PqItem{
-		Node:   dst,
+		Node:   dstIndex,
 		Amount: amount,
 		Delay:  0,
 		Hops:   0,
@@ -66,7 +182,7 @@ func (g *Graph) dijkstra(src, dst string, amount uint64, exclude map[string]bool
 		}
 
 		// if we reached the source, we are done
-		if u == src {
+		if u == srcIndex {
 			break
 		}
 
@@ -75,67 +191,114 @@ func (g *Graph) dijkstra(src, dst string, amount uint64, exclude map[string]bool
 			continue
 		}
 
-		// check all the neighbors of the current node
-		for v, edge := range g.Inbound[u] {
-			if exclude[v] {
+		// check all the channels flowing into the current node (there may be multiple channels between two nodes)
+		for _, edge := range idx.inbound[u] {
+			v := edge.from
+			if excluded[v] {
 				continue
 			}
+			if excludedChannels != nil && excludedChannels[edge.channel] {
+				continue
+			}
+			channel := idx.channels[edge.channel]
 
-			// for each channel in the edge between two nodes (there may be multiple channels between two nodes)
-			for _, scid := range edge {
-
-				// some optimization for concatenating strings
-				var sb strings.Builder
-				sb.WriteString(scid)
-				sb.WriteString("/")
-				sb.WriteString(util.GetDirection(v, u))
-				channelId := sb.String()
-
-				//channelId := scid + "/" + util.GetDirection(v, u)
-				if _, ok := g.Channels[channelId]; !ok {
-					log.Println("channel not found:", channelId)
-					continue
-				}
-				channel := g.Channels[channelId]
-
-				// check if the channel is usable
-				if !channel.CanForward(amount) {
-					continue
-				}
-
-				// compute fees and update the priority queue if we found a better way to reach v
-				channelFee := channel.ComputeFee(amount)
-				newDistance := distance[u] + int(channelFee)
-				if newDistance < distance[v] {
-
-					// now v is reachable from u with a lower distance
-					distance[v] = newDistance
-
-					// add v to the priority queue while computing fees, delay and hops
-					hop[v] = RouteHop{
-						channel,
-						amount + channelFee,
-						delay + channel.Delay,
-					}
-					heap.Push(&pq, &Item{value: &PqItem{
-						Node:   v,
-						Amount: amount + channelFee,
-						Delay:  delay + channel.Delay,
-						Hops:   hops + 1,
-					}, priority: newDistance})
-				}
+			// check if the channel is usable
+			lower, upper := channel.boundsAt(now)
+			if !channel.canForward(amount, upper) {
+				continue
+			}
+
+			// discard the channel if it would lock the payment for too long
+			if maxDelay > 0 && delay+channel.Delay > maxDelay {
+				continue
+			}
+
+			// discard the channel if it would make the route exceed the fee budget
+			channelFee := channel.ComputeFee(amount)
+			if maxFee > 0 && amount+channelFee-target > maxFee {
+				continue
+			}
+
+			// compute the cost and update the priority queue if we found a better way to reach v
+			newDistance := distance[u] + int(channelFee) + probabilityPenalty(successProbability(amount, lower, upper), maxFee)
+			if nodeCosts != nil {
+				newDistance += nodeCosts[v]
+			}
+			if newDistance < distance[v] {
+
+				// now v is reachable from u with a lower distance
+				distance[v] = newDistance
+
+				// add v to the priority queue while computing fees, delay and hops
+				hop[v] = edge.channel
+				heap.Push(&pq, &Item{value: &PqItem{
+					Node:   v,
+					Amount: amount + channelFee,
+					Delay:  delay + channel.Delay,
+					Hops:   hops + 1,
+				}, priority: newDistance})
 			}
 		}
 	}
 	// if we did not reach the source, we did not find a route
-	if distance[src] == maxDistance {
-		return nil, util.ErrNoRoute
+	if distance[srcIndex] == maxDistance {
+		return nil
+	}
+
+	path := make([]int32, 0, 10)
+	for u := srcIndex; u != dstIndex; u = idx.ids[idx.channels[hop[u]].Destination] {
+		path = append(path, hop[u])
+	}
+	return path
+}
+
+// hops builds the hops of a path, computing fees and delays from the destination
+func (idx *index) hops(path []int32, amount uint64) []RouteHop {
+	hops := make([]RouteHop, len(path))
+	var delay uint
+	for i := len(path) - 1; i >= 0; i-- {
+		channel := idx.channels[path[i]]
+		amount += channel.ComputeFee(amount)
+		delay += channel.Delay
+		hops[i] = RouteHop{channel, amount, delay}
 	}
+	return hops
+}
+
+// pathCost returns the cost of a path the same way the pathfinding computes it, and false
+// if a channel can't forward its amount, the fees exceed maxFee or the delays exceed maxDelay
+func (idx *index) pathCost(path []int32, amount, maxFee uint64, nodeCosts []int, maxDelay uint, now int64) (int, bool) {
+	target := amount
+	cost := 0
+	var delay uint
+	for i := len(path) - 1; i >= 0; i-- {
+		channel := idx.channels[path[i]]
+		lower, upper := channel.boundsAt(now)
+		if !channel.canForward(amount, upper) {
+			return 0, false
+		}
+		channelFee := channel.ComputeFee(amount)
+		cost += int(channelFee) + probabilityPenalty(successProbability(amount, lower, upper), maxFee)
+		if nodeCosts != nil {
+			cost += nodeCosts[idx.ids[channel.Source]]
+		}
+		amount += channelFee
+		delay += channel.Delay
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		return 0, false
+	}
+	if maxFee > 0 && amount-target > maxFee {
+		return 0, false
+	}
+	return cost, true
+}
 
-	// now we have the hop map, we can build the hops
-	hops := make([]RouteHop, 0, 10)
-	for u := src; u != dst; u = hop[u].Destination {
-		hops = append(hops, hop[u])
+// probabilityPenalty converts the probability of failure of a channel into a cost, so that
+// routes that are more likely to succeed are preferred over slightly cheaper ones
+func probabilityPenalty(probability float64, maxFee uint64) int {
+	if probability >= 1 {
+		return 0
 	}
-	return hops, nil
+	return int(float64(maxFee) * -math.Log(probability))
 }
@@ -4,6 +4,7 @@ import (
 	"circular/util"
 	"encoding/json"
 	"fmt"
+	"github.com/elementsproject/glightning/glightning"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"os"
@@ -42,19 +43,19 @@ func TestPathfinderBasic(t *testing.T) {
 	src := "02d41224b71a5346a656f8949c66d11495e39dac55ab8772f55c26ca515db910ea"
 	dst := "03c731efa9935d869d87e57d4496de2b3badfb9ec7dbbd40051fb19351027336c5"
 	amount := 200000000
-	exclude := map[string]bool{
+	filter := &Filter{ExcludeNodes: map[string]bool{
 		"02a30b35b374b0bde273f2e36f1a6db9b1d9f4591d00416ffa541b6eb16e70921f": true,
-	}
+	}}
 	maxHops := 10
 
-	hops, err := graph.dijkstra(src, dst, uint64(amount), exclude, maxHops)
+	hops, err := graph.dijkstra(src, dst, uint64(amount), 0, filter, maxHops, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.LessOrEqual(t, len(hops), maxHops)
 	for i := 0; i < len(hops)-1; i++ {
 		assert.Equal(t, hops[i].Destination, hops[i+1].Source)
-		assert.GreaterOrEqual(t, hops[i].Liquidity, hops[i].MilliSatoshi)
+		assert.GreaterOrEqual(t, hops[i].UpperBound, hops[i].MilliSatoshi)
 		assert.GreaterOrEqual(t, hops[i].MilliSatoshi, hops[i+1].MilliSatoshi)
 		assert.Greater(t, hops[i].Delay, hops[i+1].Delay)
 	}
@@ -62,12 +63,273 @@ func TestPathfinderBasic(t *testing.T) {
 	assert.Equal(t, hops[0].Source, src)
 }
 
+func newTestChannel(source, destination, scid string, capacity, feePPM uint64) *Channel {
+	return NewChannel(&glightning.Channel{
+		Source:                   source,
+		Destination:              destination,
+		ShortChannelId:           scid,
+		AmountMsat:               glightning.AmountFromMSat(capacity),
+		IsActive:                 true,
+		FeePerMillionth:          feePPM,
+		Delay:                    40,
+		HtlcMinimumMilliSatoshis: glightning.AmountFromMSat(1000),
+		HtlcMaximumMilliSatoshis: glightning.AmountFromMSat(capacity),
+	}, 0, capacity, 0)
+}
+
+func addTestChannel(g *Graph, c *Channel) {
+	g.Channels[c.ShortChannelId+"/"+util.GetDirection(c.Source, c.Destination)] = c
+	g.AddChannel(c)
+	allocate(&g.Inbound, c.Source, c.Destination)
+}
+
+// newDiamondGraph returns a graph with two routes from A to D: A-B-D, and A-C-D that costs twice as much
+func newDiamondGraph() *Graph {
+	g := NewGraph()
+	addTestChannel(g, newTestChannel("A", "B", "1x1x1", 1000000000, 1))
+	addTestChannel(g, newTestChannel("B", "D", "2x1x1", 1000000000, 1))
+	addTestChannel(g, newTestChannel("A", "C", "3x1x1", 1000000000, 2))
+	addTestChannel(g, newTestChannel("C", "D", "4x1x1", 1000000000, 2))
+	return g
+}
+
+func TestPathfinderPrefersLikelyRoutes(t *testing.T) {
+	// A-B-D is cheaper, but we believe B-D has little liquidity
+	g := newDiamondGraph()
+	g.Channels["2x1x1/0"].UpperBound = 110000000
+
+	amount := uint64(100000000)
+	route, err := g.GetRoute("A", "D", amount, nil, 4, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C", route.Hops[0].Destination)
+
+	// without a fee budget we only look at fees
+	route, err = g.GetRoute("A", "D", amount, nil, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "B", route.Hops[0].Destination)
+
+	// a tighter budget excludes the more expensive route
+	route, err = g.GetRoute("A", "D", amount, nil, 4, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "B", route.Hops[0].Destination)
+}
+
+func TestPathfinderMaxDelay(t *testing.T) {
+	// A-B-D is cheaper, but B asks for a large cltv delta
+	g := newDiamondGraph()
+	g.Channels["1x1x1/0"].Delay = 1000
+
+	amount := uint64(100000000)
+	route, err := g.GetRoute("A", "D", amount, nil, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "B", route.Hops[0].Destination)
+
+	route, err = g.GetRoute("A", "D", amount, nil, 4, 0, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C", route.Hops[0].Destination)
+	assert.LessOrEqual(t, route.Hops[0].Delay, uint(500))
+
+	routes, err := g.GetRoutes("A", "D", amount, nil, 4, 0, 500, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, routes, 1)
+
+	_, err = g.GetRoute("A", "D", amount, nil, 4, 0, 50)
+	assert.Equal(t, util.ErrNoRoute, err)
+}
+
+func TestPathfinderReputation(t *testing.T) {
+	// A-B-D is cheaper, but B failed payments
+	g := newDiamondGraph()
+	g.AddPenalty("B", FAILURE_PENALTY)
+	assert.InDelta(t, FAILURE_PENALTY, g.GetPenalty("B"), 0.01)
+
+	amount := uint64(100000000)
+	route, err := g.GetRoute("A", "D", amount, nil, 4, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C", route.Hops[0].Destination)
+
+	routes, err := g.GetRoutes("A", "D", amount, nil, 4, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C", routes[0].Hops[0].Destination)
+
+	// without a fee budget we only look at fees
+	route, err = g.GetRoute("A", "D", amount, nil, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "B", route.Hops[0].Destination)
+
+	// the reputation is saved with the graph
+	data, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewGraph()
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	assert.InDelta(t, FAILURE_PENALTY, loaded.GetPenalty("B"), 0.01)
+
+	// after a few half lives B is forgiven
+	g.Reputation["B"].Timestamp -= 10 * REPUTATION_HALF_LIFE
+	assert.Less(t, g.GetPenalty("B"), 0.001)
+	route, err = g.GetRoute("A", "D", amount, nil, 4, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "B", route.Hops[0].Destination)
+
+	// and forgotten on the next penalty
+	g.AddPenalty("C", LIQUIDITY_FAILURE_PENALTY)
+	assert.NotContains(t, g.Reputation, "B")
+}
+
+func TestPathfinderKShortestRoutes(t *testing.T) {
+	// three disjoint routes from A to D, the cheapest first, and a variation of the cheapest one
+	g := newDiamondGraph()
+	addTestChannel(g, newTestChannel("A", "E", "5x1x1", 1000000000, 3))
+	addTestChannel(g, newTestChannel("E", "D", "6x1x1", 1000000000, 3))
+	addTestChannel(g, newTestChannel("B", "D", "7x1x1", 1000000000, 1))
+
+	amount := uint64(100000000)
+	routes, err := g.GetRoutes("A", "D", amount, nil, 5, 0, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := g.GetRoute("A", "D", amount, nil, 5, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, route.Hops, routes[0].Hops)
+
+	// the other channel from B to D shares A-B with the best route, so it is skipped
+	assert.Len(t, routes, 3)
+	assert.Equal(t, "B", routes[0].Hops[0].Destination)
+	assert.Equal(t, "C", routes[1].Hops[0].Destination)
+	assert.Equal(t, "E", routes[2].Hops[0].Destination)
+	for _, r := range routes {
+		assert.Equal(t, "D", r.Hops[len(r.Hops)-1].Destination)
+	}
+
+	// there are no more routes than the graph has
+	routes, err = g.GetRoutes("A", "D", amount, nil, 5, 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, routes, 3)
+
+	_, err = g.GetRoutes("A", "D", amount, &Filter{ExcludeNodes: map[string]bool{"B": true, "C": true, "E": true}}, 5, 0, 0, 3)
+	assert.Equal(t, util.ErrNoRoute, err)
+}
+
+func TestPathfinderFilter(t *testing.T) {
+	g := newDiamondGraph()
+	addTestChannel(g, newTestChannel("C", "E", "5x1x1", 1000000000, 2))
+	addTestChannel(g, newTestChannel("E", "D", "6x1x1", 1000000000, 2))
+	amount := uint64(100000000)
+
+	filter, err := NewFilter(nil, []string{"1x1x1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := g.GetRoute("A", "D", amount, filter, 5, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C", route.Hops[0].Destination)
+
+	// the route must go through E, after C
+	filter, err = NewFilter(nil, nil, []string{"E"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err = g.GetRoute("A", "D", amount, filter, 5, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, route.Hops, 3)
+	assert.Equal(t, "E", route.Hops[1].Destination)
+	assert.Greater(t, route.Hops[0].MilliSatoshi, route.Hops[1].MilliSatoshi)
+	assert.Greater(t, route.Hops[0].Delay, route.Hops[1].Delay)
+
+	// the legs can't be longer than the route
+	_, err = g.GetRoute("A", "D", amount, filter, 4, 0, 0)
+	assert.Equal(t, util.ErrNoRoute, err)
+
+	_, err = NewFilter([]string{"E"}, nil, []string{"E"})
+	assert.Equal(t, util.ErrInvalidViaNodes, err)
+
+	// the blocklist applies to every route
+	g.SetBlocklist([]string{"C"}, nil)
+	assert.True(t, g.Blocked("C"))
+	route, err = g.GetRoute("A", "D", amount, nil, 5, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "B", route.Hops[0].Destination)
+	_, err = g.GetRoutes("A", "D", amount, filter, 5, 0, 0, 3)
+	assert.Equal(t, util.ErrNoRoute, err)
+}
+
+func TestChannelSuccessProbability(t *testing.T) {
+	c := newTestChannel("A", "B", "1x1x1", 1000000, 0)
+	c.LowerBound = 200000
+	c.UpperBound = 600000
+	assert.Equal(t, 1.0, c.SuccessProbability(200000))
+	assert.Equal(t, 0.0, c.SuccessProbability(600001))
+	assert.InDelta(t, 0.5, c.SuccessProbability(400000), 0.001)
+	assert.Equal(t, uint64(400000), c.ExpectedLiquidity())
+}
+
+// newRandomGraph returns a graph with the given number of nodes, where every node opens channels
+// with random peers. Fees and capacities are random as well
+func newRandomGraph(nodes, channelsPerNode int) *Graph {
+	channels := make([]*glightning.Channel, 0, 2*nodes*channelsPerNode)
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < channelsPerNode; j++ {
+			peer := rand.Intn(nodes)
+			if peer == i {
+				continue
+			}
+			scid := fmt.Sprintf("%dx%dx0", i, j)
+			capacity := uint64(1000000000 + rand.Intn(9000000000))
+			for _, c := range []*Channel{
+				newTestChannel(fmt.Sprintf("node%d", i), fmt.Sprintf("node%d", peer), scid, capacity, uint64(rand.Intn(1000))),
+				newTestChannel(fmt.Sprintf("node%d", peer), fmt.Sprintf("node%d", i), scid, capacity, uint64(rand.Intn(1000))),
+			} {
+				channels = append(channels, c.Channel)
+			}
+		}
+	}
+	g := NewGraph()
+	g.RefreshChannels(channels)
+	return g
+}
+
+// BenchmarkGraph_GetRoute runs on testdata/mainnet_graph.json if it is there, otherwise on a random graph
+// of about the same size (15000 nodes and 90000 directed channels)
 func BenchmarkGraph_GetRoute(b *testing.B) {
+	rand.Seed(69)
 	graph, err := LoadGraphFromFile("testdata", "mainnet_graph.json")
 	if err != nil {
-		b.Fatal(err)
+		graph = newRandomGraph(15000, 3)
 	}
-	rand.Seed(69)
 
 	// get a slice of the ids of all the nodes in the graph
 	ids := make([]string, len(graph.Inbound))
@@ -84,13 +346,12 @@ func BenchmarkGraph_GetRoute(b *testing.B) {
 
 	for _, h := range inputs {
 		b.Run(fmt.Sprintf("dijkstra_%d_maxhops", h), func(b *testing.B) {
-			b.N = 1000
 			for i := 0; i < b.N; i++ {
 				// get random key from inbound map
 				src := ids[rand.Intn(len(ids))]
 				dst := ids[rand.Intn(len(ids))]
 				amount := uint64(rand.Intn(1000000000))
-				graph.GetRoute(src, dst, amount, nil, h)
+				graph.GetRoute(src, dst, amount, nil, h, 0, 0)
 			}
 		})
 	}
@@ -5,7 +5,7 @@ import (
 )
 
 type PqItem struct {
-	Node   string
+	Node   int32
 	Amount uint64
 	Delay  uint
 	Hops   int
@@ -24,6 +24,7 @@ type PrettyRoute struct {
 	Amount           uint64           `json:"amount_sat"`
 	Fee              uint64           `json:"fee_msat"`
 	FeePPM           uint64           `json:"ppm"`
+	Probability      float64          `json:"probability"`
 	Hops             []PrettyRouteHop `json:"hops"`
 }
 
@@ -67,6 +68,7 @@ func NewPrettyRoute(route *Route, paymentHash string) *PrettyRoute {
 		Amount:           route.Amount / 1000,
 		Fee:              route.Fee(),
 		FeePPM:           route.FeePPM(),
+		Probability:      route.Probability(),
 		Hops:             hops,
 	}
 }
@@ -77,6 +79,7 @@ func (r *PrettyRoute) String() string {
 	result += "Amount: " + strconv.FormatUint(r.Amount, 10) + "\n"
 	result += "Fee: " + strconv.FormatUint(r.Fee, 10) + "msat\n"
 	result += "Fee PPM: " + strconv.FormatUint(r.FeePPM, 10) + "\n"
+	result += "Probability: " + strconv.FormatFloat(r.Probability, 'f', 3, 64) + "\n"
 	result += "Hops: " + strconv.Itoa(len(r.Hops)) + "\n"
 
 	for i := 0; i < len(r.Hops); i++ {
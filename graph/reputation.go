@@ -0,0 +1,79 @@
+package graph
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	REPUTATION_HALF_LIFE      = 24 * 60 * 60 // seconds
+	REPUTATION_MIN_PENALTY    = 0.01         // below this, a node is forgotten
+	FAILURE_PENALTY           = 1.0          // the node failed for a reason other than liquidity
+	LIQUIDITY_FAILURE_PENALTY = 0.1          // the node didn't have enough liquidity
+	TIMEOUT_PENALTY           = 1.0          // the payment timed out, the node may be holding it
+	STUCK_PENALTY             = 3.0          // the node failed the payment only after it timed out
+)
+
+// Reputation is how unreliable a node has been as a router. The penalty grows with every failure
+// the node causes and halves every REPUTATION_HALF_LIFE seconds, so that flaky nodes are avoided
+// for a while without being banned for good
+type Reputation struct {
+	Penalty   float64 `json:"penalty"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+func (r *Reputation) penaltyAt(now int64) float64 {
+	return r.Penalty * math.Pow(0.5, float64(now-r.Timestamp)/REPUTATION_HALF_LIFE)
+}
+
+// AddPenalty lowers the reputation of a node
+func (g *Graph) AddPenalty(id string, penalty float64) {
+	g.channelsLock.Lock()
+	defer g.channelsLock.Unlock()
+
+	now := time.Now().Unix()
+	if g.Reputation == nil {
+		g.Reputation = make(map[string]*Reputation)
+	}
+	for node, r := range g.Reputation {
+		if r.penaltyAt(now) < REPUTATION_MIN_PENALTY {
+			delete(g.Reputation, node)
+		}
+	}
+
+	if r, ok := g.Reputation[id]; ok {
+		penalty += r.penaltyAt(now)
+	}
+	g.Reputation[id] = &Reputation{Penalty: penalty, Timestamp: now}
+}
+
+// GetPenalty returns the current penalty of a node, 0 if it has a clean reputation
+func (g *Graph) GetPenalty(id string) float64 {
+	g.channelsLock.RLock()
+	defer g.channelsLock.RUnlock()
+
+	if r, ok := g.Reputation[id]; ok {
+		return r.penaltyAt(time.Now().Unix())
+	}
+	return 0
+}
+
+// reputationCosts returns the cost of going through every node of the index, or nil if no node
+// has a penalty. It assumes that the read lock on channels is held
+func (g *Graph) reputationCosts(idx *index, maxFee uint64, now int64) []int {
+	if len(g.Reputation) == 0 || maxFee == 0 {
+		return nil
+	}
+	costs := make([]int, len(idx.nodes))
+	for id, r := range g.Reputation {
+		if i, ok := idx.ids[id]; ok {
+			costs[i] = reputationPenalty(r.penaltyAt(now), maxFee)
+		}
+	}
+	return costs
+}
+
+// reputationPenalty treats a node with penalty p like a channel that succeeds with probability 1/(1+p)
+func reputationPenalty(penalty float64, maxFee uint64) int {
+	return probabilityPenalty(1/(1+penalty), maxFee)
+}
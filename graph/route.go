@@ -5,7 +5,7 @@ import (
 )
 
 const (
-	INITIAL_DELAY = 144
+	DEFAULT_FINAL_DELAY = 144 // the cltv delta of the last hop, the one that pays us
 )
 
 type RouteHop struct {
@@ -40,6 +40,19 @@ func (r *Route) FeePPM() uint64 {
 	return (r.Fee() * 1000000) / r.Amount
 }
 
+// Probability returns the probability of success of the route according to our liquidity beliefs
+func (r *Route) Probability() float64 {
+	// the bounds of the hops can be updated by the results of other payments in the meantime
+	r.Graph.channelsLock.RLock()
+	defer r.Graph.channelsLock.RUnlock()
+
+	probability := 1.0
+	for _, hop := range r.Hops {
+		probability *= hop.SuccessProbability(hop.MilliSatoshi)
+	}
+	return probability
+}
+
 func (r *Route) Prepend(channel *Channel) {
 	firstHop := r.Hops[0]
 	newFirstHop := RouteHop{
@@ -61,11 +74,12 @@ func (r *Route) recomputeFeeAndDelay() {
 	}
 }
 
-func (r *Route) Append(channel *Channel) {
+// Append adds the last hop of the route, which delivers the amount with finalDelay blocks
+func (r *Route) Append(channel *Channel, finalDelay uint) {
 	newLastHop := RouteHop{
 		Channel:      channel,
 		MilliSatoshi: r.Amount,
-		Delay:        INITIAL_DELAY,
+		Delay:        finalDelay,
 	}
 	r.Hops = append(r.Hops, newLastHop)
 	r.recomputeFeeAndDelay()
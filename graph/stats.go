@@ -25,7 +25,7 @@ func (g *Graph) GetStats() *Stats {
 		if c.IsActive {
 			activeChannels++
 		}
-		if c.Liquidity >= 200000000 {
+		if c.ExpectedLiquidity() >= 200000000 {
 			atLeast200kLiquidity++
 		}
 		maxHtlc := c.HtlcMaximumMilliSatoshis.MSat()
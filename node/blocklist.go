@@ -0,0 +1,180 @@
+package node
+
+import (
+	"circular/util"
+	"encoding/json"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+	"sort"
+)
+
+const (
+	BLOCKLIST_KEY = "blocklist"
+)
+
+// Blocklist is the set of nodes and channels that no rebalance goes through. It is kept in the
+// database, so that it survives restarts, and applied to the graph, so that the pathfinding honors it
+type Blocklist struct {
+	Nodes    map[string]bool `json:"nodes"`
+	Channels map[string]bool `json:"channels"`
+}
+
+func newBlocklist() *Blocklist {
+	return &Blocklist{
+		Nodes:    make(map[string]bool),
+		Channels: make(map[string]bool),
+	}
+}
+
+// loadBlocklist reads the blocklist from the database and applies it to the graph
+func (n *Node) loadBlocklist() error {
+	n.blocklistLock.Lock()
+	defer n.blocklistLock.Unlock()
+
+	value, err := n.DB.Get(BLOCKLIST_KEY)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	blocklist := newBlocklist()
+	if err = json.Unmarshal(value, blocklist); err != nil {
+		return err
+	}
+	if blocklist.Nodes == nil {
+		blocklist.Nodes = make(map[string]bool)
+	}
+	if blocklist.Channels == nil {
+		blocklist.Channels = make(map[string]bool)
+	}
+	n.blocklist = blocklist
+	n.applyBlocklist()
+	n.Logf(glightning.Debug, "blocklist loaded: %d nodes, %d channels", len(blocklist.Nodes), len(blocklist.Channels))
+	return nil
+}
+
+// saveBlocklist assumes that the lock is held
+func (n *Node) saveBlocklist() error {
+	value, err := json.Marshal(n.blocklist)
+	if err != nil {
+		return err
+	}
+	return n.DB.SetPermanent(BLOCKLIST_KEY, value)
+}
+
+// applyBlocklist assumes that the lock is held
+func (n *Node) applyBlocklist() {
+	n.Graph.SetBlocklist(util.GetMapKeys(n.blocklist.Nodes), util.GetMapKeys(n.blocklist.Channels))
+}
+
+// UpdateBlocklist adds the nodes and the channels to the blocklist, or removes them if add is false
+func (n *Node) UpdateBlocklist(nodes, channels []string, add bool) (*BlocklistResult, error) {
+	n.blocklistLock.Lock()
+	defer n.blocklistLock.Unlock()
+
+	for _, id := range nodes {
+		if add {
+			n.blocklist.Nodes[id] = true
+		} else {
+			delete(n.blocklist.Nodes, id)
+		}
+	}
+	for _, scid := range channels {
+		if add {
+			n.blocklist.Channels[scid] = true
+		} else {
+			delete(n.blocklist.Channels, scid)
+		}
+	}
+	n.applyBlocklist()
+	if err := n.saveBlocklist(); err != nil {
+		return nil, err
+	}
+	return n.blocklistResult(), nil
+}
+
+// BlockedNode is a node of the blocklist
+type BlockedNode struct {
+	Id    string `json:"id"`
+	Alias string `json:"alias,omitempty"`
+}
+
+type BlocklistResult struct {
+	Nodes    []*BlockedNode `json:"nodes"`
+	Channels []string       `json:"channels"`
+}
+
+// blocklistResult assumes that the lock is held
+func (n *Node) blocklistResult() *BlocklistResult {
+	result := &BlocklistResult{
+		Nodes:    make([]*BlockedNode, 0, len(n.blocklist.Nodes)),
+		Channels: util.GetMapKeys(n.blocklist.Channels),
+	}
+	for id := range n.blocklist.Nodes {
+		result.Nodes = append(result.Nodes, &BlockedNode{Id: id, Alias: n.Graph.GetAlias(id)})
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool {
+		return result.Nodes[i].Id < result.Nodes[j].Id
+	})
+	sort.Strings(result.Channels)
+	return result
+}
+
+type BlocklistAdd struct {
+	Nodes    []string `json:"nodes,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+func (b *BlocklistAdd) Name() string {
+	return "circular-blocklist-add"
+}
+
+func (b *BlocklistAdd) New() interface{} {
+	return &BlocklistAdd{}
+}
+
+func (b *BlocklistAdd) Call() (jrpc2.Result, error) {
+	if len(b.Nodes) == 0 && len(b.Channels) == 0 {
+		return nil, util.ErrNoRequiredParameter
+	}
+	return GetNode().UpdateBlocklist(b.Nodes, b.Channels, true)
+}
+
+type BlocklistRemove struct {
+	Nodes    []string `json:"nodes,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+func (b *BlocklistRemove) Name() string {
+	return "circular-blocklist-remove"
+}
+
+func (b *BlocklistRemove) New() interface{} {
+	return &BlocklistRemove{}
+}
+
+func (b *BlocklistRemove) Call() (jrpc2.Result, error) {
+	if len(b.Nodes) == 0 && len(b.Channels) == 0 {
+		return nil, util.ErrNoRequiredParameter
+	}
+	return GetNode().UpdateBlocklist(b.Nodes, b.Channels, false)
+}
+
+type BlocklistList struct{}
+
+func (b *BlocklistList) Name() string {
+	return "circular-blocklist-list"
+}
+
+func (b *BlocklistList) New() interface{} {
+	return &BlocklistList{}
+}
+
+func (b *BlocklistList) Call() (jrpc2.Result, error) {
+	n := GetNode()
+	n.blocklistLock.Lock()
+	defer n.blocklistLock.Unlock()
+	return n.blocklistResult(), nil
+}
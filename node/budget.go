@@ -0,0 +1,293 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"encoding/json"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BUDGET_PREFIX = "b_"
+	HOUR          = "hour"
+	DAY           = "day"
+	WEEK          = "week"
+)
+
+var windows = map[string]time.Duration{
+	HOUR: time.Hour,
+	DAY:  24 * time.Hour,
+	WEEK: 7 * 24 * time.Hour,
+}
+
+// Spend is the fee paid by a rebalance, in msat
+type Spend struct {
+	PaymentHash string `json:"payment_hash"`
+	Timestamp   int64  `json:"timestamp"`
+	Fee         uint64 `json:"fee"`
+	Out         string `json:"out"`
+	In          string `json:"in"`
+}
+
+// Budget limits how much we spend in fees across all rebalances over rolling windows of time.
+// Fees of rebalances in flight are reserved, so that parallel rebalances can't overshoot the limits.
+// A limit of 0 means that there is no limit
+type Budget struct {
+	// Limits maps a window to the maximum amount of fees that can be spent in it, in msat
+	Limits map[string]uint64
+	// PeerLimit is the maximum amount of fees that can be spent in a day on rebalances involving a peer, in msat
+	PeerLimit uint64
+	spends    []*Spend
+	reserved  map[string]*Spend
+	db        *Store
+	lock      *sync.Mutex
+}
+
+func NewBudget(hour, day, week, peer uint64) *Budget {
+	return &Budget{
+		Limits: map[string]uint64{
+			HOUR: hour * 1000,
+			DAY:  day * 1000,
+			WEEK: week * 1000,
+		},
+		PeerLimit: peer * 1000,
+		spends:    make([]*Spend, 0),
+		reserved:  make(map[string]*Spend),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Load reads the spends of the last week from the database
+func (b *Budget) Load(db *Store) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.db = db
+	threshold := time.Now().Add(-windows[WEEK]).Unix()
+	return db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(BUDGET_PREFIX)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var spend Spend
+			if err = json.Unmarshal(v, &spend); err != nil {
+				return err
+			}
+			if spend.Timestamp >= threshold {
+				b.spends = append(b.spends, &spend)
+			}
+		}
+		sort.Slice(b.spends, func(i, j int) bool {
+			return b.spends[i].Timestamp < b.spends[j].Timestamp
+		})
+		return nil
+	})
+}
+
+// Reserve checks that the route fits in the budget and reserves its fee until the payment is over.
+// The parts of a payment split across several routes are reserved one after the other under the same payment hash
+func (b *Budget) Reserve(paymentHash string, route *graph.Route) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	fee := route.Fee()
+	out := route.Hops[0].Destination
+	in := route.Hops[len(route.Hops)-1].Source
+
+	b.prune()
+	for window, limit := range b.Limits {
+		if limit > 0 && b.spent(window, "")+fee > limit {
+			return util.NewBudgetExceededError(window, limit)
+		}
+	}
+	if b.PeerLimit > 0 {
+		for _, peer := range []string{out, in} {
+			if b.spent(DAY, peer)+fee > b.PeerLimit {
+				return util.NewBudgetExceededError(DAY+" for peer "+peer, b.PeerLimit)
+			}
+		}
+	}
+
+	if spend, ok := b.reserved[paymentHash]; ok {
+		spend.Fee += fee
+		return nil
+	}
+	b.reserved[paymentHash] = &Spend{
+		PaymentHash: paymentHash,
+		Timestamp:   time.Now().Unix(),
+		Fee:         fee,
+		Out:         out,
+		In:          in,
+	}
+	return nil
+}
+
+// Commit turns a reservation into a spend and saves it in the database.
+// Payments that are not reserved, or whose outcome was already settled, are ignored
+func (b *Budget) Commit(paymentHash string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	spend, ok := b.reserved[paymentHash]
+	if !ok {
+		return nil
+	}
+	delete(b.reserved, paymentHash)
+	spend.Timestamp = time.Now().Unix()
+	b.spends = append(b.spends, spend)
+
+	value, err := json.Marshal(spend)
+	if err != nil {
+		return err
+	}
+	return b.db.Set(BUDGET_PREFIX+paymentHash, value)
+}
+
+// Exhausted tells whether the fees spent and reserved already reached one of the window limits
+func (b *Budget) Exhausted() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.prune()
+	for window, limit := range b.Limits {
+		if limit > 0 && b.spent(window, "") >= limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Release gives back the reservation of a payment that failed. A payment that timed out is still in flight:
+// its reservation is kept until its outcome is notified
+func (b *Budget) Release(paymentHash string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.reserved, paymentHash)
+}
+
+// prune forgets the spends that are older than the longest window. It assumes that the lock is held
+func (b *Budget) prune() {
+	threshold := time.Now().Add(-windows[WEEK]).Unix()
+	i := 0
+	for i < len(b.spends) && b.spends[i].Timestamp < threshold {
+		i++
+	}
+	b.spends = b.spends[i:]
+}
+
+// spent returns the fees spent and reserved in a window, optionally only by rebalances involving peer.
+// It assumes that the lock is held
+func (b *Budget) spent(window, peer string) uint64 {
+	threshold := time.Now().Add(-windows[window]).Unix()
+	involves := func(spend *Spend) bool {
+		return peer == "" || spend.Out == peer || spend.In == peer
+	}
+
+	var result uint64 = 0
+	for _, spend := range b.spends {
+		if spend.Timestamp >= threshold && involves(spend) {
+			result += spend.Fee
+		}
+	}
+	for _, spend := range b.reserved {
+		if involves(spend) {
+			result += spend.Fee
+		}
+	}
+	return result
+}
+
+type BudgetWindow struct {
+	Window    string `json:"window"`
+	Limit     uint64 `json:"limit_msat"`
+	Spent     uint64 `json:"spent_msat"`
+	Remaining uint64 `json:"remaining_msat,omitempty"`
+}
+
+type BudgetPeer struct {
+	Id        string `json:"id"`
+	Alias     string `json:"alias"`
+	Spent     uint64 `json:"spent_msat"`
+	Remaining uint64 `json:"remaining_msat,omitempty"`
+}
+
+type BudgetStatus struct {
+	Windows []*BudgetWindow `json:"windows"`
+	Peers   []*BudgetPeer   `json:"peers"`
+}
+
+func (s *BudgetStatus) Name() string {
+	return "circular-budget"
+}
+
+func (s *BudgetStatus) New() interface{} {
+	return &BudgetStatus{}
+}
+
+func (s *BudgetStatus) Call() (jrpc2.Result, error) {
+	return GetNode().GetBudgetStatus(), nil
+}
+
+// GetBudgetStatus returns what has been spent in every window and, for every peer, what has been spent in the last day
+func (n *Node) GetBudgetStatus() *BudgetStatus {
+	defer util.TimeTrack(time.Now(), "node.GetBudgetStatus", n.Logf)
+	b := n.Budget
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.prune()
+	result := &BudgetStatus{
+		Windows: make([]*BudgetWindow, 0, len(windows)),
+		Peers:   make([]*BudgetPeer, 0),
+	}
+	for _, window := range []string{HOUR, DAY, WEEK} {
+		spent := b.spent(window, "")
+		result.Windows = append(result.Windows, &BudgetWindow{
+			Window:    window,
+			Limit:     b.Limits[window],
+			Spent:     spent,
+			Remaining: remaining(b.Limits[window], spent),
+		})
+	}
+
+	peers := make(map[string]bool)
+	threshold := time.Now().Add(-windows[DAY]).Unix()
+	for _, spend := range b.spends {
+		if spend.Timestamp >= threshold {
+			peers[spend.Out] = true
+			peers[spend.In] = true
+		}
+	}
+	for peer := range peers {
+		spent := b.spent(DAY, peer)
+		result.Peers = append(result.Peers, &BudgetPeer{
+			Id:        peer,
+			Alias:     n.Graph.GetAlias(peer),
+			Spent:     spent,
+			Remaining: remaining(b.PeerLimit, spent),
+		})
+	}
+	sort.Slice(result.Peers, func(i, j int) bool {
+		return result.Peers[i].Spent > result.Peers[j].Spent
+	})
+
+	n.Logln(glightning.Debug, "budget status computed")
+	return result
+}
+
+func remaining(limit, spent uint64) uint64 {
+	if limit == 0 {
+		return 0
+	}
+	return limit - util.Min(limit, spent)
+}
@@ -0,0 +1,246 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"fmt"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBudget returns a budget with limits in sats, backed by a database in a temporary directory
+func newTestBudget(t *testing.T, hour, day, week, peer uint64) *Budget {
+	db := NewDB(t.TempDir())
+	t.Cleanup(func() {
+		db.Close()
+	})
+	b := NewBudget(hour, day, week, peer)
+	if err := b.Load(db); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newBudgetRoute returns a route out through peer out and back in through peer in, that pays fee msat
+func newBudgetRoute(out, in string, fee uint64) *graph.Route {
+	channel := func(source, destination string) *graph.Channel {
+		return graph.NewChannel(&glightning.Channel{Source: source, Destination: destination}, 0, 0, 0)
+	}
+	return graph.NewRoute("self", "self", 1000000, []graph.RouteHop{
+		{Channel: channel("self", out), MilliSatoshi: 1000000 + fee},
+		{Channel: channel(out, in), MilliSatoshi: 1000000},
+		{Channel: channel(in, "self"), MilliSatoshi: 1000000},
+	}, nil)
+}
+
+func TestBudget_ReserveCommitRelease(t *testing.T) {
+	b := newTestBudget(t, 10, 0, 0, 0)
+
+	assert.NoError(t, b.Reserve("a", newBudgetRoute("alice", "bob", 4000)))
+	assert.NoError(t, b.Reserve("b", newBudgetRoute("alice", "bob", 4000)))
+	// reservations count against the limit
+	err := b.Reserve("c", newBudgetRoute("alice", "bob", 4000))
+	assert.Equal(t, util.NewBudgetExceededError(HOUR, 10000), err)
+
+	// a payment that failed gives its reservation back
+	b.Release("b")
+	assert.NoError(t, b.Reserve("c", newBudgetRoute("alice", "bob", 4000)))
+	b.Release("c")
+
+	// a payment that succeeded keeps it, and is saved
+	assert.NoError(t, b.Commit("a"))
+	assert.Equal(t, uint64(4000), b.spent(HOUR, ""))
+	_, err = b.db.Get(BUDGET_PREFIX + "a")
+	assert.NoError(t, err)
+
+	// releasing or committing twice, or an unknown payment, changes nothing
+	b.Release("a")
+	assert.NoError(t, b.Commit("a"))
+	assert.NoError(t, b.Commit("unknown"))
+	assert.Equal(t, uint64(4000), b.spent(HOUR, ""))
+	assert.False(t, b.Exhausted())
+
+	assert.NoError(t, b.Reserve("d", newBudgetRoute("alice", "bob", 6000)))
+	assert.True(t, b.Exhausted())
+	b.Release("d")
+	assert.False(t, b.Exhausted())
+}
+
+func TestBudget_ReservePartsOfAPayment(t *testing.T) {
+	b := newTestBudget(t, 10, 0, 0, 0)
+
+	// the parts of a split payment add up under its payment hash
+	assert.NoError(t, b.Reserve("a", newBudgetRoute("alice", "bob", 3000)))
+	assert.NoError(t, b.Reserve("a", newBudgetRoute("alice", "bob", 4000)))
+	assert.Equal(t, uint64(7000), b.spent(HOUR, ""))
+	err := b.Reserve("a", newBudgetRoute("alice", "bob", 4000))
+	assert.Equal(t, util.NewBudgetExceededError(HOUR, 10000), err)
+
+	assert.NoError(t, b.Commit("a"))
+	assert.Len(t, b.spends, 1)
+	assert.Equal(t, uint64(7000), b.spends[0].Fee)
+}
+
+func TestBudget_SettledByTheOutcome(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+	n.Budget = newTestBudget(t, 0, 1000, 0, 0)
+
+	// a rebalance that timed out keeps the fee reserved until the outcome of the payment is notified
+	assert.NoError(t, n.Budget.Reserve("a", newBudgetRoute("alice", "bob", 3000)))
+	assert.NoError(t, n.Budget.Reserve("b", newBudgetRoute("alice", "bob", 4000)))
+	n.OnPaymentSuccess(&glightning.SendPaySuccess{PaymentHash: "a"})
+	n.OnPaymentFailure(&glightning.SendPayFailure{
+		Data: glightning.SendPayFailureData{PaymentHash: "b", ErringNode: n.Id},
+	})
+
+	assert.Empty(t, n.Budget.reserved)
+	assert.Equal(t, uint64(3000), n.Budget.spent(DAY, ""))
+	_, err := n.Budget.db.Get(BUDGET_PREFIX + "a")
+	assert.NoError(t, err)
+}
+
+func TestBudget_NoLimits(t *testing.T) {
+	b := newTestBudget(t, 0, 0, 0, 0)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.Reserve(fmt.Sprint(i), newBudgetRoute("alice", "bob", 1000000)))
+	}
+	assert.False(t, b.Exhausted())
+}
+
+func TestBudget_WindowsRollOver(t *testing.T) {
+	b := newTestBudget(t, 20, 30, 30, 0)
+	now := time.Now()
+	b.spends = []*Spend{
+		{PaymentHash: "lastweek", Timestamp: now.Add(-8 * 24 * time.Hour).Unix(), Fee: 100000},
+		{PaymentHash: "week", Timestamp: now.Add(-3 * 24 * time.Hour).Unix(), Fee: 10000},
+		{PaymentHash: "day", Timestamp: now.Add(-3 * time.Hour).Unix(), Fee: 5000},
+		{PaymentHash: "hour", Timestamp: now.Add(-10 * time.Minute).Unix(), Fee: 2000},
+	}
+
+	// spends older than a window don't count in it, the ones older than a week are forgotten
+	assert.NoError(t, b.Reserve("a", newBudgetRoute("alice", "bob", 1000)))
+	assert.Len(t, b.spends, 3)
+	assert.Equal(t, uint64(3000), b.spent(HOUR, ""))
+	assert.Equal(t, uint64(8000), b.spent(DAY, ""))
+	assert.Equal(t, uint64(18000), b.spent(WEEK, ""))
+
+	// 13k fit in the hour and in the day, but not in the week
+	err := b.Reserve("b", newBudgetRoute("alice", "bob", 13000))
+	assert.Equal(t, util.NewBudgetExceededError(WEEK, 30000), err)
+
+	// once the spend of three days ago is older than a week, the week has room again
+	b.spends[0].Timestamp = now.Add(-7*24*time.Hour - time.Minute).Unix()
+	assert.NoError(t, b.Reserve("b", newBudgetRoute("alice", "bob", 13000)))
+	assert.Len(t, b.spends, 2)
+	// but the hour is almost full
+	err = b.Reserve("c", newBudgetRoute("alice", "bob", 5000))
+	assert.Equal(t, util.NewBudgetExceededError(HOUR, 20000), err)
+	assert.NoError(t, b.Reserve("c", newBudgetRoute("alice", "bob", 4000)))
+	assert.True(t, b.Exhausted())
+}
+
+func TestBudget_PeerLimit(t *testing.T) {
+	b := newTestBudget(t, 0, 0, 0, 5)
+
+	assert.NoError(t, b.Reserve("a", newBudgetRoute("alice", "bob", 3000)))
+	assert.NoError(t, b.Commit("a"))
+
+	// alice and bob are both involved in the first rebalance
+	err := b.Reserve("b", newBudgetRoute("carol", "bob", 3000))
+	assert.Equal(t, util.NewBudgetExceededError(DAY+" for peer bob", 5000), err)
+	err = b.Reserve("b", newBudgetRoute("alice", "carol", 3000))
+	assert.Equal(t, util.NewBudgetExceededError(DAY+" for peer alice", 5000), err)
+	assert.NoError(t, b.Reserve("b", newBudgetRoute("carol", "dave", 3000)))
+	assert.NoError(t, b.Reserve("c", newBudgetRoute("alice", "dave", 2000)))
+
+	// the peer limit is over a day
+	b.spends[0].Timestamp = time.Now().Add(-25 * time.Hour).Unix()
+	assert.Equal(t, uint64(2000), b.spent(DAY, "alice"))
+	assert.Equal(t, uint64(0), b.spent(DAY, "bob"))
+	// the peer limit is not a window limit
+	assert.False(t, b.Exhausted())
+}
+
+func TestBudget_ConcurrentReservations(t *testing.T) {
+	b := newTestBudget(t, 0, 100, 0, 0)
+
+	// 50 rebalances of 5 sats compete for 100 sats: exactly 20 of them fit
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		reserved []string
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(hash string) {
+			defer wg.Done()
+			if b.Reserve(hash, newBudgetRoute("alice", "bob", 5000)) == nil {
+				lock.Lock()
+				reserved = append(reserved, hash)
+				lock.Unlock()
+			}
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	assert.Len(t, reserved, 20)
+	assert.Equal(t, uint64(100000), b.spent(DAY, ""))
+
+	// half of them succeed and half of them fail, at the same time
+	for i, hash := range reserved {
+		wg.Add(1)
+		go func(hash string, success bool) {
+			defer wg.Done()
+			if success {
+				assert.NoError(t, b.Commit(hash))
+			} else {
+				b.Release(hash)
+			}
+		}(hash, i%2 == 0)
+	}
+	wg.Wait()
+	assert.Empty(t, b.reserved)
+	assert.Len(t, b.spends, 10)
+	assert.Equal(t, uint64(50000), b.spent(DAY, ""))
+}
+
+func TestBudget_Load(t *testing.T) {
+	b := newTestBudget(t, 0, 0, 0, 0)
+	assert.NoError(t, b.Reserve("a", newBudgetRoute("alice", "bob", 3000)))
+	assert.NoError(t, b.Commit("a"))
+	assert.NoError(t, b.Reserve("b", newBudgetRoute("alice", "bob", 4000)))
+
+	// only what was committed survives a restart
+	loaded := NewBudget(0, 0, 0, 0)
+	assert.NoError(t, loaded.Load(b.db))
+	assert.Len(t, loaded.spends, 1)
+	assert.Equal(t, uint64(3000), loaded.spent(WEEK, ""))
+	assert.Equal(t, uint64(3000), loaded.spent(DAY, "bob"))
+}
+
+func TestBudget_ReleaseAfterFailedPayment(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+	n.Budget = newTestBudget(t, 0, 1000, 0, 0)
+	// bob can't send anything back to us
+	network.SetActive("2x2x2", false)
+
+	route := newTestRoute(t, n, 100000000)
+	hash, err := n.GeneratePreimageHashPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, n.Budget.Reserve(hash, route))
+	assert.Equal(t, route.Fee(), n.Budget.spent(DAY, ""))
+
+	_, err = n.SendPay(route, hash)
+	assert.Error(t, err)
+	// the rebalance gives the reservation back when the payment fails
+	n.Budget.Release(hash)
+	assert.Equal(t, uint64(0), n.Budget.spent(DAY, ""))
+	status := n.GetBudgetStatus()
+	assert.Equal(t, uint64(1000000), status.Windows[1].Remaining)
+	assert.Empty(t, status.Peers)
+}
@@ -1,6 +1,7 @@
 package node
 
 import (
+	"circular/graph"
 	"circular/util"
 	"github.com/elementsproject/glightning/glightning"
 	"github.com/robfig/cron/v3"
@@ -11,10 +12,12 @@ import (
 
 const (
 	LIQUIDITY_REFRESH_INTERVAL = 10 // minutes
+	ALIASES_REFRESH_INTERVAL   = 24 * time.Hour
 )
 
 func (n *Node) setupCronJobs(options map[string]glightning.Option) {
 	c := cron.New()
+	n.cron = c
 
 	// every 10 minutes by default, refresh the information gathered via gossip
 	addCronJob(c, strconv.Itoa(options["circular-graph-refresh"].GetValue().(int))+"m", func() {
@@ -26,14 +29,22 @@ func (n *Node) setupCronJobs(options map[string]glightning.Option) {
 		n.refreshPeers()
 	})
 
-	// every 10 minutes by default, check if there are channels that need to be reset
-	addCronJob(c, strconv.Itoa(LIQUIDITY_REFRESH_INTERVAL)+"m", func() {
-		n.refreshLiquidity()
-	})
+	// with decay, beliefs fade by themselves. Without it, every 10 minutes check if there are
+	// channels that need to be reset
+	if n.liquidityDecay.Model == graph.DECAY_NONE {
+		addCronJob(c, strconv.Itoa(LIQUIDITY_REFRESH_INTERVAL)+"m", func() {
+			n.refreshLiquidity()
+		})
+	}
 
 	c.Start()
 }
 
+// AddCronJob runs f every interval, expressed as a duration string such as "10m"
+func (n *Node) AddCronJob(interval string, f func()) {
+	addCronJob(n.cron, interval, f)
+}
+
 func addCronJob(c *cron.Cron, interval string, f func()) {
 	_, err := c.AddFunc("@every "+interval, f)
 	if err != nil {
@@ -51,19 +62,26 @@ func (n *Node) refreshGraph() error {
 		return err
 	}
 
+	// lightningd can't filter channels by last update, but only the ones that changed are applied to the graph
 	n.Logln(glightning.Debug, "refreshing channels")
-	n.Graph.RefreshChannels(channelList)
+	updated, added := n.Graph.RefreshChannels(channelList)
+	n.Logf(glightning.Debug, "%d channels updated, %d channels added", updated, added)
 
 	n.Logln(glightning.Debug, "pruning channels")
 	n.Graph.PruneChannels()
 
-	n.Logln(glightning.Debug, "refreshing aliases")
-	nodes, err := n.lightning.ListNodes()
-	if err != nil {
-		n.Logf(glightning.Unusual, "error listing nodes: %+v", err)
-		return err
+	// listnodes is expensive and aliases rarely change: ask for them only when new nodes may have
+	// appeared, and once a day otherwise
+	if added > 0 || time.Since(n.aliasesRefreshed) > ALIASES_REFRESH_INTERVAL {
+		n.Logln(glightning.Debug, "refreshing aliases")
+		nodes, err := n.lightning.ListNodes()
+		if err != nil {
+			n.Logf(glightning.Unusual, "error listing nodes: %+v", err)
+			return err
+		}
+		n.Graph.RefreshAliases(nodes)
+		n.aliasesRefreshed = time.Now()
 	}
-	n.Graph.RefreshAliases(nodes)
 
 	n.Logln(glightning.Debug, "saving graph to file")
 	if err = n.SaveGraphToFile(CIRCULAR_DIR, "graph.json"); err != nil {
@@ -85,11 +103,20 @@ func (n *Node) refreshPeers() error {
 		return err
 	}
 
+	// glightning can't subscribe to channel_state_changed, so changes are only detected here
+	changes := make([]*stateChange, 0)
 	n.PeersLock.Lock()
-	defer n.PeersLock.Unlock()
+	// the first refresh only loads the peers, the graph already has their channels
+	initial := len(n.Peers) == 0
 	for _, peer := range peers {
+		if !initial {
+			changes = append(changes, diffPeer(n.Peers[peer.Id], peer)...)
+		}
 		n.Peers[peer.Id] = peer
 	}
+	n.PeersLock.Unlock()
+
+	n.applyStateChanges(changes)
 	return nil
 }
 
@@ -31,8 +31,28 @@ func NewDB(path string) *Store {
 
 // Every key is allowed to stay in the db for at most 14 days
 func (s *Store) Set(key string, value []byte) error {
+	return s.SetWithTTL(key, value, FOURTEEN_DAYS)
+}
+
+// SetWithTTL stores a key that expires after ttl. A ttl of 0 means that the key never expires
+func (s *Store) SetWithTTL(key string, value []byte, ttl time.Duration) error {
 	err := s.db.Update(func(txn *badger.Txn) error {
-		return txn.SetEntry(badger.NewEntry([]byte(key), value).WithTTL(FOURTEEN_DAYS))
+		entry := badger.NewEntry([]byte(key), value)
+		if ttl > 0 {
+			entry = entry.WithTTL(ttl)
+		}
+		return txn.SetEntry(entry)
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetPermanent stores a key that never expires, for configuration that must survive restarts
+func (s *Store) SetPermanent(key string, value []byte) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(key), value))
 	})
 	if err != nil {
 		return err
@@ -70,25 +90,20 @@ func (s *Store) Delete(key string) error {
 	return nil
 }
 
-func (s *Store) ListFailures() ([]glightning.SendPayFailure, error) {
+// Close flushes the database to disk, so that the next start doesn't need to recover the value log
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// ListFailures returns the failures saved between from and to (unix timestamps). 0 means no bound
+func (s *Store) ListFailures(from, to int64) ([]glightning.SendPayFailure, error) {
 	result := make([]glightning.SendPayFailure, 0)
-	err := s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		prefix := []byte(FAILURE_PREFIX)
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-			var sf glightning.SendPayFailure
-			err = json.Unmarshal(v, &sf)
-			if err != nil {
-				return err
-			}
-			result = append(result, sf)
+	err := s.listStats(FAILURE_PREFIX, from, to, func(v []byte) error {
+		var sf glightning.SendPayFailure
+		if err := json.Unmarshal(v, &sf); err != nil {
+			return err
 		}
+		result = append(result, sf)
 		return nil
 	})
 	if err != nil {
@@ -97,25 +112,15 @@ func (s *Store) ListFailures() ([]glightning.SendPayFailure, error) {
 	return result, nil
 }
 
-func (s *Store) ListSuccesses() ([]glightning.SendPaySuccess, error) {
+// ListSuccesses returns the successes saved between from and to (unix timestamps). 0 means no bound
+func (s *Store) ListSuccesses(from, to int64) ([]glightning.SendPaySuccess, error) {
 	result := make([]glightning.SendPaySuccess, 0)
-	err := s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		prefix := []byte(SUCCESS_PREFIX)
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-			var sf glightning.SendPaySuccess
-			err = json.Unmarshal(v, &sf)
-			if err != nil {
-				return err
-			}
-			result = append(result, sf)
+	err := s.listStats(SUCCESS_PREFIX, from, to, func(v []byte) error {
+		var ss glightning.SendPaySuccess
+		if err := json.Unmarshal(v, &ss); err != nil {
+			return err
 		}
+		result = append(result, ss)
 		return nil
 	})
 	if err != nil {
@@ -124,25 +129,15 @@ func (s *Store) ListSuccesses() ([]glightning.SendPaySuccess, error) {
 	return result, nil
 }
 
-func (s *Store) ListRoutes() ([]graph.PrettyRoute, error) {
+// ListRoutes returns the routes saved between from and to (unix timestamps). 0 means no bound
+func (s *Store) ListRoutes(from, to int64) ([]graph.PrettyRoute, error) {
 	result := make([]graph.PrettyRoute, 0)
-	err := s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		prefix := []byte(ROUTE_PREFIX)
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-			var pr graph.PrettyRoute
-			err = json.Unmarshal(v, &pr)
-			if err != nil {
-				return err
-			}
-			result = append(result, pr)
+	err := s.listStats(ROUTE_PREFIX, from, to, func(v []byte) error {
+		var pr graph.PrettyRoute
+		if err := json.Unmarshal(v, &pr); err != nil {
+			return err
 		}
+		result = append(result, pr)
 		return nil
 	})
 	if err != nil {
@@ -162,7 +157,7 @@ func (n *Node) SaveToDb(key string, value any) error {
 		return err
 	}
 
-	err = n.DB.Set(key, b)
+	err = n.DB.SetWithTTL(key, b, n.statsRetention)
 	if err != nil {
 		n.Logln(glightning.Unusual, err)
 		return err
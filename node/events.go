@@ -0,0 +1,103 @@
+package node
+
+import (
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"time"
+)
+
+const (
+	CHANNELD_NORMAL = "CHANNELD_NORMAL"
+	ONCHAIN         = "ONCHAIN"
+	CLOSED          = "CLOSED"
+)
+
+// stateChange is a channel that was found in a different state than the last time peers were refreshed
+type stateChange struct {
+	PeerId         string
+	ChannelId      string
+	ShortChannelId string
+	OldState       string
+	NewState       string
+}
+
+// OnChannelOpened makes a new channel known to the node as soon as it is opened
+func (n *Node) OnChannelOpened(c *glightning.ChannelOpened) {
+	defer util.TimeTrack(time.Now(), "node.OnChannelOpened", n.Logf)
+	n.Logf(glightning.Info, "channel opened with %s, funding txid %s", c.PeerId, c.FundingTxId)
+
+	changes, err := n.refreshPeer(c.PeerId)
+	if err != nil {
+		n.Logln(glightning.Unusual, err)
+		return
+	}
+	n.applyStateChanges(changes)
+}
+
+// applyStateChanges updates the graph after channels changed state
+func (n *Node) applyStateChanges(changes []*stateChange) {
+	for _, c := range changes {
+		n.Logf(glightning.Debug, "channel %s with %s went from %s to %s", c.ShortChannelId, c.PeerId, c.OldState, c.NewState)
+		if c.ShortChannelId == "" {
+			// the funding transaction is not confirmed yet, there is nothing to route through
+			continue
+		}
+
+		switch c.NewState {
+		case CHANNELD_NORMAL:
+			// the channel can be announced to us only later via gossip, get it from lightningd right away
+			channels, err := n.lightning.GetChannel(c.ShortChannelId)
+			if err != nil {
+				n.Logln(glightning.Debug, err)
+				continue
+			}
+			n.Graph.RefreshChannels(channels)
+		case ONCHAIN, CLOSED:
+			n.Graph.RemoveChannel(c.ShortChannelId)
+		default:
+			if c.OldState == CHANNELD_NORMAL {
+				n.Graph.DisableChannel(c.ShortChannelId + "/" + util.GetDirection(n.Id, c.PeerId))
+				n.Graph.DisableChannel(c.ShortChannelId + "/" + util.GetDirection(c.PeerId, n.Id))
+			}
+		}
+	}
+}
+
+// refreshPeer gets a single peer from lightningd and returns the channels that changed state
+func (n *Node) refreshPeer(id string) ([]*stateChange, error) {
+	peer, err := n.lightning.GetPeer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	n.PeersLock.Lock()
+	defer n.PeersLock.Unlock()
+	changes := diffPeer(n.Peers[id], peer)
+	n.Peers[id] = peer
+	return changes, nil
+}
+
+// diffPeer returns the channels of peer whose state is different from the one they had in old
+func diffPeer(old, peer *glightning.Peer) []*stateChange {
+	states := make(map[string]string)
+	if old != nil {
+		for _, channel := range old.Channels {
+			states[channel.ChannelId] = channel.State
+		}
+	}
+
+	changes := make([]*stateChange, 0)
+	for _, channel := range peer.Channels {
+		if state, ok := states[channel.ChannelId]; ok && state == channel.State {
+			continue
+		}
+		changes = append(changes, &stateChange{
+			PeerId:         peer.Id,
+			ChannelId:      channel.ChannelId,
+			ShortChannelId: channel.ShortChannelId,
+			OldState:       states[channel.ChannelId],
+			NewState:       channel.State,
+		})
+	}
+	return changes
+}
@@ -0,0 +1,256 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	COOLDOWN_FAILURES = 3         // consecutive failures that put a channel on cooldown
+	COOLDOWN          = time.Hour // how long a channel stays on cooldown after its last failure
+)
+
+// History is what past rebalances tell us about a channel, or about a pair of outgoing and incoming channels
+type History struct {
+	Successes           uint64
+	Failures            uint64
+	ConsecutiveFailures uint64 // failures since the last success
+	LastFailure         int64
+	Amount              uint64 // sats rebalanced successfully
+	Fee                 uint64 // msat paid for the successful rebalances
+}
+
+// PPM is the average ppm paid for the successful rebalances
+func (h *History) PPM() uint64 {
+	if h.Amount == 0 {
+		return 0
+	}
+	return h.Fee * 1000 / h.Amount
+}
+
+// SuccessRate is the fraction of successful rebalances, smoothed so that
+// channels we know nothing about are neither favored nor discarded
+func (h *History) SuccessRate() float64 {
+	return float64(h.Successes+1) / float64(h.Successes+h.Failures+2)
+}
+
+// Cost ranks channels and pairs: the lower, the better. Those that succeeded before are priced
+// at the ppm they cost, the others at ppm. The cost grows with every failure, and even more so
+// with failures that were not followed by a success
+func (h *History) Cost(ppm uint64) float64 {
+	if h.Successes > 0 {
+		ppm = h.PPM()
+	}
+	return float64(ppm+1) * float64(h.ConsecutiveFailures+1) / h.SuccessRate()
+}
+
+// CoolingDown tells whether the channel kept failing recently and should not be tried for a while
+func (h *History) CoolingDown(now time.Time) bool {
+	return h.ConsecutiveFailures >= COOLDOWN_FAILURES && now.Unix()-h.LastFailure < int64(COOLDOWN.Seconds())
+}
+
+func (h *History) add(r *rebalanceRecord) {
+	if !r.success {
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastFailure = r.timestamp
+		return
+	}
+	h.Successes++
+	h.ConsecutiveFailures = 0
+	h.Amount += r.amount
+	h.Fee += r.fee
+}
+
+func PairKey(outScid, inScid string) string {
+	return outScid + "/" + inScid
+}
+
+// historyCache keeps the history of channels and pairs in memory, so that ranking candidates doesn't
+// read every stat from the db. It is loaded from the db on start and then kept up to date by the
+// outcome of every payment, even when stats are not saved
+type historyCache struct {
+	lock  *sync.Mutex
+	out   map[string]*History
+	in    map[string]*History
+	pairs map[string]*History
+}
+
+func newHistoryCache() *historyCache {
+	return &historyCache{
+		lock:  &sync.Mutex{},
+		out:   make(map[string]*History),
+		in:    make(map[string]*History),
+		pairs: make(map[string]*History),
+	}
+}
+
+// add records a rebalance in the history of its channels and of its pair. It assumes that the lock is held
+func (c *historyCache) add(r *rebalanceRecord) {
+	addRecord(c.out, r.out, r)
+	addRecord(c.in, r.in, r)
+	addRecord(c.pairs, PairKey(r.out, r.in), r)
+}
+
+// loadHistory fills the history cache with the rebalances saved in the db
+func (n *Node) loadHistory() error {
+	records, err := n.listRebalances()
+	if err != nil {
+		return err
+	}
+
+	cache := newHistoryCache()
+	for _, r := range records {
+		cache.add(r)
+	}
+	n.history = cache
+	return nil
+}
+
+// recordRebalance adds the outcome of a payment sent through route to the history cache
+func (n *Node) recordRebalance(route *graph.Route, success bool, timestamp int64) {
+	if route == nil || len(route.Hops) < 2 {
+		return
+	}
+	r := &rebalanceRecord{
+		out:       route.Hops[0].ShortChannelId,
+		in:        route.Hops[len(route.Hops)-1].ShortChannelId,
+		success:   success,
+		timestamp: timestamp,
+		amount:    route.Amount / 1000,
+		fee:       route.Fee(),
+	}
+
+	n.history.lock.Lock()
+	defer n.history.lock.Unlock()
+	n.history.add(r)
+}
+
+// GetPairHistory returns the history of every pair of channels that has been used to rebalance, keyed by PairKey
+func (n *Node) GetPairHistory() map[string]*History {
+	n.history.lock.Lock()
+	defer n.history.lock.Unlock()
+	return copyHistory(n.history.pairs)
+}
+
+// GetChannelHistory returns the history of the channels that have been used to send
+// and to receive rebalances, keyed by short channel id
+func (n *Node) GetChannelHistory() (map[string]*History, map[string]*History) {
+	n.history.lock.Lock()
+	defer n.history.lock.Unlock()
+	return copyHistory(n.history.out), copyHistory(n.history.in)
+}
+
+// copyHistory returns a copy of histories that the caller can change
+func copyHistory(histories map[string]*History) map[string]*History {
+	result := make(map[string]*History, len(histories))
+	for key, h := range histories {
+		c := *h
+		result[key] = &c
+	}
+	return result
+}
+
+func addRecord(histories map[string]*History, key string, r *rebalanceRecord) {
+	if _, ok := histories[key]; !ok {
+		histories[key] = &History{}
+	}
+	histories[key].add(r)
+}
+
+// rebalanceRecord is the outcome of a past rebalance
+type rebalanceRecord struct {
+	paymentHash   string
+	out           string
+	in            string
+	outPeer       string
+	inPeer        string
+	success       bool
+	timestamp     int64
+	amount        uint64
+	fee           uint64
+	erringNode    string
+	erringChannel string
+}
+
+func (r *rebalanceRecord) ppm() uint64 {
+	if r.amount == 0 {
+		return 0
+	}
+	return r.fee * 1000 / r.amount
+}
+
+// listRebalances joins the routes stored in the db with the outcome of their payments, oldest first
+func (n *Node) listRebalances() ([]*rebalanceRecord, error) {
+	defer util.TimeTrack(time.Now(), "node.listRebalances", n.Logf)
+
+	successes, failures, routes, err := n.loadStats(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return joinRebalances(successes, failures, routes), nil
+}
+
+// loadStats reads the successes and failures of the payments sent between from and to, and their routes
+func (n *Node) loadStats(from, to int64) ([]glightning.SendPaySuccess, []glightning.SendPayFailure, []graph.PrettyRoute, error) {
+	successes, err := n.DB.ListSuccesses(from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	failures, err := n.DB.ListFailures(from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if from > ROUTE_TIMESTAMP_SLACK {
+		from -= ROUTE_TIMESTAMP_SLACK
+	}
+	routes, err := n.DB.ListRoutes(from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return successes, failures, routes, nil
+}
+
+// joinRebalances matches every route with the outcome of its payment, oldest first
+func joinRebalances(successes []glightning.SendPaySuccess, failures []glightning.SendPayFailure, routes []graph.PrettyRoute) []*rebalanceRecord {
+	outcome := make(map[string]*rebalanceRecord, len(successes)+len(failures))
+	for _, s := range successes {
+		outcome[s.PaymentHash] = &rebalanceRecord{success: true, timestamp: int64(s.CreatedAt)}
+	}
+	for _, f := range failures {
+		outcome[f.Data.PaymentHash] = &rebalanceRecord{
+			success:       false,
+			timestamp:     int64(f.Data.CreatedAt),
+			erringNode:    f.Data.ErringNode,
+			erringChannel: f.Data.ErringChannel,
+		}
+	}
+
+	result := make([]*rebalanceRecord, 0, len(routes))
+	for _, route := range routes {
+		o, ok := outcome[route.PaymentHash]
+		// the payment may still be in flight, or its outcome may have expired
+		if !ok || len(route.Hops) < 2 {
+			continue
+		}
+		// the parts of a split rebalance share the payment hash, each of them is a record of its own
+		record := *o
+		record.paymentHash = route.PaymentHash
+		record.out = route.Hops[0].ShortChannelId
+		record.in = route.Hops[len(route.Hops)-1].ShortChannelId
+		record.outPeer = route.Hops[1].Id
+		record.inPeer = route.Hops[len(route.Hops)-1].Id
+		record.amount = route.Amount
+		record.fee = route.Fee
+		result = append(result, &record)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].timestamp < result[j].timestamp
+	})
+	return result
+}
@@ -0,0 +1,128 @@
+package node
+
+import (
+	"circular/util"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/elementsproject/glightning/glightning"
+	"strconv"
+	"strings"
+)
+
+const (
+	TLV_AMT_TO_FORWARD = 2 // the type of amt_to_forward in the tlv payload of the onion, see BOLT 4
+)
+
+// OnHtlcAccepted resolves the htlcs of our rebalances with their preimage. The parts of a split
+// rebalance are held until all of them have arrived. Other htlcs continue: lightningd fails
+// the ones that don't pay one of its invoices
+func (n *Node) OnHtlcAccepted(event *glightning.HtlcAcceptedEvent) *glightning.HtlcAcceptedResponse {
+	paymentHash := event.Htlc.PaymentHash
+	preimage, err := n.DB.Get(paymentHash)
+	if err != nil {
+		return event.Continue()
+	}
+
+	if p := n.getMultiPart(paymentHash); p != nil {
+		amount, err := htlcAmount(event)
+		if err != nil {
+			// without the amount we can't tell when every part arrived, holding them would only delay the failure
+			n.Logln(glightning.Unusual, "unable to read the amount of the HTLC, failing the payment: ", err)
+			p.lock.Lock()
+			p.release(true)
+			p.lock.Unlock()
+			return event.Continue()
+		}
+		if !n.waitForParts(p, paymentHash, amount) {
+			// lightningd fails the HTLC, since there's no invoice for it
+			return event.Continue()
+		}
+	}
+
+	n.Logln(glightning.Info, "resolving HTLC with preimage: ", string(preimage))
+	return event.Resolve(string(preimage))
+}
+
+// htlcAmount returns what the htlc pays us, in msat. Current versions of lightningd don't send the
+// amount of the htlc anymore, so it is read from amt_to_forward in the onion payload first
+func htlcAmount(event *glightning.HtlcAcceptedEvent) (uint64, error) {
+	amount, err := amountToForward(event.Onion.Payload)
+	if err == nil {
+		return amount, nil
+	}
+	for _, field := range []string{event.Onion.ForwardAmount, event.Htlc.AmountMilliSatoshi} {
+		if field != "" {
+			return strconv.ParseUint(strings.TrimSuffix(field, "msat"), 10, 64)
+		}
+	}
+	return 0, err
+}
+
+// amountToForward reads amt_to_forward from the hex encoded tlv payload of an onion,
+// which may be prefixed by its length
+func amountToForward(payload string) (uint64, error) {
+	stream, err := hex.DecodeString(payload)
+	if err != nil {
+		return 0, err
+	}
+	if length, read, err := readBigSize(stream); err == nil && length == uint64(len(stream)-read) {
+		stream = stream[read:]
+	}
+
+	for len(stream) > 0 {
+		recordType, read, err := readBigSize(stream)
+		if err != nil {
+			return 0, err
+		}
+		stream = stream[read:]
+		length, read, err := readBigSize(stream)
+		if err != nil {
+			return 0, err
+		}
+		stream = stream[read:]
+		if length > uint64(len(stream)) {
+			return 0, util.ErrInvalidOnionPayload
+		}
+		if recordType == TLV_AMT_TO_FORWARD {
+			// a tu64: big endian, without leading zeros
+			if length > 8 {
+				return 0, util.ErrInvalidOnionPayload
+			}
+			var amount uint64
+			for _, b := range stream[:length] {
+				amount = amount<<8 | uint64(b)
+			}
+			return amount, nil
+		}
+		stream = stream[length:]
+	}
+	return 0, util.ErrNoHtlcAmount
+}
+
+// readBigSize reads a BigSize integer, see BOLT 1. It returns the integer and how many bytes it took
+func readBigSize(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, util.ErrInvalidOnionPayload
+	}
+	size := 1
+	switch b[0] {
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 5
+	case 0xff:
+		size = 9
+	}
+	if len(b) < size {
+		return 0, 0, util.ErrInvalidOnionPayload
+	}
+	switch size {
+	case 3:
+		return uint64(binary.BigEndian.Uint16(b[1:3])), size, nil
+	case 5:
+		return uint64(binary.BigEndian.Uint32(b[1:5])), size, nil
+	case 9:
+		return binary.BigEndian.Uint64(b[1:9]), size, nil
+	}
+	return uint64(b[0]), size, nil
+}
@@ -0,0 +1,105 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNode_SendPayPartsHeldUntilAllArrive(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	// every part must have arrived by the time the first one is resolved
+	var lock sync.Mutex
+	arrived := 0
+	var arrivedWhenResolved []int
+	network.OnHtlcAccepted = func(event *glightning.HtlcAcceptedEvent) *glightning.HtlcAcceptedResponse {
+		lock.Lock()
+		arrived++
+		lock.Unlock()
+		response := n.OnHtlcAccepted(event)
+		lock.Lock()
+		arrivedWhenResolved = append(arrivedWhenResolved, arrived)
+		lock.Unlock()
+		return response
+	}
+
+	hash, err := n.GeneratePreimageHashPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := []*graph.Route{newTestRoute(t, n, 100000000), newTestRoute(t, n, 50000000)}
+	assert.NoError(t, n.SendPayParts(routes, hash))
+
+	assert.Equal(t, []int{2, 2}, arrivedWhenResolved)
+	assert.Equal(t, uint64(250000000), network.Balance("2x2x2", "self"))
+	// alice was paid the fees on top
+	assert.Less(t, network.Balance("1x1x1", "self"), uint64(750000000))
+	assert.Eventually(t, func() bool {
+		return n.getMultiPart(hash) == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestNode_OnHtlcAcceptedFailsUnreadableParts(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+	hash, err := n.GeneratePreimageHashPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &multiPartPayment{
+		total:     200000000,
+		routes:    make(map[uint64]*graph.Route),
+		arrived:   make(chan struct{}),
+		createdAt: time.Now(),
+		lock:      &sync.Mutex{},
+	}
+	n.addMultiPart(hash, p)
+
+	done := make(chan *glightning.HtlcAcceptedResponse)
+	go func() {
+		done <- n.OnHtlcAccepted(&glightning.HtlcAcceptedEvent{
+			Onion: glightning.Onion{Payload: "0604020186a0"}, // only an outgoing_cltv_value
+			Htlc:  glightning.HtlcOffer{PaymentHash: hash},
+		})
+	}()
+	select {
+	case response := <-done:
+		assert.Equal(t, glightning.HtlcAcceptedResult("continue"), response.Result)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the part is held although its amount is unknown")
+	}
+	// the parts that arrive next are not held either
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	assert.True(t, p.failed)
+}
+
+func TestAmountToForward(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		amount  uint64
+		err     error
+	}{
+		{"with its length", "0c02030186a004020190080100", 100000, nil},
+		{"without its length", "02030186a004020190", 100000, nil},
+		{"after another record", "04020190020405f5e100", 100000000, nil},
+		{"zero", "020004020190", 0, nil},
+		{"a large type", "fd01010100020101", 1, nil},
+		{"without amount", "04020190", 0, util.ErrNoHtlcAmount},
+		{"a truncated record", "0205010203", 0, util.ErrInvalidOnionPayload},
+		{"an amount longer than a tu64", "0209010203040506070809", 0, util.ErrInvalidOnionPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, err := amountToForward(tt.payload)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.amount, amount)
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package node
+
+import (
+	"circular/util"
+	"encoding/json"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_RUNNING   = "running"
+	JOB_COMPLETED = "completed"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+	JOB_ABORTED   = "aborted"
+	JOB_RESUMED   = "resumed"
+	JOB_RETENTION = 24 * time.Hour
+)
+
+// JobProgress is a snapshot of how far a job has gone
+type JobProgress struct {
+	Amount           uint64   `json:"amount"`
+	AmountRebalanced uint64   `json:"amount_rebalanced"`
+	InFlightSplits   int      `json:"inflight_splits"`
+	Attempts         uint64   `json:"attempts"`
+	CandidatesTried  []string `json:"candidates_tried,omitempty"`
+}
+
+// Job is a rebalance running in the background
+type Job struct {
+	Id        uint64       `json:"id"`
+	Method    string       `json:"method"`
+	Status    string       `json:"status"`
+	StartedAt int64        `json:"started_at"`
+	EndedAt   int64        `json:"ended_at,omitempty"`
+	Progress  *JobProgress `json:"progress,omitempty"`
+	Result    any          `json:"result,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	// Params are the parameters the job was started with, so that it can be resumed after a restart
+	Params      json.RawMessage `json:"params,omitempty"`
+	ResumedFrom uint64          `json:"resumed_from,omitempty"`
+	ResumedAs   uint64          `json:"resumed_as,omitempty"`
+	Cancelled   bool            `json:"cancelled,omitempty"`
+	progress    func() *JobProgress
+	savedAt     time.Time
+	lock        *sync.Mutex
+}
+
+type JobStarted struct {
+	Id      uint64 `json:"job_id"`
+	Message string `json:"message"`
+}
+
+// IsCancelled can be called on a nil job, which is never cancelled
+func (j *Job) IsCancelled() bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.Cancelled
+}
+
+// SetProgress sets the function that is used to report the progress of the job
+func (j *Job) SetProgress(progress func() *JobProgress) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.progress = progress
+}
+
+// snapshot copies the job with its progress. The progress is asked for after the lock of the job
+// is released: the rebalance takes its own lock to report it, and it checks the job under that lock
+func (j *Job) snapshot() *Job {
+	j.lock.Lock()
+	result := *j
+	progress := j.progress
+	j.lock.Unlock()
+
+	if progress != nil {
+		result.Progress = progress()
+	}
+	return &result
+}
+
+func (j *Job) finish(result jrpc2.Result, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.EndedAt = time.Now().Unix()
+	j.Result = result
+	switch {
+	case err != nil:
+		j.Status = JOB_FAILED
+		j.Error = err.Error()
+	case j.Cancelled:
+		j.Status = JOB_CANCELLED
+	default:
+		j.Status = JOB_COMPLETED
+	}
+}
+
+// StartJob runs work in the background and returns right away.
+// params are saved with the job, so that it can be resumed if the plugin restarts before it is over
+func (n *Node) StartJob(method string, params any, work func(job *Job) (jrpc2.Result, error)) *JobStarted {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	n.pruneJobs()
+	n.lastJobId++
+	job := &Job{
+		Id:        n.lastJobId,
+		Method:    method,
+		Status:    JOB_RUNNING,
+		StartedAt: time.Now().Unix(),
+		lock:      &sync.Mutex{},
+	}
+	if value, err := json.Marshal(params); err == nil {
+		job.Params = value
+	} else {
+		n.Logln(glightning.Unusual, "unable to save the parameters of the job: ", err)
+	}
+	n.jobs[job.Id] = job
+	n.SaveJob(job)
+
+	go func() {
+		result, err := work(job)
+		// a job stopped by the shutdown is not over: it stays running in the db, to be resumed or aborted on restart
+		if n.shuttingDown.Load() {
+			n.Logf(glightning.Info, "job %d (%s) interrupted by the shutdown", job.Id, job.Method)
+			return
+		}
+		job.finish(result, err)
+		n.deleteJob(job.Id)
+		n.Logf(glightning.Info, "job %d (%s) is over: %s", job.Id, job.Method, job.Status)
+	}()
+
+	n.Logf(glightning.Info, "started job %d (%s)", job.Id, method)
+	return &JobStarted{
+		Id:      job.Id,
+		Message: "job started. Use circular-job-status to follow its progress",
+	}
+}
+
+// pruneJobs forgets jobs that ended more than JOB_RETENTION ago. It assumes that jobsLock is held
+func (n *Node) pruneJobs() {
+	threshold := time.Now().Add(-JOB_RETENTION).Unix()
+	for id, job := range n.jobs {
+		job.lock.Lock()
+		expired := job.Status != JOB_RUNNING && job.EndedAt < threshold
+		job.lock.Unlock()
+		if expired {
+			delete(n.jobs, id)
+			n.deleteJob(id)
+		}
+	}
+}
+
+func (n *Node) GetJob(id uint64) (*Job, error) {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	job, ok := n.jobs[id]
+	if !ok {
+		return nil, util.ErrNoSuchJob
+	}
+	return job.snapshot(), nil
+}
+
+func (n *Node) ListJobs() []*Job {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	result := make([]*Job, 0, len(n.jobs))
+	for _, job := range n.jobs {
+		snapshot := job.snapshot()
+		// results can be big, use circular-job-status to get them
+		snapshot.Result = nil
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+// CancelJob stops a job from firing new htlcs. The htlcs that are in flight will be completed
+func (n *Node) CancelJob(id uint64) (*Job, error) {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	job, ok := n.jobs[id]
+	if !ok {
+		return nil, util.ErrNoSuchJob
+	}
+	job.lock.Lock()
+	if job.Status != JOB_RUNNING {
+		job.lock.Unlock()
+		return nil, util.ErrJobNotRunning
+	}
+	job.Cancelled = true
+	job.lock.Unlock()
+	n.SaveJob(job)
+
+	n.Logf(glightning.Info, "job %d (%s) has been cancelled", job.Id, job.Method)
+	return job.snapshot(), nil
+}
+
+type ListJobs struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+func (l *ListJobs) Name() string {
+	return "circular-jobs"
+}
+
+func (l *ListJobs) New() interface{} {
+	return &ListJobs{}
+}
+
+func (l *ListJobs) Call() (jrpc2.Result, error) {
+	return &ListJobs{Jobs: GetNode().ListJobs()}, nil
+}
+
+type JobStatus struct {
+	Id uint64 `json:"id"`
+}
+
+func (s *JobStatus) Name() string {
+	return "circular-job-status"
+}
+
+func (s *JobStatus) New() interface{} {
+	return &JobStatus{}
+}
+
+func (s *JobStatus) Call() (jrpc2.Result, error) {
+	if s.Id == 0 {
+		return nil, util.ErrNoRequiredParameter
+	}
+	return GetNode().GetJob(s.Id)
+}
+
+type JobCancel struct {
+	Id uint64 `json:"id"`
+}
+
+func (c *JobCancel) Name() string {
+	return "circular-job-cancel"
+}
+
+func (c *JobCancel) New() interface{} {
+	return &JobCancel{}
+}
+
+func (c *JobCancel) Call() (jrpc2.Result, error) {
+	if c.Id == 0 {
+		return nil, util.ErrNoRequiredParameter
+	}
+	return GetNode().CancelJob(c.Id)
+}
@@ -0,0 +1,194 @@
+package node
+
+import (
+	"circular/util"
+	"github.com/elementsproject/glightning/jrpc2"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForJob waits until the job is not running anymore and returns it
+func waitForJob(t *testing.T, n *Node, id uint64) *Job {
+	var job *Job
+	assert.Eventually(t, func() bool {
+		var err error
+		job, err = n.GetJob(id)
+		return err == nil && job.Status != JOB_RUNNING
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestJob_RunsThroughSimnet(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+	route := newTestRoute(t, n, 100000000)
+
+	started := n.StartJob("circular-test", map[string]uint64{"amount": 100000}, func(job *Job) (jrpc2.Result, error) {
+		job.SetProgress(func() *JobProgress {
+			return &JobProgress{Amount: 100000}
+		})
+		hash, err := n.GeneratePreimageHashPair()
+		if err != nil {
+			return nil, err
+		}
+		return n.SendPay(route, hash)
+	})
+	assert.Equal(t, uint64(1), started.Id)
+
+	job := waitForJob(t, n, started.Id)
+	assert.Equal(t, JOB_COMPLETED, job.Status, job.Error)
+	assert.NotZero(t, job.EndedAt)
+	assert.NotNil(t, job.Result)
+	assert.Equal(t, uint64(100000), job.Progress.Amount)
+	assert.JSONEq(t, `{"amount":100000}`, string(job.Params))
+	assert.Equal(t, uint64(200000000), network.Balance("2x2x2", "self"))
+
+	// circular-jobs lists the job without its result
+	jobs := n.ListJobs()
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, started.Id, jobs[0].Id)
+		assert.Equal(t, "circular-test", jobs[0].Method)
+		assert.Equal(t, JOB_COMPLETED, jobs[0].Status)
+		assert.Nil(t, jobs[0].Result)
+	}
+
+	// a job that is over can't be cancelled
+	_, err := n.CancelJob(started.Id)
+	assert.Equal(t, util.ErrJobNotRunning, err)
+}
+
+func TestJob_FailsWithTheErrorOfTheWork(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+	// bob can't send anything back to us
+	network.SetActive("2x2x2", false)
+	route := newTestRoute(t, n, 100000000)
+
+	started := n.StartJob("circular-test", nil, func(job *Job) (jrpc2.Result, error) {
+		hash, err := n.GeneratePreimageHashPair()
+		if err != nil {
+			return nil, err
+		}
+		return n.SendPay(route, hash)
+	})
+
+	job := waitForJob(t, n, started.Id)
+	assert.Equal(t, JOB_FAILED, job.Status)
+	assert.NotEmpty(t, job.Error)
+	assert.Equal(t, uint64(100000000), network.Balance("2x2x2", "self"))
+}
+
+func TestJob_Cancel(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	// the work stops firing once it sees that it has been cancelled, like the parallel rebalances do
+	fired := make(chan struct{}, 100)
+	started := n.StartJob("circular-test", nil, func(job *Job) (jrpc2.Result, error) {
+		for !job.IsCancelled() {
+			select {
+			case fired <- struct{}{}:
+			default:
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return "stopped", nil
+	})
+	<-fired
+
+	running, err := n.GetJob(started.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, JOB_RUNNING, running.Status)
+
+	cancelled, err := n.CancelJob(started.Id)
+	assert.NoError(t, err)
+	assert.True(t, cancelled.Cancelled)
+
+	job := waitForJob(t, n, started.Id)
+	assert.Equal(t, JOB_CANCELLED, job.Status)
+	assert.Equal(t, "stopped", job.Result)
+
+	_, err = n.CancelJob(started.Id)
+	assert.Equal(t, util.ErrJobNotRunning, err)
+	_, err = n.CancelJob(started.Id + 1)
+	assert.Equal(t, util.ErrNoSuchJob, err)
+	_, err = n.GetJob(started.Id + 1)
+	assert.Equal(t, util.ErrNoSuchJob, err)
+}
+
+func TestJob_IdsIncrease(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	work := func(job *Job) (jrpc2.Result, error) {
+		return nil, nil
+	}
+	first := n.StartJob("circular-test", nil, work)
+	second := n.StartJob("circular-test", nil, work)
+	assert.Equal(t, first.Id+1, second.Id)
+	waitForJob(t, n, first.Id)
+	waitForJob(t, n, second.Id)
+
+	jobs := n.ListJobs()
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, first.Id, jobs[0].Id)
+		assert.Equal(t, second.Id, jobs[1].Id)
+	}
+}
+
+func TestJob_NilIsNeverCancelled(t *testing.T) {
+	var job *Job
+	assert.False(t, job.IsCancelled())
+}
+
+func TestJob_ProgressCanCheckTheJob(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	// like the parallel rebalances, the progress takes the lock that is held while the job is checked
+	var amountLock sync.Mutex
+	ready := make(chan struct{})
+	stop := make(chan struct{})
+	started := n.StartJob("circular-test", nil, func(job *Job) (jrpc2.Result, error) {
+		job.SetProgress(func() *JobProgress {
+			amountLock.Lock()
+			defer amountLock.Unlock()
+			return &JobProgress{Amount: 100000}
+		})
+		close(ready)
+		for {
+			select {
+			case <-stop:
+				return nil, nil
+			default:
+			}
+			amountLock.Lock()
+			job.IsCancelled()
+			amountLock.Unlock()
+		}
+	})
+	<-ready
+	n.jobsLock.Lock()
+	job := n.jobs[started.Id]
+	n.jobsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			n.GetJob(started.Id)
+			n.ListJobs()
+			n.SaveJob(job)
+		}
+		n.CancelJob(started.Id)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job and its status are waiting for each other")
+	}
+	close(stop)
+	assert.Equal(t, JOB_CANCELLED, waitForJob(t, n, started.Id).Status)
+}
@@ -0,0 +1,198 @@
+package node
+
+import (
+	"encoding/json"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/elementsproject/glightning/glightning"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_PREFIX = "j_"
+	// running jobs are checkpointed at most this often, the shutdown saves them one last time
+	JOB_SAVE_INTERVAL = 10 * time.Second
+)
+
+// JobResumer starts again on n a job that was running when the plugin stopped, given the parameters
+// it was started with and how far it had gone. It returns the job that takes its place
+type JobResumer func(n *Node, params json.RawMessage, progress *JobProgress) (*JobStarted, error)
+
+// RegisterJobResumer makes the jobs started by method resumable
+func (n *Node) RegisterJobResumer(method string, resumer JobResumer) {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	n.jobResumers[method] = resumer
+}
+
+// SaveJob stores a running job and its progress, so that it survives a restart. Jobs don't expire
+// from the database, they are deleted once they are over
+func (n *Node) SaveJob(job *Job) {
+	if job == nil || n.DB == nil {
+		return
+	}
+	snapshot := job.snapshot()
+	if snapshot.Status != JOB_RUNNING {
+		return
+	}
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		n.Logln(glightning.Unusual, "unable to save job: ", err)
+		return
+	}
+
+	// the lock is held until the job is written, so that a job that is over is never saved again after its deletion
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.Status != JOB_RUNNING {
+		return
+	}
+	if err = n.DB.SetPermanent(JOB_PREFIX+strconv.FormatUint(job.Id, 10), value); err != nil {
+		n.Logln(glightning.Unusual, "unable to save job: ", err)
+		return
+	}
+	job.savedAt = time.Now()
+}
+
+// CheckpointJob saves the job unless it was saved less than JOB_SAVE_INTERVAL ago
+func (n *Node) CheckpointJob(job *Job) {
+	if job == nil {
+		return
+	}
+	job.lock.Lock()
+	recent := time.Since(job.savedAt) < JOB_SAVE_INTERVAL
+	job.lock.Unlock()
+	if !recent {
+		n.SaveJob(job)
+	}
+}
+
+func (n *Node) deleteJob(id uint64) {
+	if n.DB == nil {
+		return
+	}
+	if err := n.DB.Delete(JOB_PREFIX + strconv.FormatUint(id, 10)); err != nil {
+		n.Logln(glightning.Unusual, "unable to delete job: ", err)
+	}
+}
+
+// saveRunningJobs checkpoints the jobs that are still running, so that they can be resumed on restart
+func (n *Node) saveRunningJobs() {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	for _, job := range n.jobs {
+		job.lock.Lock()
+		running := job.Status == JOB_RUNNING
+		job.lock.Unlock()
+		if running {
+			n.SaveJob(job)
+		}
+	}
+}
+
+// loadJobs reads the jobs from the database. The ones that were running when the plugin stopped
+// are marked aborted, or kept aside to be resumed by ResumeJobs if resume is true
+func (n *Node) loadJobs(resume bool) error {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+
+	jobs := make([]*Job, 0)
+	err := n.DB.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(JOB_PREFIX)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			job := &Job{lock: &sync.Mutex{}}
+			if err = json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		n.jobs[job.Id] = job
+		if job.Id > n.lastJobId {
+			n.lastJobId = job.Id
+		}
+		if job.Status != JOB_RUNNING {
+			continue
+		}
+		if _, ok := n.jobResumers[job.Method]; ok && resume && !job.Cancelled {
+			n.interruptedJobs = append(n.interruptedJobs, job)
+			continue
+		}
+		n.abortJob(job, "the plugin stopped while the job was running")
+	}
+	n.pruneJobs()
+	n.Logf(glightning.Info, "loaded %d jobs, %d to resume", len(jobs), len(n.interruptedJobs))
+	return nil
+}
+
+// abortJob assumes that jobsLock is held
+func (n *Node) abortJob(job *Job, reason string) {
+	job.lock.Lock()
+	job.Status = JOB_ABORTED
+	job.EndedAt = time.Now().Unix()
+	job.Error = reason
+	if job.Progress != nil {
+		job.Error += ". " + strconv.FormatUint(job.Progress.AmountRebalanced, 10) + " sats out of " +
+			strconv.FormatUint(job.Progress.Amount, 10) + " had been rebalanced"
+	}
+	job.lock.Unlock()
+	n.deleteJob(job.Id)
+	n.Logf(glightning.Info, "job %d (%s) aborted: %s", job.Id, job.Method, job.Error)
+}
+
+// ResumeJobs starts again the jobs that were interrupted by the last restart, for what they had left to do.
+// It must be called once the node is initialized, because resumers use it
+func (n *Node) ResumeJobs() {
+	n.jobsLock.Lock()
+	interrupted := n.interruptedJobs
+	n.interruptedJobs = nil
+	n.jobsLock.Unlock()
+
+	for _, job := range interrupted {
+		n.jobsLock.Lock()
+		resumer := n.jobResumers[job.Method]
+		n.jobsLock.Unlock()
+
+		progress := job.Progress
+		if progress == nil {
+			progress = &JobProgress{}
+		}
+		started, err := resumer(n, job.Params, progress)
+
+		n.jobsLock.Lock()
+		if err != nil {
+			n.abortJob(job, "unable to resume the job after a restart: "+err.Error())
+			n.jobsLock.Unlock()
+			continue
+		}
+		job.lock.Lock()
+		job.Status = JOB_RESUMED
+		job.EndedAt = time.Now().Unix()
+		job.ResumedAs = started.Id
+		job.lock.Unlock()
+		n.deleteJob(job.Id)
+		if resumed, ok := n.jobs[started.Id]; ok {
+			resumed.lock.Lock()
+			resumed.ResumedFrom = job.Id
+			resumed.lock.Unlock()
+			n.SaveJob(resumed)
+		}
+		n.jobsLock.Unlock()
+		n.Logf(glightning.Info, "job %d (%s) resumed as job %d", job.Id, job.Method, started.Id)
+	}
+}
@@ -0,0 +1,184 @@
+package node
+
+import (
+	"encoding/json"
+	"github.com/elementsproject/glightning/jrpc2"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// startInterruptedJob starts a job on a node in dir that is still running when the node shuts down,
+// after rebalancing 100k sats out of 300k. The node is closed when it returns
+func startInterruptedJob(t *testing.T, dir string) uint64 {
+	n, err := New(newTestNetwork(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready, release := make(chan struct{}), make(chan struct{})
+	started := n.StartJob("circular-test", map[string]uint64{"amount": 300000}, func(job *Job) (jrpc2.Result, error) {
+		job.SetProgress(func() *JobProgress {
+			return &JobProgress{Amount: 300000, AmountRebalanced: 100000}
+		})
+		close(ready)
+		<-release
+		return nil, nil
+	})
+	<-ready
+
+	// a job that is over is not kept in the database
+	over := n.StartJob("circular-test", nil, func(job *Job) (jrpc2.Result, error) {
+		return nil, nil
+	})
+	waitForJob(t, n, over.Id)
+	_, err = n.DB.Get(JOB_PREFIX + strconv.FormatUint(over.Id, 10))
+	assert.Error(t, err)
+
+	n.shuttingDown.Store(true)
+	n.saveRunningJobs()
+	close(release)
+	assert.NoError(t, n.DB.Close())
+	return started.Id
+}
+
+// restart returns a node on dir where the jobs that circular-test started can be resumed
+func restart(t *testing.T, dir string, resumer JobResumer) *Node {
+	n, err := New(newTestNetwork(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	if resumer != nil {
+		n.RegisterJobResumer("circular-test", resumer)
+	}
+	return n
+}
+
+func TestJob_ResumedAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	id := startInterruptedJob(t, dir)
+
+	var params json.RawMessage
+	var progress *JobProgress
+	var n *Node
+	n = restart(t, dir, func(node *Node, p json.RawMessage, jp *JobProgress) (*JobStarted, error) {
+		assert.Same(t, n, node)
+		params, progress = p, jp
+		return node.StartJob("circular-test", p, func(job *Job) (jrpc2.Result, error) {
+			return nil, nil
+		}), nil
+	})
+	assert.NoError(t, n.loadJobs(true))
+	n.ResumeJobs()
+
+	// the resumer gets the parameters and the progress that were saved
+	assert.JSONEq(t, `{"amount":300000}`, string(params))
+	if assert.NotNil(t, progress) {
+		assert.Equal(t, uint64(300000), progress.Amount)
+		assert.Equal(t, uint64(100000), progress.AmountRebalanced)
+	}
+
+	old, err := n.GetJob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, JOB_RESUMED, old.Status)
+	assert.NotZero(t, old.ResumedAs)
+	resumed := waitForJob(t, n, old.ResumedAs)
+	assert.Equal(t, JOB_COMPLETED, resumed.Status)
+	assert.Equal(t, id, resumed.ResumedFrom)
+
+	// neither is left in the database
+	for _, jobId := range []uint64{id, resumed.Id} {
+		_, err = n.DB.Get(JOB_PREFIX + strconv.FormatUint(jobId, 10))
+		assert.Error(t, err, jobId)
+	}
+}
+
+func TestJob_AbortedAfterRestart(t *testing.T) {
+	resumer := func(node *Node, p json.RawMessage, jp *JobProgress) (*JobStarted, error) {
+		t.Error("the job must not be resumed")
+		return nil, nil
+	}
+	tests := []struct {
+		name    string
+		resume  bool
+		resumer JobResumer
+	}{
+		{"resuming is disabled", false, resumer},
+		{"there's no resumer for the method", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			id := startInterruptedJob(t, dir)
+
+			n := restart(t, dir, tt.resumer)
+			assert.NoError(t, n.loadJobs(tt.resume))
+			n.ResumeJobs()
+
+			job, err := n.GetJob(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, JOB_ABORTED, job.Status)
+			assert.Contains(t, job.Error, "100000 sats out of 300000 had been rebalanced")
+			_, err = n.DB.Get(JOB_PREFIX + strconv.FormatUint(id, 10))
+			assert.Error(t, err)
+
+			// new jobs don't reuse the id
+			started := n.StartJob("circular-test", nil, func(job *Job) (jrpc2.Result, error) {
+				return nil, nil
+			})
+			assert.Greater(t, started.Id, id)
+		})
+	}
+}
+
+func TestJob_CheckpointsAreThrottled(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+	saved := func(id uint64) uint64 {
+		value, err := n.DB.Get(JOB_PREFIX + strconv.FormatUint(id, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := &Job{}
+		if err = json.Unmarshal(value, job); err != nil {
+			t.Fatal(err)
+		}
+		return job.Progress.AmountRebalanced
+	}
+
+	var rebalanced atomic.Uint64
+	ready, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	started := n.StartJob("circular-test", nil, func(job *Job) (jrpc2.Result, error) {
+		job.SetProgress(func() *JobProgress {
+			return &JobProgress{Amount: 300000, AmountRebalanced: rebalanced.Load()}
+		})
+		close(ready)
+		<-release
+		return nil, nil
+	})
+	<-ready
+	n.jobsLock.Lock()
+	job := n.jobs[started.Id]
+	n.jobsLock.Unlock()
+
+	// right after a save, a checkpoint doesn't write anything
+	rebalanced.Store(100000)
+	n.SaveJob(job)
+	rebalanced.Store(200000)
+	n.CheckpointJob(job)
+	assert.Equal(t, uint64(100000), saved(started.Id))
+
+	// once the interval is over, it does
+	job.lock.Lock()
+	job.savedAt = job.savedAt.Add(-JOB_SAVE_INTERVAL)
+	job.lock.Unlock()
+	n.CheckpointJob(job)
+	assert.Equal(t, uint64(200000), saved(started.Id))
+}
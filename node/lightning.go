@@ -0,0 +1,70 @@
+package node
+
+import (
+	"circular/graph"
+	"github.com/elementsproject/glightning/glightning"
+	"time"
+)
+
+// Lightning is what the node needs from lightningd.
+// It is implemented by *glightning.Lightning and, for tests, by simnet.Network
+type Lightning interface {
+	GetInfo() (*glightning.NodeInfo, error)
+	ListChannels() ([]*glightning.Channel, error)
+	GetChannel(shortChanId string) ([]*glightning.Channel, error)
+	ListNodes() ([]*glightning.Node, error)
+	ListPeers() ([]*glightning.Peer, error)
+	GetPeer(peerId string) (*glightning.Peer, error)
+	SendPayLite(route []glightning.RouteHop, paymentHash string) (*glightning.SendPayResult, error)
+	SendPay(route []glightning.RouteHop, paymentHash, label string, msat uint64, bolt11 string, paymentSecret string, partId uint64) (*glightning.SendPayResult, error)
+	WaitSendPay(paymentHash string, timeout uint) (*glightning.SendPayFields, error)
+	WaitSendPayPart(paymentHash string, timeout uint, partId uint64) (*glightning.SendPayFields, error)
+	SetTimeout(secs uint)
+}
+
+var _ Lightning = (*glightning.Lightning)(nil)
+
+// New returns a node that is not attached to a plugin: it uses lightning as its backend,
+// keeps its database in dir and runs with the default settings and no cron jobs.
+// The plugin uses GetNode and Init instead
+func New(lightning Lightning, dir string) (*Node, error) {
+	n := newNode()
+	n.lightning = lightning
+
+	info, err := lightning.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	n.Id = info.Id
+
+	decay, err := graph.NewLiquidityDecay(graph.DEFAULT_LIQUIDITY_DECAY, graph.DEFAULT_LIQUIDITY_HALF_LIFE*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	n.liquidityDecay = decay
+	n.liquidityRefresh = DEFAULT_LIQUIDITY_RESET_INTERVAL * time.Minute
+	n.statsRetention = DEFAULT_STATS_RETENTION * 24 * time.Hour
+	n.FinalDelay = graph.DEFAULT_FINAL_DELAY
+	n.Graph = graph.NewGraph()
+	n.Graph.SetLiquidityDecay(decay)
+
+	channels, err := lightning.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+	n.Graph.RefreshChannels(channels)
+
+	if err = n.refreshPeers(); err != nil {
+		return nil, err
+	}
+
+	n.DB = NewDB(dir)
+	n.Budget = NewBudget(0, 0, 0, 0)
+	if err = n.Budget.Load(n.DB); err != nil {
+		return nil, err
+	}
+	if err = n.loadHistory(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -5,10 +5,14 @@ import (
 	"strconv"
 )
 
+// LiquidityUpdate tells us something about the liquidity of a channel.
+// If Success is false, the channel was not able to forward Amount.
+// If Success is true, the channel successfully forwarded Amount.
 type LiquidityUpdate struct {
 	Amount         uint64
 	ShortChannelID string
 	Direction      int
+	Success        bool
 }
 
 func (n *Node) UpdateLiquidity() {
@@ -22,8 +26,13 @@ func (n *Node) UpdateLiquidity() {
 		oppositeDirection := strconv.Itoa(update.Direction ^ 0x1)
 		oppositeChannelId := update.ShortChannelID + "/" + oppositeDirection
 
-		n.Logf(glightning.Debug, "channel %s failed, opposite channel is %s", channelId, oppositeChannelId)
+		if update.Success {
+			n.Logf(glightning.Debug, "channel %s succeeded, opposite channel is %s", channelId, oppositeChannelId)
+			n.Graph.UpdateChannelSuccess(channelId, oppositeChannelId, update.Amount)
+			continue
+		}
 
+		n.Logf(glightning.Debug, "channel %s failed, opposite channel is %s", channelId, oppositeChannelId)
 		n.Graph.UpdateChannel(channelId, oppositeChannelId, update.Amount)
 	}
 }
@@ -0,0 +1,253 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/elementsproject/glightning/glightning"
+	"sync"
+	"time"
+)
+
+const (
+	MULTIPART_TIMEOUT = 60 * time.Second // how long the parts that arrived wait for the others
+)
+
+// multiPartPayment is a payment to ourselves split across several routes, that all share its payment hash.
+// The parts that arrive are held by the htlc_accepted hook until the whole amount is there
+type multiPartPayment struct {
+	total         uint64 // msat expected at the destination
+	received      uint64 // msat held by the hook
+	routes        map[uint64]*graph.Route
+	sent          int // parts whose outcome will be notified
+	notifications int
+	failed        bool
+	timedOut      bool
+	penalized     map[string]bool // nodes already penalized for holding a part that timed out
+	arrived       chan struct{}   // closed once every part arrived, or the payment failed
+	createdAt     time.Time
+	lock          *sync.Mutex
+}
+
+// release wakes up the parts held by the hook. It assumes that the lock is held
+func (p *multiPartPayment) release(failed bool) {
+	select {
+	case <-p.arrived:
+	default:
+		p.failed = failed
+		close(p.arrived)
+	}
+}
+
+func (n *Node) getMultiPart(paymentHash string) *multiPartPayment {
+	n.multiPartsLock.Lock()
+	defer n.multiPartsLock.Unlock()
+	return n.multiParts[paymentHash]
+}
+
+func (n *Node) addMultiPart(paymentHash string, p *multiPartPayment) {
+	n.multiPartsLock.Lock()
+	defer n.multiPartsLock.Unlock()
+
+	// forget the payments whose notifications never came
+	for hash, old := range n.multiParts {
+		if time.Since(old.createdAt) > 2*SENDPAY_TIMEOUT*time.Second {
+			delete(n.multiParts, hash)
+		}
+	}
+	n.multiParts[paymentHash] = p
+}
+
+func (n *Node) deleteMultiPart(paymentHash string) {
+	n.multiPartsLock.Lock()
+	defer n.multiPartsLock.Unlock()
+	delete(n.multiParts, paymentHash)
+}
+
+// SendPayParts sends one payment split across routes, one part per route, and waits for all of them.
+// Every route must end with the same channel to us
+func (n *Node) SendPayParts(routes []*graph.Route, paymentHash string) error {
+	defer util.TimeTrack(time.Now(), "node.SendPayParts", n.Logf)
+
+	// we are the destination: the secret only has to be the same for every part
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	paymentSecret := hex.EncodeToString(secret)
+
+	p := &multiPartPayment{
+		routes:    make(map[uint64]*graph.Route),
+		sent:      len(routes),
+		penalized: make(map[string]bool),
+		arrived:   make(chan struct{}),
+		createdAt: time.Now(),
+		lock:      &sync.Mutex{},
+	}
+	for i, route := range routes {
+		p.total += route.Amount
+		p.routes[uint64(i+1)] = route
+	}
+	if err := n.startPayment(); err != nil {
+		return err
+	}
+	defer n.inflight.Done()
+	n.addMultiPart(paymentHash, p)
+
+	n.Logln(glightning.Debug, "sending payment in ", len(routes), " parts")
+	for partId := uint64(1); partId <= uint64(len(routes)); partId++ {
+		finalRoute := p.routes[partId].ToLightningRoute()
+		if _, err := n.lightning.SendPay(finalRoute, paymentHash, "", p.total, "", paymentSecret, partId); err != nil {
+			n.Logln(glightning.Unusual, err)
+			// the parts already sent can't complete the payment, let them fail.
+			// Only their outcomes will be notified, some of them may already have been
+			p.lock.Lock()
+			p.release(true)
+			p.sent = int(partId - 1)
+			notified := p.notifications >= p.sent
+			p.lock.Unlock()
+			if notified {
+				n.deleteMultiPart(paymentHash)
+			}
+			return util.ErrFirstPeerNotReady
+		}
+	}
+
+	n.Logln(glightning.Debug, "waiting for the parts to be confirmed")
+	errs := make(chan error, len(routes))
+	for partId, route := range p.routes {
+		go func(partId uint64, finalRoute []glightning.RouteHop) {
+			if _, err := n.lightning.WaitSendPayPart(paymentHash, SENDPAY_TIMEOUT, partId); err != nil {
+				if err.Error() == util.ErrSendPayTimeout.Error() {
+					errs <- n.managePartTimeout(p, paymentHash, finalRoute)
+					return
+				}
+				_, err = n.sendPayError(err, finalRoute, paymentHash)
+				errs <- err
+				return
+			}
+			errs <- nil
+		}(partId, route.ToLightningRoute())
+	}
+
+	var result error
+	for range routes {
+		// the first error tells why the payment failed, the others follow from it
+		if err := <-errs; err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// waitForParts holds a part of amount msat of the payment p until the whole amount has arrived.
+// It returns whether the payment can be resolved
+func (n *Node) waitForParts(p *multiPartPayment, paymentHash string, amount uint64) bool {
+	p.lock.Lock()
+	p.received += amount
+	if p.received >= p.total {
+		p.release(false)
+	}
+	p.lock.Unlock()
+
+	select {
+	case <-p.arrived:
+	case <-time.After(MULTIPART_TIMEOUT):
+		n.Logf(glightning.Unusual, "not every part of %s arrived after %s, failing the payment", paymentHash, MULTIPART_TIMEOUT)
+		p.lock.Lock()
+		p.release(true)
+		p.lock.Unlock()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.failed
+}
+
+// managePartTimeout is manageTimeout for a part of p. The payment times out once, however many of its
+// parts time out, and every node holding them is penalized once
+func (n *Node) managePartTimeout(p *multiPartPayment, paymentHash string, finalRoute []glightning.RouteHop) error {
+	p.lock.Lock()
+	first := !p.timedOut
+	p.timedOut = true
+	hops := make([]glightning.RouteHop, 0, len(finalRoute))
+	for _, hop := range finalRoute {
+		if !p.penalized[hop.Id] {
+			p.penalized[hop.Id] = true
+			hops = append(hops, hop)
+		}
+	}
+	p.lock.Unlock()
+
+	if first {
+		n.timeoutPayment(paymentHash)
+	}
+	n.penalizeTimeout(hops)
+	return util.ErrSendPayTimeout
+}
+
+// notified counts a notification of a part and returns whether it is the first one.
+// The payment is forgotten once every part that was sent has been notified
+func (n *Node) notified(p *multiPartPayment, paymentHash string) bool {
+	p.lock.Lock()
+	p.notifications++
+	first := p.notifications == 1
+	last := p.notifications >= p.sent
+	p.lock.Unlock()
+
+	if last {
+		n.deleteMultiPart(paymentHash)
+	}
+	return first
+}
+
+// onPartSuccess handles the success of a part. The parts are resolved all together,
+// so the first success means that every part succeeded
+func (n *Node) onPartSuccess(p *multiPartPayment, ss *glightning.SendPaySuccess) {
+	if !n.notified(p, ss.PaymentHash) {
+		return
+	}
+	if err := n.deleteIfOurs(ss.PaymentHash); err != nil {
+		n.Logln(glightning.Unusual, err)
+	}
+
+	// the success is saved once, for the whole amount
+	success := *ss
+	success.MilliSatoshi = p.total
+	if err := n.SaveToDb(StatKey(SUCCESS_PREFIX, int64(ss.CreatedAt), ss.PaymentHash), &success); err != nil {
+		n.Logln(glightning.Unusual, err)
+	}
+
+	for _, route := range p.routes {
+		n.recordRebalance(route, true, int64(ss.CreatedAt))
+		n.updateLiquiditySuccess(route)
+	}
+}
+
+// onPartFailure handles the failure of a part: the other parts can't complete the payment anymore
+func (n *Node) onPartFailure(p *multiPartPayment, sf *glightning.SendPayFailure) {
+	p.lock.Lock()
+	p.release(true)
+	p.lock.Unlock()
+
+	stuck := n.timedOut(sf.Data.PaymentHash)
+	if n.notified(p, sf.Data.PaymentHash) {
+		if err := n.deleteIfOurs(sf.Data.PaymentHash); err != nil {
+			n.Logln(glightning.Unusual, err)
+		}
+		if err := n.SaveToDb(StatKey(FAILURE_PREFIX, int64(sf.Data.CreatedAt), sf.Data.PaymentHash), sf); err != nil {
+			n.Logln(glightning.Unusual, err)
+		}
+		for _, route := range p.routes {
+			n.recordRebalance(route, false, int64(sf.Data.CreatedAt))
+		}
+	}
+
+	// the parts that arrived and were failed by us don't tell anything about the liquidity
+	if sf.Data.ErringNode == n.Id {
+		return
+	}
+	n.updateLiquidityFailure(sf)
+	n.updateReputation(sf, stuck)
+}
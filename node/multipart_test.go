@@ -0,0 +1,99 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/simnet"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testLightning is a simnet where sending a part and waiting for it can be intercepted
+type testLightning struct {
+	*simnet.Network
+	beforeSend func(partId uint64)
+	wait       func(paymentHash string, partId uint64) error
+}
+
+func (l *testLightning) SendPay(route []glightning.RouteHop, paymentHash, label string, msat uint64, bolt11 string, paymentSecret string, partId uint64) (*glightning.SendPayResult, error) {
+	if l.beforeSend != nil {
+		l.beforeSend(partId)
+	}
+	return l.Network.SendPay(route, paymentHash, label, msat, bolt11, paymentSecret, partId)
+}
+
+func (l *testLightning) WaitSendPayPart(paymentHash string, timeout uint, partId uint64) (*glightning.SendPayFields, error) {
+	if l.wait != nil {
+		if err := l.wait(paymentHash, partId); err != nil {
+			return nil, err
+		}
+	}
+	return l.Network.WaitSendPayPart(paymentHash, timeout, partId)
+}
+
+func newTestLightning(t *testing.T) (*Node, *testLightning) {
+	lightning := &testLightning{Network: newTestNetwork()}
+	n, err := New(lightning, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	lightning.OnSendPaySuccess = n.OnPaymentSuccess
+	lightning.OnSendPayFailure = n.OnPaymentFailure
+	lightning.OnHtlcAccepted = n.OnHtlcAccepted
+	return n, lightning
+}
+
+func TestSendPayParts_KeepsThePaymentUntilEveryPartIsNotified(t *testing.T) {
+	n, lightning := newTestLightning(t)
+	hash, err := n.GeneratePreimageHashPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first part fails before the second one is sent
+	kept := false
+	lightning.beforeSend = func(partId uint64) {
+		if partId != 2 {
+			return
+		}
+		n.OnPaymentFailure(&glightning.SendPayFailure{
+			Data: glightning.SendPayFailureData{PaymentHash: hash, ErringNode: n.Id},
+		})
+		kept = n.getMultiPart(hash) != nil
+	}
+	routes := []*graph.Route{newTestRoute(t, n, 100000000), newTestRoute(t, n, 50000000)}
+	assert.Error(t, n.SendPayParts(routes, hash))
+
+	assert.True(t, kept, "the payment was forgotten while its parts were being sent")
+	assert.Eventually(t, func() bool {
+		return n.getMultiPart(hash) == nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(100000000), lightning.Balance("2x2x2", "self"))
+}
+
+func TestSendPayParts_TimesOutOnce(t *testing.T) {
+	n, lightning := newTestLightning(t)
+	hash, err := n.GeneratePreimageHashPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lightning.wait = func(string, uint64) error {
+		return util.ErrSendPayTimeout
+	}
+	routes := []*graph.Route{newTestRoute(t, n, 100000000), newTestRoute(t, n, 50000000)}
+	assert.Equal(t, util.ErrSendPayTimeout, n.SendPayParts(routes, hash))
+
+	assert.True(t, n.timedOut(hash))
+	_, err = n.DB.Get(hash)
+	assert.Error(t, err)
+	// both parts went through alice and bob, they are penalized once
+	assert.InDelta(t, graph.TIMEOUT_PENALTY, n.Graph.GetPenalty("alice"), 0.01)
+	assert.InDelta(t, graph.TIMEOUT_PENALTY, n.Graph.GetPenalty("bob"), 0.01)
+	assert.Zero(t, n.Graph.GetPenalty("self"))
+}
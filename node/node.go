@@ -5,9 +5,11 @@ import (
 	"circular/util"
 	"fmt"
 	"github.com/elementsproject/glightning/glightning"
+	"github.com/robfig/cron/v3"
 	"log"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,16 +26,39 @@ var (
 )
 
 type Node struct {
-	lightning           *glightning.Lightning
+	lightning           Lightning
 	plugin              *glightning.Plugin
 	liquidityRefresh    time.Duration
+	liquidityDecay      *graph.LiquidityDecay
 	initLock            *sync.Mutex
 	saveStats           bool
+	statsRetention      time.Duration
+	FinalDelay          uint
 	PeersLock           *sync.RWMutex
+	routesLock          *sync.Mutex
+	routes              map[string]*graph.Route
+	multiPartsLock      *sync.Mutex
+	multiParts          map[string]*multiPartPayment
+	blocklistLock       *sync.Mutex
+	blocklist           *Blocklist
+	jobsLock            *sync.Mutex
+	jobs                map[uint64]*Job
+	lastJobId           uint64
+	resumeJobs          bool
+	jobResumers         map[string]JobResumer
+	interruptedJobs     []*Job
+	history             *historyCache
+	cron                *cron.Cron
+	aliasesRefreshed    time.Time
+	inflight            sync.WaitGroup
+	inflightLock        sync.Mutex
+	shutdownOnce        sync.Once
+	shuttingDown        atomic.Bool
 	Id                  string
 	Peers               map[string]*glightning.Peer
 	Graph               *graph.Graph
 	DB                  *Store
+	Budget              *Budget
 	LiquidityUpdateChan chan *LiquidityUpdate
 	Stopped             bool
 }
@@ -41,13 +66,7 @@ type Node struct {
 func GetNode() *Node {
 	once.Do(func() {
 		rand.Seed(time.Now().UnixNano())
-		singleton = &Node{
-			initLock:            &sync.Mutex{},
-			PeersLock:           &sync.RWMutex{},
-			Peers:               make(map[string]*glightning.Peer),
-			LiquidityUpdateChan: make(chan *LiquidityUpdate, 16),
-		}
-		go singleton.UpdateLiquidity()
+		singleton = newNode()
 	})
 	// This makes sure the node is not used until it is initialized or refreshed
 	singleton.initLock.Lock()
@@ -56,7 +75,28 @@ func GetNode() *Node {
 	return singleton
 }
 
-func (n *Node) Init(lightning *glightning.Lightning, plugin *glightning.Plugin, options map[string]glightning.Option, config *glightning.Config) {
+func newNode() *Node {
+	n := &Node{
+		initLock:            &sync.Mutex{},
+		PeersLock:           &sync.RWMutex{},
+		routesLock:          &sync.Mutex{},
+		routes:              make(map[string]*graph.Route),
+		multiPartsLock:      &sync.Mutex{},
+		multiParts:          make(map[string]*multiPartPayment),
+		blocklistLock:       &sync.Mutex{},
+		blocklist:           newBlocklist(),
+		jobsLock:            &sync.Mutex{},
+		jobs:                make(map[uint64]*Job),
+		jobResumers:         make(map[string]JobResumer),
+		history:             newHistoryCache(),
+		Peers:               make(map[string]*glightning.Peer),
+		LiquidityUpdateChan: make(chan *LiquidityUpdate, 16),
+	}
+	go n.UpdateLiquidity()
+	return n
+}
+
+func (n *Node) Init(lightning Lightning, plugin *glightning.Plugin, options map[string]glightning.Option, config *glightning.Config) {
 	defer util.TimeTrack(time.Now(), "node.Init", n.Logf)
 	n.initLock.Lock()
 	defer n.initLock.Unlock()
@@ -72,6 +112,7 @@ func (n *Node) Init(lightning *glightning.Lightning, plugin *glightning.Plugin,
 
 	n.Logln(glightning.Debug, "loading from file")
 	n.getGraphFromFile(err, config)
+	n.Graph.SetLiquidityDecay(n.liquidityDecay)
 
 	n.Logln(glightning.Debug, "refreshing graph")
 	if err = n.refreshGraph(); err != nil {
@@ -86,6 +127,29 @@ func (n *Node) Init(lightning *glightning.Lightning, plugin *glightning.Plugin,
 	n.Logln(glightning.Debug, "opening database")
 	n.DB = NewDB(config.LightningDir + "/" + CIRCULAR_DIR)
 
+	n.Logln(glightning.Debug, "setting up stats")
+	n.setupStats()
+
+	n.Logln(glightning.Debug, "loading the history of rebalances")
+	if err = n.loadHistory(); err != nil {
+		n.Logln(glightning.Unusual, "unable to load the history of rebalances: ", err)
+	}
+
+	n.Logln(glightning.Debug, "loading fee budget")
+	if err = n.Budget.Load(n.DB); err != nil {
+		n.Logln(glightning.Unusual, "unable to load fee budget: ", err)
+	}
+
+	n.Logln(glightning.Debug, "loading blocklist")
+	if err = n.loadBlocklist(); err != nil {
+		n.Logln(glightning.Unusual, "unable to load blocklist: ", err)
+	}
+
+	n.Logln(glightning.Debug, "loading jobs")
+	if err = n.loadJobs(n.resumeJobs); err != nil {
+		n.Logln(glightning.Unusual, "unable to load jobs: ", err)
+	}
+
 	n.Logln(glightning.Debug, "setting up cronjobs")
 	n.setupCronJobs(options)
 
@@ -105,7 +169,7 @@ func (n *Node) getGraphFromFile(err error, config *glightning.Config) {
 	}
 }
 
-func (n *Node) setOptions(lightning *glightning.Lightning, plugin *glightning.Plugin, options map[string]glightning.Option) {
+func (n *Node) setOptions(lightning Lightning, plugin *glightning.Plugin, options map[string]glightning.Option) {
 	n.lightning = lightning
 	n.plugin = plugin
 	n.Logln(glightning.Info, "initializing node")
@@ -113,17 +177,49 @@ func (n *Node) setOptions(lightning *glightning.Lightning, plugin *glightning.Pl
 	n.liquidityRefresh = time.Duration(options["circular-liquidity-refresh"].GetValue().(int)) * time.Minute
 	n.Logln(glightning.Debug, "liquidity refresh interval: ", int(n.liquidityRefresh.Minutes()), " minutes")
 
+	halfLife := time.Duration(options["circular-liquidity-half-life"].GetValue().(int)) * time.Minute
+	decay, err := graph.NewLiquidityDecay(options["circular-liquidity-decay"].GetValue().(string), halfLife)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	n.liquidityDecay = decay
+	n.Logln(glightning.Debug, "liquidity decay: ", decay.Model, ", half-life: ", int(halfLife.Minutes()), " minutes")
+
+	n.Budget = NewBudget(
+		uint64(options["circular-budget-hour"].GetValue().(int)),
+		uint64(options["circular-budget-day"].GetValue().(int)),
+		uint64(options["circular-budget-week"].GetValue().(int)),
+		uint64(options["circular-budget-peer"].GetValue().(int)),
+	)
+	n.Logf(glightning.Debug, "fee budget: %+v, per peer: %d msat", n.Budget.Limits, n.Budget.PeerLimit)
+
 	n.saveStats = options["circular-save-stats"].GetValue().(bool)
 	n.Logln(glightning.Debug, "save stats: ", n.saveStats)
 
+	n.statsRetention = time.Duration(options["circular-stats-retention"].GetValue().(int)) * 24 * time.Hour
+	n.Logln(glightning.Debug, "stats retention: ", int(n.statsRetention.Hours()/24), " days")
+
+	n.FinalDelay = uint(options["circular-final-cltv"].GetValue().(int))
+	n.Logln(glightning.Debug, "final cltv: ", n.FinalDelay)
+
+	n.resumeJobs = options["circular-resume-jobs"].GetValue().(bool)
+	n.Logln(glightning.Debug, "resume jobs: ", n.resumeJobs)
+
 	n.lightning.SetTimeout(DEFAULT_RPC_TIMEOUT)
 }
 
 func (n *Node) Logf(level glightning.LogLevel, format string, v ...any) {
+	// nodes created with New are not attached to a plugin
+	if n.plugin == nil {
+		return
+	}
 	n.plugin.Log(util.GetCallInfo()+fmt.Sprintf(format, v...), level)
 }
 
 func (n *Node) Logln(level glightning.LogLevel, v ...any) {
+	if n.plugin == nil {
+		return
+	}
 	n.plugin.Log(util.GetCallInfo()+fmt.Sprint(v...), level)
 }
 
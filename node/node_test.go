@@ -0,0 +1,51 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/simnet"
+	"testing"
+)
+
+// newTestNode returns a node backed by network, wired to its notifications like the plugin does
+func newTestNode(t *testing.T, network *simnet.Network) *Node {
+	n, err := New(network, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	network.OnSendPaySuccess = n.OnPaymentSuccess
+	network.OnSendPayFailure = n.OnPaymentFailure
+	network.OnHtlcAccepted = n.OnHtlcAccepted
+	return n
+}
+
+// newTestNetwork returns a network where self has a channel to alice and one to bob,
+// and alice can forward to bob
+func newTestNetwork() *simnet.Network {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 500000, 0, 10)
+	return network
+}
+
+// newTestRoute returns the route of a rebalance of amount msat from alice to bob, through 1x1x1 and 2x2x2
+func newTestRoute(t *testing.T, n *Node, amount uint64) *graph.Route {
+	out, err := n.GetOutgoingChannelFromScid("1x1x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := n.GetIncomingChannelFromScid("2x2x2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := n.Graph.GetRoute(out.Destination, in.Source, amount, nil, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.Prepend(out)
+	route.Append(in, n.FinalDelay)
+	return route
+}
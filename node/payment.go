@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/elementsproject/glightning/glightning"
+	"strconv"
 	"time"
 )
 
@@ -17,50 +18,94 @@ const (
 	SENDPAY_TIMEOUT = 120 // 2 minutes
 )
 
+const (
+	WIRE_UNKNOWN_NEXT_PEER         = "WIRE_UNKNOWN_NEXT_PEER"
+	WIRE_CHANNEL_DISABLED          = "WIRE_CHANNEL_DISABLED"
+	WIRE_FEE_INSUFFICIENT          = "WIRE_FEE_INSUFFICIENT"
+	WIRE_INCORRECT_CLTV_EXPIRY     = "WIRE_INCORRECT_CLTV_EXPIRY"
+	WIRE_TEMPORARY_NODE_FAILURE    = "WIRE_TEMPORARY_NODE_FAILURE"
+	WIRE_PERMANENT_NODE_FAILURE    = "WIRE_PERMANENT_NODE_FAILURE"
+	WIRE_PERMANENT_CHANNEL_FAILURE = "WIRE_PERMANENT_CHANNEL_FAILURE"
+)
+
 func (n *Node) SendPay(route *graph.Route, paymentHash string) (*glightning.SendPayFields, error) {
 	defer util.TimeTrack(time.Now(), "node.SendPay", n.Logf)
 	finalRoute := route.ToLightningRoute()
 
+	if err := n.startPayment(); err != nil {
+		return nil, err
+	}
+	defer n.inflight.Done()
+
 	n.Logln(glightning.Debug, "sending payment")
+	n.addRoute(paymentHash, route)
 	if _, err := n.lightning.SendPayLite(finalRoute, paymentHash); err != nil {
 		n.Logln(glightning.Unusual, err)
+		n.popRoute(paymentHash)
 		return nil, util.ErrFirstPeerNotReady
 	}
 
 	n.Logln(glightning.Debug, "waiting for payment to be confirmed")
 	result, err := n.lightning.WaitSendPay(paymentHash, SENDPAY_TIMEOUT)
-
 	if err != nil {
-		n.Logf(glightning.Debug, "%+v", err)
-		n.Logln(glightning.Debug, "err.Error(): ", err.Error())
+		return n.sendPayError(err, finalRoute, paymentHash)
+	}
 
-		// in case of timeout, there's some work to do
-		if err.Error() == util.ErrSendPayTimeout.Error() {
-			return n.manageTimeout(paymentHash)
-		}
+	return result, nil
+}
+
+// sendPayError turns the error of waitsendpay into the error of the rebalance
+func (n *Node) sendPayError(err error, finalRoute []glightning.RouteHop, paymentHash string) (*glightning.SendPayFields, error) {
+	n.Logf(glightning.Debug, "%+v", err)
+	n.Logln(glightning.Debug, "err.Error(): ", err.Error())
 
-		// in case of WIRE_FEE_INSUFFICIENT, we return only if the last hop is the one who originated the error
-		// in this way we make the rebalance fail if the last node changed fees, but treat
-		// WIRE_FEE_INSUFFICIENT errors along the path as a liquidity failure
-		if err.Error() == util.ErrWireFeeInsufficient.Error() {
-			// we need to get the full error
-			var paymentError *glightning.PaymentError
-			if errors.As(err, &paymentError) {
-				lastNode := finalRoute[len(finalRoute)-2].Id
-				if lastNode == paymentError.Data.ErringNode {
-					n.Logln(glightning.Debug, "last node is the node that caused the error")
-					return nil, util.ErrWireFeeInsufficient
-				}
+	// in case of timeout, there's some work to do
+	if err.Error() == util.ErrSendPayTimeout.Error() {
+		return n.manageTimeout(paymentHash, finalRoute)
+	}
+
+	// in case of WIRE_FEE_INSUFFICIENT, we return only if the last hop is the one who originated the error
+	// in this way we make the rebalance fail if the last node changed fees, but treat
+	// WIRE_FEE_INSUFFICIENT errors along the path as a liquidity failure
+	if err.Error() == util.ErrWireFeeInsufficient.Error() {
+		// we need to get the full error
+		var paymentError *glightning.PaymentError
+		if errors.As(err, &paymentError) {
+			lastNode := finalRoute[len(finalRoute)-2].Id
+			if lastNode == paymentError.Data.ErringNode {
+				n.Logln(glightning.Debug, "last node is the node that caused the error")
+				return nil, util.ErrWireFeeInsufficient
 			}
 		}
-
-		return nil, err
 	}
 
-	return result, nil
+	return nil, err
+}
+
+// addRoute remembers the route of a payment until its outcome is known
+func (n *Node) addRoute(paymentHash string, route *graph.Route) {
+	n.routesLock.Lock()
+	defer n.routesLock.Unlock()
+	n.routes[paymentHash] = route
 }
 
-func (n *Node) manageTimeout(paymentHash string) (*glightning.SendPayFields, error) {
+// popRoute returns the route of a payment and forgets it
+func (n *Node) popRoute(paymentHash string) *graph.Route {
+	n.routesLock.Lock()
+	defer n.routesLock.Unlock()
+	route := n.routes[paymentHash]
+	delete(n.routes, paymentHash)
+	return route
+}
+
+func (n *Node) manageTimeout(paymentHash string, finalRoute []glightning.RouteHop) (*glightning.SendPayFields, error) {
+	n.timeoutPayment(paymentHash)
+	n.penalizeTimeout(finalRoute)
+	return nil, util.ErrSendPayTimeout
+}
+
+// timeoutPayment makes the payment fail if its htlc comes in, and remembers that it timed out
+func (n *Node) timeoutPayment(paymentHash string) {
 	// delete the preimage from the DB. In this way the payment will fail when the HTLC comes in
 	n.Logln(glightning.Debug, "payment timed out, deleting preimage from database")
 	if err := n.DB.Delete(paymentHash); err != nil {
@@ -72,8 +117,22 @@ func (n *Node) manageTimeout(paymentHash string) (*glightning.SendPayFields, err
 	if err := n.DB.Set(TIMEOUT_PREFIX+paymentHash, []byte("timeout")); err != nil {
 		n.Logln(glightning.Unusual, err)
 	}
+}
+
+// penalizeTimeout lowers the reputation of the nodes of a route that timed out:
+// any of them may be holding the payment, so all of them lose some reputation
+func (n *Node) penalizeTimeout(finalRoute []glightning.RouteHop) {
+	for _, hop := range finalRoute {
+		if hop.Id != n.Id {
+			n.Graph.AddPenalty(hop.Id, graph.TIMEOUT_PENALTY)
+		}
+	}
+}
 
-	return nil, util.ErrSendPayTimeout
+// timedOut tells whether the payment is one of ours that timed out
+func (n *Node) timedOut(paymentHash string) bool {
+	_, err := n.DB.Get(TIMEOUT_PREFIX + paymentHash)
+	return err == nil
 }
 
 func (n *Node) deleteIfOurs(paymentHash string) error {
@@ -100,32 +159,122 @@ func (n *Node) deleteIfOurs(paymentHash string) error {
 }
 
 func (n *Node) OnPaymentFailure(sf *glightning.SendPayFailure) {
+	// the fee of a payment that timed out was kept reserved until now
+	n.Budget.Release(sf.Data.PaymentHash)
+	if p := n.getMultiPart(sf.Data.PaymentHash); p != nil {
+		n.onPartFailure(p, sf)
+		return
+	}
+	stuck := n.timedOut(sf.Data.PaymentHash)
 	if err := n.deleteIfOurs(sf.Data.PaymentHash); err != nil {
 		return // this payment was not made by us
 	}
+	n.recordRebalance(n.popRoute(sf.Data.PaymentHash), false, int64(sf.Data.CreatedAt))
 
 	// save to db
-	if err := n.SaveToDb(FAILURE_PREFIX+sf.Data.PaymentHash, sf); err != nil {
+	if err := n.SaveToDb(StatKey(FAILURE_PREFIX, int64(sf.Data.CreatedAt), sf.Data.PaymentHash), sf); err != nil {
 		n.Logln(glightning.Unusual, err)
 	}
 
+	n.updateLiquidityFailure(sf)
+	n.updateReputation(sf, stuck)
+}
+
+// updateReputation lowers the reputation of the node that failed the payment. A failure of a
+// payment that already timed out is the worst, since the node kept our liquidity locked for long
+func (n *Node) updateReputation(sf *glightning.SendPayFailure, stuck bool) {
+	if sf.Data.ErringNode == n.Id {
+		return
+	}
+
+	penalty := graph.LIQUIDITY_FAILURE_PENALTY
+	switch sf.Data.FailCodeName {
+	case WIRE_UNKNOWN_NEXT_PEER, WIRE_CHANNEL_DISABLED, WIRE_TEMPORARY_NODE_FAILURE, WIRE_PERMANENT_NODE_FAILURE:
+		penalty = graph.FAILURE_PENALTY
+	case WIRE_FEE_INSUFFICIENT, WIRE_INCORRECT_CLTV_EXPIRY, WIRE_PERMANENT_CHANNEL_FAILURE:
+		// our gossip was outdated or the channel is gone, the node did nothing wrong
+		penalty = 0
+	}
+	if stuck {
+		penalty = graph.STUCK_PENALTY
+	}
+	if penalty == 0 {
+		return
+	}
+	n.Logf(glightning.Debug, "lowering the reputation of %s by %.2f", sf.Data.ErringNode, penalty)
+	n.Graph.AddPenalty(sf.Data.ErringNode, penalty)
+}
+
+// updateLiquidityFailure learns what it can from the failure of a payment
+func (n *Node) updateLiquidityFailure(sf *glightning.SendPayFailure) {
 	n.Logf(glightning.Debug, "code: %d, failcode: %d, failcodename: %s", sf.Code, sf.Data.FailCode, sf.Data.FailCodeName)
 
-	// TODO: handle failure codes separately: right now we treat every failure as a liquidity failure, but it might not be the case
-	n.LiquidityUpdateChan <- &LiquidityUpdate{
-		Amount:         sf.Data.MilliSatoshi - util.Min(sf.Data.MilliSatoshi, 1000000),
-		ShortChannelID: sf.Data.ErringChannel,
-		Direction:      sf.Data.ErringDirection,
+	channelId := sf.Data.ErringChannel + "/" + strconv.Itoa(sf.Data.ErringDirection)
+	switch sf.Data.FailCodeName {
+	case WIRE_UNKNOWN_NEXT_PEER, WIRE_CHANNEL_DISABLED:
+		// the channel can't be used right now, gossip will tell us when it's back
+		n.Logln(glightning.Debug, "disabling channel ", channelId)
+		n.Graph.DisableChannel(channelId)
+	case WIRE_FEE_INSUFFICIENT, WIRE_INCORRECT_CLTV_EXPIRY:
+		// our gossip is outdated, get the latest channel update
+		n.Logln(glightning.Debug, "refreshing channel ", channelId)
+		channel, err := n.Graph.GetChannel(channelId)
+		if err != nil {
+			n.Logln(glightning.Unusual, err)
+			return
+		}
+		n.RefreshChannel(channel)
+	case WIRE_TEMPORARY_NODE_FAILURE, WIRE_PERMANENT_NODE_FAILURE:
+		n.Logln(glightning.Debug, "penalizing node ", sf.Data.ErringNode)
+		n.Graph.PenalizeNode(sf.Data.ErringNode)
+	case WIRE_PERMANENT_CHANNEL_FAILURE:
+		// the channel is closed or about to be
+		n.Logln(glightning.Debug, "removing channel ", sf.Data.ErringChannel)
+		n.Graph.RemoveChannel(sf.Data.ErringChannel)
+	default:
+		// WIRE_TEMPORARY_CHANNEL_FAILURE and anything we don't know how to handle is a liquidity failure
+		n.LiquidityUpdateChan <- &LiquidityUpdate{
+			Amount:         sf.Data.MilliSatoshi - util.Min(sf.Data.MilliSatoshi, 1000000),
+			ShortChannelID: sf.Data.ErringChannel,
+			Direction:      sf.Data.ErringDirection,
+		}
 	}
 }
 
 func (n *Node) OnPaymentSuccess(ss *glightning.SendPaySuccess) {
+	if err := n.Budget.Commit(ss.PaymentHash); err != nil {
+		n.Logln(glightning.Unusual, "unable to save spend to db: ", err)
+	}
+	if p := n.getMultiPart(ss.PaymentHash); p != nil {
+		n.onPartSuccess(p, ss)
+		return
+	}
 	if err := n.deleteIfOurs(ss.PaymentHash); err != nil {
 		return // this payment was not made by us
 	}
 
 	// save to db
-	if err := n.SaveToDb(SUCCESS_PREFIX+ss.PaymentHash, ss); err != nil {
+	if err := n.SaveToDb(StatKey(SUCCESS_PREFIX, int64(ss.CreatedAt), ss.PaymentHash), ss); err != nil {
 		n.Logln(glightning.Unusual, err)
 	}
+
+	route := n.popRoute(ss.PaymentHash)
+	if route == nil {
+		n.Logln(glightning.Debug, "route not found for payment ", ss.PaymentHash)
+		return
+	}
+	n.recordRebalance(route, true, int64(ss.CreatedAt))
+	n.updateLiquiditySuccess(route)
+}
+
+// updateLiquiditySuccess records that every channel in the route was able to forward the payment
+func (n *Node) updateLiquiditySuccess(route *graph.Route) {
+	for _, hop := range route.Hops {
+		n.LiquidityUpdateChan <- &LiquidityUpdate{
+			Amount:         hop.MilliSatoshi,
+			ShortChannelID: hop.ShortChannelId,
+			Direction:      int(hop.GetDirection()),
+			Success:        true,
+		}
+	}
 }
@@ -122,7 +122,18 @@ func (n *Node) OnConnect(c *glightning.ConnectEvent) {
 
 	if _, ok := n.Peers[c.PeerId]; ok {
 		n.Peers[c.PeerId].Connected = true
+		return
 	}
+
+	// a new peer, it may be about to open a channel with us
+	go func() {
+		changes, err := n.refreshPeer(c.PeerId)
+		if err != nil {
+			n.Logln(glightning.Debug, err)
+			return
+		}
+		n.applyStateChanges(changes)
+	}()
 }
 
 func (n *Node) OnDisconnect(c *glightning.DisconnectEvent) {
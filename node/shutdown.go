@@ -0,0 +1,84 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"time"
+)
+
+const (
+	SHUTDOWN_TIMEOUT = 25 * time.Second // lightningd kills plugins 30 seconds after notifying the shutdown
+)
+
+// Shutdown stops firing new htlcs, waits at most timeout for the payments in flight,
+// saves the graph and closes the database. It is safe to call it more than once
+func (n *Node) Shutdown(timeout time.Duration) {
+	n.shutdownOnce.Do(func() {
+		n.shutdown(timeout)
+	})
+}
+
+func (n *Node) shutdown(timeout time.Duration) {
+	defer util.TimeTrack(time.Now(), "node.Shutdown", n.Logf)
+	n.Logln(glightning.Info, "shutting down")
+	n.Stopped = true
+	// after this, no payment can be added to the ones the shutdown waits for
+	n.inflightLock.Lock()
+	n.shuttingDown.Store(true)
+	n.inflightLock.Unlock()
+
+	// the node may be shutting down before it has been initialized
+	if n.lightning == nil {
+		return
+	}
+
+	if n.cron != nil {
+		n.cron.Stop()
+	}
+
+	n.Logln(glightning.Debug, "waiting for payments in flight")
+	done := make(chan struct{})
+	go func() {
+		n.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		n.Logln(glightning.Debug, "no payments in flight")
+	case <-time.After(timeout):
+		n.Logf(glightning.Unusual, "payments still in flight after %s, shutting down anyway", timeout)
+	}
+
+	if n.Graph != nil {
+		n.Logln(glightning.Debug, "saving graph to file")
+		if err := n.SaveGraphToFile(CIRCULAR_DIR, graph.FILE); err != nil {
+			n.Logln(glightning.Unusual, "error saving graph to file: ", err)
+		}
+	}
+
+	if n.DB != nil {
+		n.Logln(glightning.Debug, "saving running jobs")
+		n.saveRunningJobs()
+
+		n.Logln(glightning.Debug, "closing database")
+		if err := n.DB.Close(); err != nil {
+			n.Logln(glightning.Unusual, "error closing database: ", err)
+		}
+	}
+
+	n.Logln(glightning.Info, "shutdown complete")
+}
+
+// startPayment keeps track of a payment in flight, so that a shutdown can wait for it.
+// It fails once the shutdown started, the caller must call inflight.Done otherwise
+func (n *Node) startPayment() error {
+	n.inflightLock.Lock()
+	defer n.inflightLock.Unlock()
+
+	if n.shuttingDown.Load() {
+		return util.ErrCircularStopped
+	}
+	n.inflight.Add(1)
+	return nil
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"circular/graph"
+	"circular/util"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// newShutdownNode returns a test node run from a temporary directory, where the shutdown saves the graph
+func newShutdownNode(t *testing.T) *Node {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	return newTestNode(t, newTestNetwork())
+}
+
+func TestShutdown_RejectsNewPayments(t *testing.T) {
+	n := newShutdownNode(t)
+	route := newTestRoute(t, n, 100000000)
+	hash, err := n.GeneratePreimageHashPair()
+	assert.NoError(t, err)
+	n.Shutdown(time.Second)
+
+	_, err = n.SendPay(route, hash)
+	assert.Equal(t, util.ErrCircularStopped, err)
+
+	err = n.SendPayParts([]*graph.Route{route}, hash)
+	assert.Equal(t, util.ErrCircularStopped, err)
+	assert.Empty(t, n.multiParts)
+
+	assert.FileExists(t, CIRCULAR_DIR+"/"+graph.FILE)
+}
+
+func TestShutdown_WaitsForPaymentsInFlight(t *testing.T) {
+	n := newShutdownNode(t)
+	assert.NoError(t, n.startPayment())
+
+	done := make(chan struct{})
+	go func() {
+		n.Shutdown(5 * time.Second)
+		close(done)
+	}()
+
+	assert.Eventually(t, n.shuttingDown.Load, time.Second, time.Millisecond)
+	// a payment can't start while the shutdown is waiting for the ones in flight
+	assert.Equal(t, util.ErrCircularStopped, n.startPayment())
+	select {
+	case <-done:
+		t.Fatal("shutdown didn't wait for the payment in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	n.inflight.Done()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown didn't complete after the payment was over")
+	}
+}
+
+func TestShutdown_GivesUpAfterTimeout(t *testing.T) {
+	n := newShutdownNode(t)
+	assert.NoError(t, n.startPayment())
+	defer n.inflight.Done()
+
+	start := time.Now()
+	n.Shutdown(100 * time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -5,15 +5,127 @@ import (
 	"circular/util"
 	"github.com/elementsproject/glightning/glightning"
 	"github.com/elementsproject/glightning/jrpc2"
+	"sort"
 	"strconv"
 	"time"
 )
 
+const (
+	STATUS_SUCCESS = "success"
+	STATUS_FAILURE = "failure"
+)
+
+// StatsFilter selects the rebalances that the stats are computed on. Zero values match everything
+type StatsFilter struct {
+	From   int64  `json:"from,omitempty"` // unix timestamp
+	To     int64  `json:"to,omitempty"`   // unix timestamp
+	Peer   string `json:"peer,omitempty"` // matches the first or the last peer of the route
+	Scid   string `json:"scid,omitempty"` // matches the outgoing or the incoming channel
+	Status string `json:"status,omitempty"`
+	MinPPM uint64 `json:"minppm,omitempty"`
+	MaxPPM uint64 `json:"maxppm,omitempty"`
+}
+
+func (f *StatsFilter) validate() error {
+	if f.Status != "" && f.Status != STATUS_SUCCESS && f.Status != STATUS_FAILURE {
+		return util.ErrInvalidStatus
+	}
+	if f.To > 0 && f.From > f.To {
+		return util.ErrInvalidTimeRange
+	}
+	if f.MaxPPM > 0 && f.MinPPM > f.MaxPPM {
+		return util.ErrInvalidPPMRange
+	}
+	return nil
+}
+
+func (f *StatsFilter) match(r *rebalanceRecord) bool {
+	if f.From > 0 && r.timestamp < f.From {
+		return false
+	}
+	if f.To > 0 && r.timestamp > f.To {
+		return false
+	}
+	if f.Peer != "" && r.outPeer != f.Peer && r.inPeer != f.Peer {
+		return false
+	}
+	if f.Scid != "" && r.out != f.Scid && r.in != f.Scid {
+		return false
+	}
+	if f.Status == STATUS_SUCCESS && !r.success || f.Status == STATUS_FAILURE && r.success {
+		return false
+	}
+	// the ppm of a failure is the one of the route it tried
+	if r.ppm() < f.MinPPM || f.MaxPPM > 0 && r.ppm() > f.MaxPPM {
+		return false
+	}
+	return true
+}
+
+// Summary aggregates a set of rebalances
+type Summary struct {
+	Successes   uint64  `json:"successes"`
+	Failures    uint64  `json:"failures"`
+	SuccessRate float64 `json:"success_rate"`
+	Amount      uint64  `json:"amount_sat"` // rebalanced successfully
+	Fee         uint64  `json:"fee_msat"`   // paid for the successful rebalances
+	PPM         uint64  `json:"ppm"`        // average, weighted by amount
+}
+
+func (s *Summary) add(r *rebalanceRecord) {
+	if !r.success {
+		s.Failures++
+		return
+	}
+	s.Successes++
+	s.Amount += r.amount
+	s.Fee += r.fee
+}
+
+func (s *Summary) compute() {
+	if s.Successes+s.Failures > 0 {
+		s.SuccessRate = float64(s.Successes) / float64(s.Successes+s.Failures)
+	}
+	if s.Amount > 0 {
+		s.PPM = s.Fee * 1000 / s.Amount
+	}
+}
+
+// PairStats aggregates the rebalances from one outgoing channel to one incoming channel
+type PairStats struct {
+	OutScid  string `json:"outscid"`
+	InScid   string `json:"inscid"`
+	OutPeer  string `json:"outpeer"`
+	InPeer   string `json:"inpeer"`
+	OutAlias string `json:"outalias"`
+	InAlias  string `json:"inalias"`
+	Summary
+}
+
+// FailureCount is how many failures a node or a channel caused
+type FailureCount struct {
+	Id       string  `json:"id"`
+	Alias    string  `json:"alias,omitempty"`
+	Failures uint64  `json:"failures"`
+	Penalty  float64 `json:"penalty,omitempty"`
+}
+
 type Stats struct {
-	GraphStats *graph.Stats                `json:"graph_stats"`
-	Successes  []glightning.SendPaySuccess `json:"successes"`
-	Failures   []glightning.SendPayFailure `json:"failures"`
-	Routes     []graph.PrettyRoute         `json:"routes"`
+	StatsFilter
+	// Raw adds the successes, failures and routes that match the filter to the result
+	Raw bool `json:"raw,omitempty"`
+}
+
+type StatsResult struct {
+	GraphStats     *graph.Stats                `json:"graph_stats"`
+	Filter         *StatsFilter                `json:"filter"`
+	Total          *Summary                    `json:"total"`
+	Pairs          []*PairStats                `json:"pairs"`
+	ErringNodes    []*FailureCount             `json:"erring_nodes"`
+	ErringChannels []*FailureCount             `json:"erring_channels"`
+	Successes      []glightning.SendPaySuccess `json:"successes,omitempty"`
+	Failures       []glightning.SendPayFailure `json:"failures,omitempty"`
+	Routes         []graph.PrettyRoute         `json:"routes,omitempty"`
 }
 
 func (s *Stats) Name() string {
@@ -25,50 +137,129 @@ func (s *Stats) New() interface{} {
 }
 
 func (s *Stats) Call() (jrpc2.Result, error) {
-	return GetNode().GetStats(), nil
+	if err := s.StatsFilter.validate(); err != nil {
+		return nil, err
+	}
+	return GetNode().GetStats(&s.StatsFilter, s.Raw)
 }
 
-func (n *Node) GetStats() *Stats {
+// GetStats aggregates the rebalances saved in the db that match filter.
+// If raw is true, the matching records are returned too.
+// The peers of a rebalance come from its saved route, so that PeersLock is not held while the db is read
+func (n *Node) GetStats(filter *StatsFilter, raw bool) (*StatsResult, error) {
 	defer util.TimeTrack(time.Now(), "node.GetStats", n.Logf)
-	n.PeersLock.RLock()
-	defer n.PeersLock.RUnlock()
 
-	successes, err := n.DB.ListSuccesses()
+	// only the time window is read from the db, the other filters are applied to the records
+	successes, failures, routes, err := n.loadStats(filter.From, filter.To)
 	if err != nil {
-		n.Logln(glightning.Unusual, err)
+		return nil, err
 	}
 
-	failures, err := n.DB.ListFailures()
-	if err != nil {
-		n.Logln(glightning.Unusual, err)
+	result := &StatsResult{
+		GraphStats: n.Graph.GetStats(),
+		Filter:     filter,
+		Total:      &Summary{},
 	}
+	pairs := make(map[string]*PairStats)
+	erringNodes := make(map[string]uint64)
+	erringChannels := make(map[string]uint64)
+	matched := make(map[string]bool)
 
-	routes, err := n.DB.ListRoutes()
-	if err != nil {
-		n.Logln(glightning.Unusual, err)
+	for _, r := range joinRebalances(successes, failures, routes) {
+		if !filter.match(r) {
+			continue
+		}
+		matched[r.paymentHash] = true
+		result.Total.add(r)
+
+		key := PairKey(r.out, r.in)
+		if _, ok := pairs[key]; !ok {
+			pairs[key] = &PairStats{
+				OutScid:  r.out,
+				InScid:   r.in,
+				OutPeer:  r.outPeer,
+				InPeer:   r.inPeer,
+				OutAlias: n.Graph.GetAlias(r.outPeer),
+				InAlias:  n.Graph.GetAlias(r.inPeer),
+			}
+		}
+		pairs[key].add(r)
+
+		if !r.success {
+			if r.erringNode != "" {
+				erringNodes[r.erringNode]++
+			}
+			if r.erringChannel != "" {
+				erringChannels[r.erringChannel]++
+			}
+		}
 	}
 
-	return &Stats{
-		GraphStats: n.Graph.GetStats(),
-		Successes:  successes,
-		Failures:   failures,
-		Routes:     routes,
+	result.Total.compute()
+	result.Pairs = util.GetMapValues(pairs)
+	for _, p := range result.Pairs {
+		p.compute()
 	}
+	// the pairs that moved the most first
+	sort.Slice(result.Pairs, func(i, j int) bool {
+		if result.Pairs[i].Amount != result.Pairs[j].Amount {
+			return result.Pairs[i].Amount > result.Pairs[j].Amount
+		}
+		return PairKey(result.Pairs[i].OutScid, result.Pairs[i].InScid) < PairKey(result.Pairs[j].OutScid, result.Pairs[j].InScid)
+	})
+	result.ErringNodes = n.failureCounts(erringNodes, true)
+	result.ErringChannels = n.failureCounts(erringChannels, false)
+
+	if raw {
+		result.Successes = make([]glightning.SendPaySuccess, 0)
+		for _, s := range successes {
+			if matched[s.PaymentHash] {
+				result.Successes = append(result.Successes, s)
+			}
+		}
+		result.Failures = make([]glightning.SendPayFailure, 0)
+		for _, f := range failures {
+			if matched[f.Data.PaymentHash] {
+				result.Failures = append(result.Failures, f)
+			}
+		}
+		result.Routes = make([]graph.PrettyRoute, 0)
+		for _, r := range routes {
+			if matched[r.PaymentHash] {
+				result.Routes = append(result.Routes, r)
+			}
+		}
+	}
+	return result, nil
 }
 
-func (s *Stats) String() string {
+// failureCounts sorts the counts, the most failures first
+func (n *Node) failureCounts(counts map[string]uint64, nodes bool) []*FailureCount {
+	result := make([]*FailureCount, 0, len(counts))
+	for id, failures := range counts {
+		count := &FailureCount{Id: id, Failures: failures}
+		if nodes {
+			count.Alias = n.Graph.GetAlias(id)
+			count.Penalty = n.Graph.GetPenalty(id)
+		}
+		result = append(result, count)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Failures != result[j].Failures {
+			return result[i].Failures > result[j].Failures
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func (s *StatsResult) String() string {
 	var result string
 	result += "Node stats:" + "\n"
 	result += s.GraphStats.String() + "\n"
-	result += "successes: " + strconv.Itoa(len(s.Successes)) + "\n"
-	result += "failures: " + strconv.Itoa(len(s.Failures)) + "\n"
-	result += "routes: " + strconv.Itoa(len(s.Routes)) + "\n"
-
-	var totalMoved uint64 = 0
-	for _, success := range s.Successes {
-		totalMoved += success.MilliSatoshi
-	}
-	result += "Total amount of BTC rebalanced: " + strconv.FormatUint(totalMoved/1000, 10) + "sats"
+	result += "successes: " + strconv.FormatUint(s.Total.Successes, 10) + "\n"
+	result += "failures: " + strconv.FormatUint(s.Total.Failures, 10) + "\n"
+	result += "Total amount of BTC rebalanced: " + strconv.FormatUint(s.Total.Amount, 10) + "sats"
 
 	return result
 }
@@ -0,0 +1,142 @@
+package node
+
+import (
+	"circular/graph"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// saveRebalance saves the route and the outcome of a rebalance of amount sats through peers, the first
+// and the last of them being our peers. The route is saved a second before the outcome, like rebalances do
+func saveRebalance(t *testing.T, n *Node, hash string, timestamp int64, success bool, amount, fee uint64, peers []string, scids []string) {
+	hops := make([]graph.PrettyRouteHop, len(scids))
+	hops[0] = graph.PrettyRouteHop{Id: n.Id, ShortChannelId: scids[0]}
+	for i := 1; i < len(scids); i++ {
+		hops[i] = graph.PrettyRouteHop{Id: peers[i-1], ShortChannelId: scids[i]}
+	}
+	route := &graph.PrettyRoute{PaymentHash: hash, Amount: amount, Fee: fee, Hops: hops}
+	if err := n.SaveToDb(StatKey(ROUTE_PREFIX, timestamp-1, hash), route); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if success {
+		err = n.SaveToDb(StatKey(SUCCESS_PREFIX, timestamp, hash), &glightning.SendPaySuccess{
+			PaymentHash: hash,
+			CreatedAt:   float64(timestamp),
+		})
+	} else {
+		err = n.SaveToDb(StatKey(FAILURE_PREFIX, timestamp, hash), &glightning.SendPayFailure{
+			Data: glightning.SendPayFailureData{
+				PaymentHash:   hash,
+				CreatedAt:     uint64(timestamp),
+				ErringNode:    peers[len(peers)-1],
+				ErringChannel: scids[len(scids)-2],
+			},
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNode_GetStats(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+	n.saveStats = true
+
+	now := time.Now().Unix() - 3600
+	saveRebalance(t, n, "h1", now, true, 100000, 10000, []string{"alice", "bob"}, []string{"1x1x1", "3x3x3", "2x2x2"})
+	saveRebalance(t, n, "h2", now+100, false, 50000, 5000, []string{"alice", "bob"}, []string{"1x1x1", "3x3x3", "2x2x2"})
+	saveRebalance(t, n, "h3", now+200, true, 200000, 40000, []string{"carol", "bob"}, []string{"4x4x4", "5x5x5", "2x2x2"})
+	saveRebalance(t, n, "h4", now+300, true, 100000, 30000, []string{"alice", "dave"}, []string{"1x1x1", "7x7x7", "6x6x6"})
+
+	type pair struct {
+		out, in string
+		amount  uint64
+	}
+	tests := []struct {
+		name      string
+		filter    StatsFilter
+		successes uint64
+		failures  uint64
+		amount    uint64
+		ppm       uint64
+		pairs     []pair
+		raw       []string
+	}{
+		{"everything", StatsFilter{}, 3, 1, 400000, 200,
+			[]pair{{"4x4x4", "2x2x2", 200000}, {"1x1x1", "2x2x2", 100000}, {"1x1x1", "6x6x6", 100000}},
+			[]string{"h1", "h2", "h3", "h4"}},
+		// the route of h2 was saved a second before from, it's still found
+		{"a time window", StatsFilter{From: now + 100, To: now + 200}, 1, 1, 200000, 200,
+			[]pair{{"4x4x4", "2x2x2", 200000}, {"1x1x1", "2x2x2", 0}},
+			[]string{"h2", "h3"}},
+		{"from a time", StatsFilter{From: now + 250}, 1, 0, 100000, 300,
+			[]pair{{"1x1x1", "6x6x6", 100000}},
+			[]string{"h4"}},
+		{"up to a time", StatsFilter{To: now + 99}, 1, 0, 100000, 100,
+			[]pair{{"1x1x1", "2x2x2", 100000}},
+			[]string{"h1"}},
+		{"the last peer", StatsFilter{Peer: "bob"}, 2, 1, 300000, 166,
+			[]pair{{"4x4x4", "2x2x2", 200000}, {"1x1x1", "2x2x2", 100000}},
+			[]string{"h1", "h2", "h3"}},
+		{"the first peer", StatsFilter{Peer: "alice"}, 2, 1, 200000, 200,
+			[]pair{{"1x1x1", "2x2x2", 100000}, {"1x1x1", "6x6x6", 100000}},
+			[]string{"h1", "h2", "h4"}},
+		{"a peer and a time window", StatsFilter{Peer: "alice", From: now + 50, To: now + 300}, 1, 1, 100000, 300,
+			[]pair{{"1x1x1", "6x6x6", 100000}, {"1x1x1", "2x2x2", 0}},
+			[]string{"h2", "h4"}},
+		{"nothing matches", StatsFilter{Peer: "erin"}, 0, 0, 0, 0, []pair{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := n.GetStats(&tt.filter, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.successes, result.Total.Successes)
+			assert.Equal(t, tt.failures, result.Total.Failures)
+			assert.Equal(t, tt.amount, result.Total.Amount)
+			assert.Equal(t, tt.ppm, result.Total.PPM)
+
+			pairs := make([]pair, len(result.Pairs))
+			for i, p := range result.Pairs {
+				pairs[i] = pair{p.OutScid, p.InScid, p.Amount}
+			}
+			assert.Equal(t, tt.pairs, pairs)
+
+			hashes := make([]string, len(result.Routes))
+			for i, r := range result.Routes {
+				hashes[i] = r.PaymentHash
+			}
+			assert.Equal(t, tt.raw, hashes)
+			assert.Equal(t, int(tt.successes), len(result.Successes))
+			assert.Equal(t, int(tt.failures), len(result.Failures))
+		})
+	}
+}
+
+func TestNode_GetStatsDoesntWaitForPeers(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+	n.saveStats = true
+	saveRebalance(t, n, "h1", time.Now().Unix(), true, 100000, 10000, []string{"alice", "bob"}, []string{"1x1x1", "3x3x3", "2x2x2"})
+
+	// a peer refresh is holding the lock
+	n.PeersLock.Lock()
+	defer n.PeersLock.Unlock()
+
+	done := make(chan *StatsResult)
+	go func() {
+		result, err := n.GetStats(&StatsFilter{Peer: "alice"}, false)
+		assert.NoError(t, err)
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		assert.Equal(t, uint64(1), result.Total.Successes)
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetStats is waiting for the peers lock")
+	}
+}
@@ -0,0 +1,190 @@
+package node
+
+import (
+	"circular/util"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/elementsproject/glightning/glightning"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_STATS_RETENTION = 14 // days
+	TIMESTAMP_LENGTH        = 10 // digits of a unix timestamp, until year 2286
+	// routes are saved right before the payment is sent, its outcome is timestamped right after
+	ROUTE_TIMESTAMP_SLACK = 60 // seconds
+)
+
+var statsPrefixes = []string{SUCCESS_PREFIX, FAILURE_PREFIX, ROUTE_PREFIX}
+
+// StatKey is the key of a success, a failure or a route: the prefix, then the timestamp, then the payment hash.
+// Keys sort by time within a prefix, so that a time window can be read without scanning the whole prefix
+func StatKey(prefix string, timestamp int64, paymentHash string) string {
+	return fmt.Sprintf("%s%0*d_%s", prefix, TIMESTAMP_LENGTH, timestamp, paymentHash)
+}
+
+func statKeyTimestamp(prefix string, key []byte) (int64, bool) {
+	if len(key) < len(prefix)+TIMESTAMP_LENGTH+1 || key[len(prefix)+TIMESTAMP_LENGTH] != '_' {
+		return 0, false
+	}
+	timestamp, err := strconv.ParseInt(string(key[len(prefix):len(prefix)+TIMESTAMP_LENGTH]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return timestamp, true
+}
+
+// listStats calls f on the value of every key of prefix saved between from and to, oldest first
+func (s *Store) listStats(prefix string, from, to int64, f func(v []byte) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte(StatKey(prefix, from, ""))); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			item := it.Item()
+			if timestamp, ok := statKeyTimestamp(prefix, item.Key()); ok && to > 0 && timestamp > to {
+				break
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err = f(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateStats moves the stats saved as prefix+paymentHash to time-indexed keys. Old keys don't
+// tell when they were saved, but they all expired 14 days after that, which gives their timestamp.
+// Their expiry follows the retention: the ones older than it are dropped.
+// It returns how many stats were moved and how many were dropped
+func (s *Store) MigrateStats(retention time.Duration) (int, int, error) {
+	type oldStat struct {
+		key, newKey []byte
+		value       []byte
+		timestamp   int64
+	}
+	stats := make([]*oldStat, 0)
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, prefix := range statsPrefixes {
+			for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+				item := it.Item()
+				if _, ok := statKeyTimestamp(prefix, item.Key()); ok {
+					continue
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				key := item.KeyCopy(nil)
+				timestamp := time.Now().Unix()
+				if item.ExpiresAt() > 0 {
+					timestamp = int64(item.ExpiresAt()) - int64(FOURTEEN_DAYS.Seconds())
+				}
+				stats = append(stats, &oldStat{
+					key:       key,
+					newKey:    []byte(StatKey(prefix, timestamp, string(key[len(prefix):]))),
+					value:     value,
+					timestamp: timestamp,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil || len(stats) == 0 {
+		return 0, 0, err
+	}
+
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+	now := time.Now()
+	migrated, dropped := 0, 0
+	for _, stat := range stats {
+		if err = batch.Delete(stat.key); err != nil {
+			return 0, 0, err
+		}
+		entry := badger.NewEntry(stat.newKey, stat.value)
+		if retention > 0 {
+			ttl := time.Unix(stat.timestamp, 0).Add(retention).Sub(now)
+			if ttl <= 0 {
+				dropped++
+				continue
+			}
+			entry = entry.WithTTL(ttl)
+		}
+		if err = batch.SetEntry(entry); err != nil {
+			return 0, 0, err
+		}
+		migrated++
+	}
+	if err = batch.Flush(); err != nil {
+		return 0, 0, err
+	}
+	return migrated, dropped, nil
+}
+
+// PruneStats deletes the stats saved before threshold. Keys expire on their own, but
+// the ones saved with a longer retention than the current one would stay until then
+func (s *Store) PruneStats(threshold int64) (int, error) {
+	keys := make([][]byte, 0)
+	err := s.db.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		it := txn.NewIterator(options)
+		defer it.Close()
+		for _, prefix := range statsPrefixes {
+			for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+				timestamp, ok := statKeyTimestamp(prefix, it.Item().Key())
+				if !ok || timestamp >= threshold {
+					break
+				}
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, key := range keys {
+		if err = batch.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	if err = batch.Flush(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// setupStats migrates the stats to the current key layout and applies the retention
+func (n *Node) setupStats() {
+	defer util.TimeTrack(time.Now(), "node.setupStats", n.Logf)
+
+	migrated, dropped, err := n.DB.MigrateStats(n.statsRetention)
+	if err != nil {
+		n.Logln(glightning.Unusual, "unable to migrate stats: ", err)
+		return
+	}
+	if migrated > 0 || dropped > 0 {
+		n.Logf(glightning.Info, "migrated %d stats to time-indexed keys, dropped %d older than the retention", migrated, dropped)
+	}
+
+	if n.statsRetention == 0 {
+		return
+	}
+	pruned, err := n.DB.PruneStats(time.Now().Add(-n.statsRetention).Unix())
+	if err != nil {
+		n.Logln(glightning.Unusual, "unable to prune stats: ", err)
+		return
+	}
+	n.Logf(glightning.Debug, "pruned %d stats older than %d days", pruned, int(n.statsRetention.Hours()/24))
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"circular/graph"
+	"encoding/json"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// setLegacyStat saves value under prefix+paymentHash, as stats were saved before they were indexed by time:
+// with a ttl of 14 days, minus the age of the stat
+func setLegacyStat(t *testing.T, s *Store, prefix, paymentHash string, age time.Duration, value any) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetWithTTL(prefix+paymentHash, b, FOURTEEN_DAYS-age); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expiresAt returns when the first key of prefix expires
+func expiresAt(t *testing.T, s *Store, prefix string) int64 {
+	var result int64
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		it.Seek([]byte(prefix))
+		if !it.ValidForPrefix([]byte(prefix)) {
+			return badger.ErrKeyNotFound
+		}
+		result = int64(it.Item().ExpiresAt())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestStore_MigrateStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention time.Duration
+		migrated  int
+		dropped   int
+		routes    []string
+	}{
+		{"stats older than the retention are dropped", 7 * day, 3, 1, []string{"a"}},
+		{"without retention, every stat is kept", 0, 4, 0, []string{"b", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewDB(t.TempDir())
+			defer s.Close()
+
+			now := time.Now().Unix()
+			setLegacyStat(t, s, SUCCESS_PREFIX, "a", 0, &glightning.SendPaySuccess{PaymentHash: "a"})
+			setLegacyStat(t, s, ROUTE_PREFIX, "a", 0, &graph.PrettyRoute{PaymentHash: "a"})
+			setLegacyStat(t, s, FAILURE_PREFIX, "b", 3*day, &glightning.SendPayFailure{Data: glightning.SendPayFailureData{PaymentHash: "b"}})
+			setLegacyStat(t, s, ROUTE_PREFIX, "b", 10*day, &graph.PrettyRoute{PaymentHash: "b"})
+			// a stat that is already indexed by time is left alone
+			value, _ := json.Marshal(&glightning.SendPaySuccess{PaymentHash: "c"})
+			if err := s.SetWithTTL(StatKey(SUCCESS_PREFIX, now-3600, "c"), value, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			migrated, dropped, err := s.MigrateStats(tt.retention)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.migrated, migrated)
+			assert.Equal(t, tt.dropped, dropped)
+
+			// the old keys are gone
+			for _, key := range []string{SUCCESS_PREFIX + "a", ROUTE_PREFIX + "a", FAILURE_PREFIX + "b", ROUTE_PREFIX + "b"} {
+				_, err = s.Get(key)
+				assert.Error(t, err, key)
+			}
+
+			// the new ones are found by time, at the time they were saved
+			successes, err := s.ListSuccesses(now-2*3600, 0)
+			assert.NoError(t, err)
+			if assert.Len(t, successes, 2) {
+				assert.Equal(t, "c", successes[0].PaymentHash)
+				assert.Equal(t, "a", successes[1].PaymentHash)
+			}
+			failures, err := s.ListFailures(now-int64((4*day).Seconds()), now-int64((2*day).Seconds()))
+			assert.NoError(t, err)
+			if assert.Len(t, failures, 1) {
+				assert.Equal(t, "b", failures[0].Data.PaymentHash)
+			}
+			routes, err := s.ListRoutes(0, 0)
+			assert.NoError(t, err)
+			hashes := make([]string, len(routes))
+			for i, r := range routes {
+				hashes[i] = r.PaymentHash
+			}
+			assert.Equal(t, tt.routes, hashes)
+
+			// and they expire according to the retention instead of the 14 days
+			expiry := expiresAt(t, s, FAILURE_PREFIX)
+			if tt.retention == 0 {
+				assert.Zero(t, expiry)
+			} else {
+				assert.InDelta(t, now+int64((4*day).Seconds()), expiry, 5)
+			}
+
+			// there's nothing left to migrate
+			migrated, dropped, err = s.MigrateStats(tt.retention)
+			assert.NoError(t, err)
+			assert.Zero(t, migrated)
+			assert.Zero(t, dropped)
+		})
+	}
+}
@@ -9,13 +9,20 @@ import (
 )
 
 type RebalanceByNode struct {
-	OutNode  string     `json:"outnode"`
-	InNode   string     `json:"innode"`
-	Amount   uint64     `json:"amount,omitempty"`
-	MaxPPM   uint64     `json:"maxppm,omitempty"`
-	Attempts int        `json:"attempts,omitempty"`
-	MaxHops  int        `json:"maxhops,omitempty"`
-	Node     *node.Node `json:"-"`
+	OutNode         string     `json:"outnode"`
+	InNode          string     `json:"innode"`
+	Amount          uint64     `json:"amount,omitempty"`
+	MaxPPM          uint64     `json:"maxppm,omitempty"`
+	Attempts        int        `json:"attempts,omitempty"`
+	MaxHops         int        `json:"maxhops,omitempty"`
+	MaxDelay        int        `json:"maxdelay,omitempty"`
+	ExcludeNodes    []string   `json:"excludenodes,omitempty"`
+	ExcludeChannels []string   `json:"excludechannels,omitempty"`
+	ViaNodes        []string   `json:"vianodes,omitempty"`
+	Parts           int        `json:"parts,omitempty"`
+	Async           bool       `json:"async,omitempty"`
+	DryRun          bool       `json:"dryrun,omitempty"`
+	Node            *node.Node `json:"-"`
 }
 
 func (r *RebalanceByNode) Name() string {
@@ -61,14 +68,23 @@ func (r *RebalanceByNode) Call() (jrpc2.Result, error) {
 		return nil, err
 	}
 
-	rebalance := NewRebalance(outgoingChannel, incomingChannel, r.Amount, r.MaxPPM, r.Attempts, r.MaxHops)
+	rebalance := NewRebalance(outgoingChannel, incomingChannel, r.Amount, r.MaxPPM, r.Attempts, r.MaxHops, r.MaxDelay)
+	rebalance.Parts = r.Parts
+	rebalance.Filter, err = graph.NewFilter(r.ExcludeNodes, r.ExcludeChannels, r.ViaNodes)
+	if err != nil {
+		return nil, err
+	}
 
 	err = rebalance.Setup()
 	if err != nil {
 		return nil, err
 	}
 
-	return rebalance.Run(), nil
+	if r.DryRun {
+		return rebalance.Preview(), nil
+	}
+
+	return rebalance.Start(r.Name(), r, r.Async), nil
 }
 
 func (r *RebalanceByNode) validatePeers() error {
@@ -1,19 +1,28 @@
 package rebalance
 
 import (
+	"circular/graph"
 	"circular/node"
 	"circular/util"
 	"github.com/elementsproject/glightning/jrpc2"
 )
 
 type RebalanceByScid struct {
-	OutScid  string     `json:"outscid"`
-	InScid   string     `json:"inscid"`
-	Amount   uint64     `json:"amount,omitempty"`
-	MaxPPM   uint64     `json:"maxppm,omitempty"`
-	Attempts int        `json:"attempts,omitempty"`
-	MaxHops  int        `json:"maxhops,omitempty"`
-	Node     *node.Node `json:"-"`
+	OutScid         string     `json:"outscid"`
+	InScid          string     `json:"inscid"`
+	Amount          uint64     `json:"amount,omitempty"`
+	MaxPPM          uint64     `json:"maxppm,omitempty"`
+	Attempts        int        `json:"attempts,omitempty"`
+	MaxHops         int        `json:"maxhops,omitempty"`
+	MaxDelay        int        `json:"maxdelay,omitempty"`
+	ExcludeNodes    []string   `json:"excludenodes,omitempty"`
+	ExcludeChannels []string   `json:"excludechannels,omitempty"`
+	ViaNodes        []string   `json:"vianodes,omitempty"`
+	Parts           int        `json:"parts,omitempty"`
+	TargetRatio     uint64     `json:"targetratio,omitempty"`
+	Async           bool       `json:"async,omitempty"`
+	DryRun          bool       `json:"dryrun,omitempty"`
+	Node            *node.Node `json:"-"`
 }
 
 func (r *RebalanceByScid) Name() string {
@@ -40,12 +49,35 @@ func (r *RebalanceByScid) Call() (jrpc2.Result, error) {
 		return nil, err
 	}
 
-	rebalance := NewRebalance(outgoingChannel, incomingChannel, r.Amount, r.MaxPPM, r.Attempts, r.MaxHops)
+	// the target ratio is the local balance that the incoming channel should reach
+	if r.TargetRatio > 0 {
+		needed, err := AmountToTargetRatio(r.Node, incomingChannel, r.TargetRatio)
+		if err != nil {
+			return nil, err
+		}
+		if r.Amount == 0 || needed/1000 < r.Amount {
+			r.Amount = needed / 1000
+		}
+		if r.Amount == 0 {
+			return nil, util.ErrTargetReached
+		}
+	}
+
+	rebalance := NewRebalance(outgoingChannel, incomingChannel, r.Amount, r.MaxPPM, r.Attempts, r.MaxHops, r.MaxDelay)
+	rebalance.Parts = r.Parts
+	rebalance.Filter, err = graph.NewFilter(r.ExcludeNodes, r.ExcludeChannels, r.ViaNodes)
+	if err != nil {
+		return nil, err
+	}
 
 	err = rebalance.Setup()
 	if err != nil {
 		return nil, err
 	}
 
-	return rebalance.Run(), nil
+	if r.DryRun {
+		return rebalance.Preview(), nil
+	}
+
+	return rebalance.Start(r.Name(), r, r.Async), nil
 }
@@ -2,9 +2,12 @@ package parallel
 
 import (
 	"circular/graph"
+	"circular/node"
 	"circular/util"
 	"github.com/elementsproject/glightning/glightning"
 	"github.com/gammazero/deque"
+	"sort"
+	"time"
 )
 
 func (r *AbstractRebalance) FindCandidates(exclude string) error {
@@ -14,7 +17,7 @@ func (r *AbstractRebalance) FindCandidates(exclude string) error {
 	r.Node.Logln(glightning.Debug, "Looking for candidates")
 	peers := r.GetCandidatesList()
 
-	r.Candidates = deque.New[*graph.Channel]()
+	candidates := make([]*graph.Channel, 0)
 	for _, p := range peers {
 		if p.Id == exclude {
 			continue
@@ -31,10 +34,15 @@ func (r *AbstractRebalance) FindCandidates(exclude string) error {
 				}
 
 				r.Node.Logln(glightning.Debug, "adding candidate to candidates:", candidate.ShortChannelId)
-				r.Candidates.PushBack(candidate)
+				candidates = append(candidates, candidate)
 			}
 		}
 	}
+
+	r.Candidates = deque.New[*graph.Channel]()
+	for _, candidate := range r.rankCandidates(candidates) {
+		r.Candidates.PushBack(candidate)
+	}
 	if r.Candidates.Len() == 0 {
 		return util.ErrNoCandidates
 	}
@@ -43,6 +51,36 @@ func (r *AbstractRebalance) FindCandidates(exclude string) error {
 	return nil
 }
 
+// rankCandidates sorts the candidates by how cheap and reliable they have been in past rebalances,
+// and leaves out the ones that kept failing recently
+func (r *AbstractRebalance) rankCandidates(candidates []*graph.Channel) []*graph.Channel {
+	out, in := r.Node.GetChannelHistory()
+	now := time.Now()
+	cost := make(map[*graph.Channel]float64, len(candidates))
+	result := make([]*graph.Channel, 0, len(candidates))
+	for _, candidate := range candidates {
+		history := in[candidate.ShortChannelId]
+		if candidate.Source == r.Node.Id {
+			history = out[candidate.ShortChannelId]
+		}
+		if history == nil {
+			history = &node.History{}
+		}
+		if history.CoolingDown(now) {
+			r.Node.Logln(glightning.Debug, "candidate on cooldown after ", history.ConsecutiveFailures, " failures:", candidate.ShortChannelId)
+			continue
+		}
+		// we don't know what a candidate that never succeeded will cost, assume the worst
+		cost[candidate] = history.Cost(r.maxPPM)
+		result = append(result, candidate)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return cost[result[i]] < cost[result[j]]
+	})
+	return result
+}
+
 func (r *AbstractRebalance) GetCandidatesList() []*glightning.Peer {
 	if r.CandidatesList == nil {
 		// if no CandidatesList was supplied, consider all peers as potential candidates
@@ -92,28 +130,37 @@ func (r *AbstractRebalance) GetNextCandidate() (*graph.Channel, error) {
 }
 
 func (r *AbstractRebalance) FireCandidates() {
+	// the job is checked before AmountLock is taken: the job reports its progress under AmountLock
+	if r.Job.IsCancelled() {
+		r.Node.Logln(glightning.Debug, "job has been cancelled, not firing new candidates")
+		return
+	}
+
 	r.AmountLock.Lock()
 	defer r.AmountLock.Unlock()
 
-	carryOn := r.AmountRebalanced+r.InFlightAmount < r.amount
-	splitsInFlight := int(r.InFlightAmount / r.splitAmount)
-
 	r.Node.Logln(glightning.Debug, "Firing candidates")
 	r.Node.Logln(glightning.Debug, "AmountRebalanced: ", r.AmountRebalanced, ", InFlightAmount: ", r.InFlightAmount, ", Total amount:", r.amount)
-	r.Node.Logln(glightning.Debug, "Carry on: ", carryOn, ", splits in flight: ", splitsInFlight)
-	for carryOn && splitsInFlight < r.splits {
+	r.Node.Logln(glightning.Debug, "Splits in flight: ", r.splitsInFlight)
+	for r.splitsInFlight < r.splits {
+		limit := r.splitLimit()
+		if limit == 0 {
+			r.Node.Logln(glightning.Debug, "amount or target ratio reached, not firing new candidates")
+			break
+		}
 		candidate, err := r.GetNextCandidate()
 		if err != nil {
 			// no candidate left
 			r.Node.Logln(glightning.Debug, err)
 			break
 		}
-		r.Fire(candidate)
+		amount := util.Min(r.getSplitAmount(candidate.ShortChannelId), limit)
+		r.Fire(candidate, amount)
+		r.candidatesTried[candidate.ShortChannelId] = true
 
-		r.InFlightAmount += r.splitAmount
-		carryOn = r.AmountRebalanced+r.InFlightAmount < r.amount
-		splitsInFlight = int(r.InFlightAmount / r.splitAmount)
+		r.InFlightAmount += amount
+		r.splitsInFlight++
 
-		r.Node.Logln(glightning.Debug, "Carry on: ", carryOn, ", splits in flight: ", splitsInFlight)
+		r.Node.Logln(glightning.Debug, "Splits in flight: ", r.splitsInFlight)
 	}
 }
@@ -0,0 +1,94 @@
+package parallel
+
+import (
+	"circular/graph"
+	"circular/node"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newRoute returns a route of amount msat from outScid to inScid
+func newRoute(t *testing.T, n *node.Node, outScid, inScid string, amount uint64) *graph.Route {
+	out, err := n.GetOutgoingChannelFromScid(outScid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := n.GetIncomingChannelFromScid(inScid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := n.Graph.GetRoute(out.Destination, in.Source, amount, nil, 5, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.Prepend(out)
+	route.Append(in, n.FinalDelay)
+	return route
+}
+
+// sendThrough sends times payments through route. The route is not looked up again, so payments
+// keep failing where the network can't forward them
+func sendThrough(t *testing.T, n *node.Node, route *graph.Route, times int) {
+	for i := 0; i < times; i++ {
+		hash, err := n.GeneratePreimageHashPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.SendPay(route, hash)
+	}
+}
+
+func TestAbstractRebalance_RankCandidates(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+	r := &AbstractRebalance{Node: n, maxPPM: 500}
+
+	candidates := make([]*graph.Channel, 0)
+	for _, scid := range []string{"6x6x6", "4x4x4", "1x1x1"} {
+		channel, err := n.GetOutgoingChannelFromScid(scid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates = append(candidates, channel)
+	}
+	ids := func(channels []*graph.Channel) []string {
+		result := make([]string, len(channels))
+		for i, c := range channels {
+			result[i] = c.ShortChannelId
+		}
+		return result
+	}
+
+	// without history, the order is kept
+	assert.Equal(t, []string{"6x6x6", "4x4x4", "1x1x1"}, ids(r.rankCandidates(candidates)))
+
+	// alice costs about 110 ppm, dave about 120 ppm and carol failed
+	sendThrough(t, n, newRoute(t, n, "1x1x1", "2x2x2", 50000000), 1)
+	sendThrough(t, n, newRoute(t, n, "6x6x6", "2x2x2", 50000000), 1)
+	carol := newRoute(t, n, "4x4x4", "2x2x2", 50000000)
+	network.SetActive("5x5x5", false)
+	sendThrough(t, n, carol, 1)
+	assert.Eventually(t, func() bool {
+		out, _ := n.GetChannelHistory()
+		return out["4x4x4"] != nil && out["4x4x4"].Failures == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1x1x1", "6x6x6", "4x4x4"}, ids(r.rankCandidates(candidates)))
+
+	// after two more failures in a row, carol is on cooldown
+	sendThrough(t, n, carol, 2)
+	assert.Eventually(t, func() bool {
+		out, _ := n.GetChannelHistory()
+		return out["4x4x4"].ConsecutiveFailures == node.COOLDOWN_FAILURES
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1x1x1", "6x6x6"}, ids(r.rankCandidates(candidates)))
+
+	// the history is recorded even if stats are not saved
+	_, in := n.GetChannelHistory()
+	assert.Equal(t, uint64(2), in["2x2x2"].Successes)
+	assert.Equal(t, uint64(3), in["2x2x2"].Failures)
+	assert.Equal(t, uint64(100000), in["2x2x2"].Amount)
+	stats, err := n.DB.ListSuccesses(0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, stats)
+}
@@ -0,0 +1,386 @@
+package parallel
+
+import (
+	"circular/graph"
+	"circular/node"
+	rebalance2 "circular/rebalance"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+	"sort"
+	"sync"
+)
+
+const (
+	DEFAULT_FLOW_TARGET = 50 // percent
+)
+
+// FlowChannel is a channel taking part in a flow. Amount is how many sats it should send (sources)
+// or receive (sinks). If Amount is not given, the channel moves liquidity until its local balance
+// reaches Target percent of its capacity
+type FlowChannel struct {
+	Scid   string `json:"scid"`
+	Amount uint64 `json:"amount,omitempty"`
+	Target uint64 `json:"target,omitempty"`
+}
+
+// flowChannel keeps track of how much a source or a sink still has to move, in msat
+type flowChannel struct {
+	channel   *graph.Channel
+	remaining uint64
+	inFlight  uint64
+}
+
+func (c *flowChannel) available() uint64 {
+	if c.inFlight > c.remaining {
+		return 0
+	}
+	return c.remaining - c.inFlight
+}
+
+// RebalanceFlow moves liquidity from many sources to many sinks. Sinks are the candidates of the
+// parallel rebalance: every time one of them is fired, it is paired with the source that looks cheapest
+// and most reliable for it. All the pairs share the same total amount and fee budget
+type RebalanceFlow struct {
+	Sources           []FlowChannel `json:"sources"`
+	Sinks             []FlowChannel `json:"sinks"`
+	Amount            uint64        `json:"amount,omitempty"`
+	MaxPPM            uint64        `json:"maxppm,omitempty"`
+	MaxFee            uint64        `json:"maxfee,omitempty"`
+	Splits            int           `json:"splits,omitempty"`
+	SplitAmount       uint64        `json:"splitamount,omitempty"`
+	Attempts          int           `json:"attempts,omitempty"`
+	MaxHops           int           `json:"maxhops,omitempty"`
+	MaxDelay          int           `json:"maxdelay,omitempty"`
+	ExcludeNodes      []string      `json:"excludenodes,omitempty"`
+	ExcludeChannels   []string      `json:"excludechannels,omitempty"`
+	ViaNodes          []string      `json:"vianodes,omitempty"`
+	Async             bool          `json:"async,omitempty"`
+	DryRun            bool          `json:"dryrun,omitempty"`
+	AbstractRebalance `json:"-"`
+	sources           []*flowChannel
+	sinks             map[string]*flowChannel
+	history           map[string]*node.History
+	maxFee            uint64
+	feeSpent          uint64
+	feeReserved       uint64
+	flowLock          *sync.Mutex
+}
+
+func (r *RebalanceFlow) Name() string {
+	return "circular-flow"
+}
+
+func (r *RebalanceFlow) New() interface{} {
+	return &RebalanceFlow{}
+}
+
+func (r *RebalanceFlow) Call() (jrpc2.Result, error) {
+	r.AbstractRebalance.RebalanceMethods = r
+	if len(r.Sources) == 0 || len(r.Sinks) == 0 {
+		return nil, util.ErrNoRequiredParameter
+	}
+	r.Init(r.Amount, r.MaxPPM, r.SplitAmount, r.Splits, r.Attempts, r.MaxHops, r.MaxDelay)
+	if err := r.setFilter(r.ExcludeNodes, r.ExcludeChannels, r.ViaNodes); err != nil {
+		return nil, err
+	}
+	r.flowLock = &sync.Mutex{}
+
+	if err := r.setupChannels(); err != nil {
+		return nil, err
+	}
+	if err := r.validateParameters(); err != nil {
+		return nil, err
+	}
+	r.Node.Logf(glightning.Debug, "RebalanceFlow parameters validated: %+v", r)
+
+	r.history = r.Node.GetPairHistory()
+
+	// the sinks are the candidates, the cheapest and most reliable first
+	peers := make(map[string]bool)
+	for _, sink := range r.sinks {
+		peers[sink.channel.Source] = true
+	}
+	r.CandidatesList = util.GetMapKeys(peers)
+	if err := r.FindCandidates(""); err != nil {
+		return nil, err
+	}
+	r.sortCandidates()
+
+	if r.DryRun {
+		return r.Preview(), nil
+	}
+
+	return r.Start(r.Name(), r.Async)
+}
+
+// setupChannels computes how much every source and sink has to move
+func (r *RebalanceFlow) setupChannels() error {
+	r.sources = make([]*flowChannel, 0, len(r.Sources))
+	r.sinks = make(map[string]*flowChannel, len(r.Sinks))
+	var sourcesTotal, sinksTotal uint64
+
+	for _, source := range r.Sources {
+		channel, err := r.Node.GetOutgoingChannelFromScid(source.Scid)
+		if err != nil {
+			return err
+		}
+		remaining, err := r.flowAmount(channel, source)
+		if err != nil {
+			return err
+		}
+		r.sources = append(r.sources, &flowChannel{channel: channel, remaining: remaining})
+		sourcesTotal += remaining
+	}
+
+	for _, sink := range r.Sinks {
+		for _, source := range r.sources {
+			if source.channel.ShortChannelId == sink.Scid {
+				return util.ErrChannelInSourcesAndSinks
+			}
+		}
+		channel, err := r.Node.GetIncomingChannelFromScid(sink.Scid)
+		if err != nil {
+			return err
+		}
+		remaining, err := r.flowAmount(channel, sink)
+		if err != nil {
+			return err
+		}
+		r.sinks[sink.Scid] = &flowChannel{channel: channel, remaining: remaining}
+		sinksTotal += remaining
+	}
+
+	// we can't move more than what the sources can give and the sinks can take
+	total := util.Min(sourcesTotal, sinksTotal)
+	if r.Amount == 0 || total < r.amount {
+		r.amount = total
+	}
+	r.amount -= r.amount % r.splitAmount
+
+	r.maxFee = r.MaxFee * 1000
+	if r.maxFee == 0 {
+		r.maxFee = r.amount * r.maxPPM / 1000000
+	}
+	return nil
+}
+
+// flowAmount returns how many msat the channel has to send if it is a source, or receive if it is a sink
+func (r *RebalanceFlow) flowAmount(channel *graph.Channel, c FlowChannel) (uint64, error) {
+	if c.Amount > 0 {
+		return c.Amount * 1000, nil
+	}
+	if c.Target == 0 {
+		c.Target = DEFAULT_FLOW_TARGET
+	}
+	return rebalance2.AmountToTargetRatio(r.Node, channel, c.Target)
+}
+
+func (r *RebalanceFlow) validateParameters() error {
+	if err := r.validateGenericParameters(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// pairCost estimates how expensive it is to move liquidity from source to sink. Pairs that never
+// succeeded are priced at the fee of the sink, which is the only part of the route we know in advance
+func (r *RebalanceFlow) pairCost(source, sink *graph.Channel) float64 {
+	h, ok := r.history[node.PairKey(source.ShortChannelId, sink.ShortChannelId)]
+	if !ok {
+		h = &node.History{}
+	}
+	return h.Cost(sink.ComputeFeePPM(r.splitAmount))
+}
+
+// bestSource returns the source that should be paired with sink, or nil if no source can send amount.
+// It assumes that the flow lock is held
+func (r *RebalanceFlow) bestSource(sink *graph.Channel, amount uint64) *flowChannel {
+	var (
+		best     *flowChannel
+		bestCost float64
+	)
+	for _, source := range r.sources {
+		if source.available() < amount || source.channel.Destination == sink.Source {
+			continue
+		}
+		peerChannel, err := r.Node.GetPeerChannelFromGraphChannel(source.channel)
+		if err != nil || peerChannel.State != rebalance2.NORMAL || peerChannel.ToUsMsat.MSat() < amount {
+			continue
+		}
+		if !r.Node.IsPeerConnected(peerChannel) {
+			continue
+		}
+		cost := r.pairCost(source.channel, sink)
+		if best == nil || cost < bestCost {
+			best = source
+			bestCost = cost
+		}
+	}
+	return best
+}
+
+// availablePPM returns the maxppm that a split of amount can pay without exceeding the fee budget.
+// It assumes that the flow lock is held
+func (r *RebalanceFlow) availablePPM(amount uint64) uint64 {
+	if r.feeSpent+r.feeReserved >= r.maxFee {
+		return 0
+	}
+	return util.Min(r.maxPPM, (r.maxFee-r.feeSpent-r.feeReserved)*1000000/amount)
+}
+
+// sortCandidates puts the sinks with the cheapest pairs in front of the queue
+func (r *RebalanceFlow) sortCandidates() {
+	r.QueueLock.Lock()
+	defer r.QueueLock.Unlock()
+
+	cost := make(map[string]float64, r.Candidates.Len())
+	candidates := make([]*graph.Channel, 0, r.Candidates.Len())
+	for r.Candidates.Len() > 0 {
+		sink := r.Candidates.PopFront()
+		cost[sink.ShortChannelId] = -1
+		for _, source := range r.sources {
+			c := r.pairCost(source.channel, sink)
+			if cost[sink.ShortChannelId] < 0 || c < cost[sink.ShortChannelId] {
+				cost[sink.ShortChannelId] = c
+			}
+		}
+		candidates = append(candidates, sink)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return cost[candidates[i].ShortChannelId] < cost[candidates[j].ShortChannelId]
+	})
+	for _, sink := range candidates {
+		r.Candidates.PushBack(sink)
+	}
+}
+
+func (r *RebalanceFlow) IsGoodCandidate(peerChannel *glightning.PeerChannel) bool {
+	_, ok := r.sinks[peerChannel.ShortChannelId]
+	return ok
+}
+
+// CanUseChannel checks that the sink still needs liquidity and that its peer can send it
+func (r *RebalanceFlow) CanUseChannel(channel *glightning.PeerChannel) error {
+	r.flowLock.Lock()
+	available := r.sinks[channel.ShortChannelId].available()
+	r.flowLock.Unlock()
+	if available < r.splitAmount {
+		return util.ErrChannelFilled
+	}
+	if channel.TotalMsat.MSat()-channel.ToUsMsat.MSat() < r.splitAmount {
+		return util.ErrIncomingChannelDepleted
+	}
+
+	if channel.State != rebalance2.NORMAL {
+		return util.ErrChannelNotInNormalState
+	}
+
+	if r.Node.IsPeerConnected(channel) == false {
+		return util.ErrIncomingPeerDisconnected
+	}
+
+	return nil
+}
+
+// NewRebalance returns the rebalance of one split into candidate from its best source.
+// It fails if no source can send the split right now
+func (r *RebalanceFlow) NewRebalance(candidate *graph.Channel, amount uint64) (*rebalance2.Rebalance, error) {
+	r.flowLock.Lock()
+	defer r.flowLock.Unlock()
+
+	source := r.bestSource(candidate, amount)
+	if source == nil {
+		return nil, util.ErrNoSource
+	}
+	return r.newRebalance(source.channel, candidate, amount, r.availablePPM(amount)), nil
+}
+
+func (r *RebalanceFlow) Fire(candidate *graph.Channel, amount uint64) {
+	r.flowLock.Lock()
+	sink := r.sinks[candidate.ShortChannelId]
+	source := r.bestSource(candidate, amount)
+	maxPPM := r.availablePPM(amount)
+	if source == nil || maxPPM == 0 {
+		r.flowLock.Unlock()
+		// the sink is not fired, the result of the flow tells why
+		result := rebalance2.NewResult("skipped", amount/1000, "", candidate.Source)
+		result.InScid = candidate.ShortChannelId
+		if source == nil {
+			result.Message = candidate.ShortChannelId + ": " + util.ErrNoSource.Error()
+		} else {
+			result.Message = candidate.ShortChannelId + ": fee budget exhausted"
+		}
+		go func() {
+			r.RebalanceResultChan <- result
+		}()
+		return
+	}
+
+	// reserve the amount and the worst case fee, so that splits in flight can't overshoot
+	fee := amount * maxPPM / 1000000
+	source.inFlight += amount
+	sink.inFlight += amount
+	r.feeReserved += fee
+	r.flowLock.Unlock()
+
+	r.Node.Logln(glightning.Debug, "Firing pair: ", source.channel.ShortChannelId, " -> ", candidate.ShortChannelId, " for attempts: ", r.attempts)
+	rebalance := r.newRebalance(source.channel, candidate, amount, maxPPM)
+	rebalance.Job = r.Job
+
+	go func() {
+		result := rebalance.Run()
+		r.settle(source, sink, amount, fee, result)
+		r.RebalanceResultChan <- result
+	}()
+}
+
+// settle releases the amount and the fee that a split reserved and learns from its outcome
+func (r *RebalanceFlow) settle(source, sink *flowChannel, amount, fee uint64, result *rebalance2.Result) {
+	r.flowLock.Lock()
+	defer r.flowLock.Unlock()
+
+	source.inFlight -= amount
+	sink.inFlight -= amount
+	r.feeReserved -= fee
+
+	key := node.PairKey(source.channel.ShortChannelId, sink.channel.ShortChannelId)
+	if _, ok := r.history[key]; !ok {
+		r.history[key] = &node.History{}
+	}
+	if result.Status != "success" {
+		r.history[key].Failures++
+		r.history[key].ConsecutiveFailures++
+		return
+	}
+	source.remaining -= util.Min(source.remaining, amount)
+	sink.remaining -= util.Min(sink.remaining, amount)
+	r.feeSpent += result.Fee
+	r.history[key].Successes++
+	r.history[key].ConsecutiveFailures = 0
+	r.history[key].Amount += result.Amount
+	r.history[key].Fee += result.Fee
+}
+
+func (r *RebalanceFlow) GetCandidateDirection(id string) string {
+	return util.GetDirection(id, r.Node.Id)
+}
+
+// EnqueueCandidate puts a sink at the front of the queue
+func (r *RebalanceFlow) EnqueueCandidate(result *rebalance2.Result) {
+	scid := result.InScid
+	candidate, err := r.Node.GetIncomingChannelFromScid(scid)
+	if err != nil {
+		r.Node.Logln(glightning.Unusual, err)
+		return
+	}
+
+	r.QueueLock.Lock()
+	r.Candidates.PushFront(candidate)
+	r.QueueLock.Unlock()
+}
+
+func (r *RebalanceFlow) AddSuccess(result *rebalance2.Result) {
+	alias := r.Node.Graph.GetAlias(result.Out) + " -> " + r.Node.Graph.GetAlias(result.In)
+	r.AddSuccessGeneric(alias, result.PPM, result.Amount)
+}
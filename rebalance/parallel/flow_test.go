@@ -0,0 +1,196 @@
+package parallel
+
+import (
+	"circular/node"
+	rebalance2 "circular/rebalance"
+	"circular/simnet"
+	"circular/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newFlowNetwork returns a network where alice and carol have too much on our side and bob and dave
+// too little. Both alice and carol can forward to both bob and dave
+func newFlowNetwork() *simnet.Network {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 100)
+	network.AddChannel("4x4x4", "self", "carol", 1000000, 900000, 0, 10)
+	network.AddChannel("6x6x6", "self", "dave", 1000000, 100000, 0, 100)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 900000, 0, 10)
+	network.AddChannel("5x5x5", "carol", "bob", 1000000, 900000, 0, 10)
+	network.AddChannel("7x7x7", "alice", "dave", 1000000, 900000, 0, 10)
+	network.AddChannel("8x8x8", "carol", "dave", 1000000, 900000, 0, 10)
+	return network
+}
+
+func newTestFlow(n *node.Node, amount uint64) *RebalanceFlow {
+	r := &RebalanceFlow{
+		Sources:     []FlowChannel{{Scid: "1x1x1", Amount: amount}, {Scid: "4x4x4", Amount: amount}},
+		Sinks:       []FlowChannel{{Scid: "2x2x2", Amount: amount}, {Scid: "6x6x6", Amount: amount}},
+		SplitAmount: 50000,
+		Splits:      1,
+		MaxPPM:      500,
+	}
+	r.Node = n
+	return r
+}
+
+// assertReleased checks that nothing is reserved anymore after the flow is over
+func assertReleased(t *testing.T, r *RebalanceFlow) {
+	for _, source := range r.sources {
+		assert.Equal(t, uint64(0), source.inFlight, source.channel.ShortChannelId)
+	}
+	for scid, sink := range r.sinks {
+		assert.Equal(t, uint64(0), sink.inFlight, scid)
+	}
+	assert.Equal(t, uint64(0), r.feeReserved)
+}
+
+func TestRebalanceFlow_MovesEveryAmount(t *testing.T) {
+	network := newFlowNetwork()
+	n := newTestNode(t, network)
+
+	r := newTestFlow(n, 100000)
+	result, err := r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200000), result.(*Result).RebalancedAmount)
+
+	assert.Equal(t, uint64(200000000), network.Balance("2x2x2", "self"))
+	assert.Equal(t, uint64(200000000), network.Balance("6x6x6", "self"))
+	assert.Less(t, network.Balance("1x1x1", "self"), uint64(800000000))
+	assert.Less(t, network.Balance("4x4x4", "self"), uint64(800000000))
+	assertReleased(t, r)
+	for _, source := range r.sources {
+		assert.Equal(t, uint64(0), source.remaining)
+	}
+	assert.LessOrEqual(t, r.feeSpent, r.maxFee)
+
+	// what the pairs cost is remembered for the next time
+	assert.Len(t, r.history, 2)
+	for key, h := range r.history {
+		assert.Equal(t, uint64(2), h.Successes, key)
+	}
+}
+
+func TestRebalanceFlow_PairsTheCheapestSource(t *testing.T) {
+	n := newTestNode(t, newFlowNetwork())
+
+	r := newTestFlow(n, 100000)
+	r.DryRun = true
+	_, err := r.Call()
+	assert.NoError(t, err)
+
+	bob, err := n.GetIncomingChannelFromScid("2x2x2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without history every source costs the same, the first one is used
+	assert.Equal(t, "1x1x1", r.bestSource(bob, 50000000).channel.ShortChannelId)
+
+	// carol moved liquidity to bob cheaply before, while alice failed
+	r.history[node.PairKey("4x4x4", "2x2x2")] = &node.History{Successes: 3, Amount: 150000, Fee: 3000}
+	r.history[node.PairKey("1x1x1", "2x2x2")] = &node.History{Failures: 2, ConsecutiveFailures: 2}
+	assert.Equal(t, "4x4x4", r.bestSource(bob, 50000000).channel.ShortChannelId)
+
+	// a source can't send more than what it has left
+	r.sources[1].inFlight = 80000000
+	assert.Equal(t, "1x1x1", r.bestSource(bob, 50000000).channel.ShortChannelId)
+	r.sources[0].remaining = 0
+	assert.Nil(t, r.bestSource(bob, 50000000))
+}
+
+func TestRebalanceFlow_FeeBudget(t *testing.T) {
+	network := newFlowNetwork()
+	n := newTestNode(t, network)
+
+	// a split costs about 5.5 sats, there's room for only one
+	r := newTestFlow(n, 100000)
+	r.MaxFee = 8
+	result, err := r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50000), result.(*Result).RebalancedAmount)
+	assert.LessOrEqual(t, r.feeSpent, r.maxFee)
+	assertReleased(t, r)
+
+	// once the budget is spent, no split is sent at all
+	r.flowLock.Lock()
+	r.feeSpent = r.maxFee
+	assert.Equal(t, uint64(0), r.availablePPM(50000000))
+	r.flowLock.Unlock()
+}
+
+func TestRebalanceFlow_ReleasesFailedSplits(t *testing.T) {
+	network := newFlowNetwork()
+	network.SetActive("3x3x3", false)
+	network.SetActive("5x5x5", false)
+	network.SetActive("7x7x7", false)
+	network.SetActive("8x8x8", false)
+	n := newTestNode(t, network)
+
+	r := newTestFlow(n, 100000)
+	result, err := r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), result.(*Result).RebalancedAmount)
+	assertReleased(t, r)
+	for _, source := range r.sources {
+		assert.Equal(t, uint64(100000000), source.remaining)
+	}
+	assert.Equal(t, uint64(0), r.feeSpent)
+}
+
+func TestRebalanceFlow_SettleReleasesWhatWasReserved(t *testing.T) {
+	n := newTestNode(t, newFlowNetwork())
+
+	r := newTestFlow(n, 100000)
+	r.DryRun = true
+	_, err := r.Call()
+	assert.NoError(t, err)
+
+	// results are in sats, the reservation is in msat: what was reserved is released to the last msat
+	source, sink := r.sources[0], r.sinks["2x2x2"]
+	source.inFlight, sink.inFlight, r.feeReserved = 50000500, 50000500, 25000
+	result := rebalance2.NewResult("failure", 50000, "alice", "bob")
+	r.settle(source, sink, 50000500, 25000, result)
+	assertReleased(t, r)
+	assert.Equal(t, uint64(100000000), source.remaining)
+
+	source.inFlight, sink.inFlight, r.feeReserved = 50000500, 50000500, 25000
+	result = rebalance2.NewResult("success", 50000, "alice", "bob")
+	result.Fee = 5500
+	r.settle(source, sink, 50000500, 25000, result)
+	assertReleased(t, r)
+	assert.Equal(t, uint64(49999500), source.remaining)
+	assert.Equal(t, uint64(5500), r.feeSpent)
+}
+
+func TestRebalanceFlow_SinksWithoutSource(t *testing.T) {
+	n := newTestNode(t, newFlowNetwork())
+
+	r := newTestFlow(n, 100000)
+	r.DryRun = true
+	_, err := r.Call()
+	assert.NoError(t, err)
+	for _, source := range r.sources {
+		source.remaining = 0
+	}
+
+	// the preview doesn't pair the sinks with a source that can't send
+	preview := r.Preview()
+	assert.Len(t, preview.Candidates, 2)
+	for _, candidate := range preview.Candidates {
+		assert.Equal(t, "unusable", candidate.Status)
+		assert.Empty(t, candidate.Out)
+		assert.Contains(t, candidate.Message, util.ErrNoSource.Error())
+	}
+
+	// and the flow tells why it didn't fire them
+	r.FireCandidates()
+	result, err := r.WaitForResult()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"2x2x2: " + util.ErrNoSource.Error(),
+		"6x6x6: " + util.ErrNoSource.Error(),
+	}, result.(*Result).Skipped)
+	assertReleased(t, r)
+}
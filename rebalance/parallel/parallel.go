@@ -4,15 +4,20 @@ import (
 	"circular/graph"
 	"circular/node"
 	rebalance2 "circular/rebalance"
+	"circular/util"
+	"encoding/json"
 	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
 	"github.com/gammazero/deque"
+	"sort"
 	"sync"
 )
 
 type RebalanceMethods interface {
 	IsGoodCandidate(peerChannel *glightning.PeerChannel) bool
 	CanUseChannel(channel *glightning.PeerChannel) error
-	Fire(candidate *graph.Channel)
+	Fire(candidate *graph.Channel, amount uint64)
+	NewRebalance(candidate *graph.Channel, amount uint64) (*rebalance2.Rebalance, error)
 	EnqueueCandidate(result *rebalance2.Result)
 	GetCandidateDirection(id string) string
 	AddSuccess(result *rebalance2.Result)
@@ -30,28 +35,99 @@ type AbstractRebalance struct {
 	RebalanceResultChan chan *rebalance2.Result
 	CandidatesList      []string
 	Result              *Result
+	Job                 *node.Job
 	amount              uint64
 	maxPPM              uint64
 	splits              int
 	splitAmount         uint64
+	minSplitAmount      uint64
+	maxSplitAmount      uint64
+	splitAmounts        map[string]uint64
+	splitsInFlight      int
 	attempts            int
 	maxHops             int
+	maxDelay            int
+	filter              *graph.Filter
+	targetRatio         uint64
+	candidatesTried     map[string]bool
+	params              json.RawMessage
 	RebalanceMethods
 }
 
-func (r *AbstractRebalance) Init(amount, maxppm, splitamount uint64, splits, attempts, maxhops int) {
-	r.Node = node.GetNode()
+func (r *AbstractRebalance) Init(amount, maxppm, splitamount uint64, splits, attempts, maxhops, maxdelay int) {
+	// the node can be set beforehand, otherwise it's the one of the plugin
+	if r.Node == nil {
+		r.Node = node.GetNode()
+	}
 	r.AmountLock = &sync.Mutex{}
 	r.QueueLock = &sync.Mutex{}
 	r.TotalAttempts = 0
 	r.RebalanceResultChan = make(chan *rebalance2.Result)
+	r.candidatesTried = make(map[string]bool)
 	r.Node.Logf(glightning.Debug, "%+v", r)
+	// the parameters are kept as they were given, before some of them are converted to msat,
+	// so that a job can be resumed with them after a restart
+	params, err := json.Marshal(r.RebalanceMethods)
+	if err != nil {
+		r.Node.Logln(glightning.Unusual, "unable to save the parameters of the rebalance: ", err)
+	}
+	r.params = params
 	r.amount = amount
 	r.maxPPM = maxppm
 	r.splitAmount = splitamount
 	r.splits = splits
 	r.attempts = attempts
 	r.maxHops = maxhops
+	r.maxDelay = maxdelay
 	r.setGenericDefaults()
 	r.Node.Logln(glightning.Debug, "AbstractRebalance initialized")
 }
+
+// setFilter restricts the routes of every split with the nodes and channels given
+func (r *AbstractRebalance) setFilter(excludeNodes, excludeChannels, viaNodes []string) error {
+	filter, err := graph.NewFilter(excludeNodes, excludeChannels, viaNodes)
+	if err != nil {
+		return err
+	}
+	r.filter = filter
+	return nil
+}
+
+// newRebalance returns the rebalance of one split, with the parameters shared by every split
+func (r *AbstractRebalance) newRebalance(out, in *graph.Channel, amount, maxPPM uint64) *rebalance2.Rebalance {
+	rebalance := rebalance2.NewRebalance(out, in, amount, maxPPM, r.attempts, r.maxHops, r.maxDelay)
+	rebalance.Node = r.Node
+	rebalance.Filter = r.filter
+	return rebalance
+}
+
+// Start fires the candidates and waits for the results, in the background if async is true.
+// The job is saved with the parameters that Init kept, so that it can be resumed after a restart
+func (r *AbstractRebalance) Start(method string, async bool) (jrpc2.Result, error) {
+	if !async {
+		r.FireCandidates()
+		return r.WaitForResult()
+	}
+	return r.Node.StartJob(method, r.params, func(job *node.Job) (jrpc2.Result, error) {
+		r.Job = job
+		job.SetProgress(r.Progress)
+		r.FireCandidates()
+		return r.WaitForResult()
+	}), nil
+}
+
+// Progress reports how far the rebalance has gone when it runs as a job
+func (r *AbstractRebalance) Progress() *node.JobProgress {
+	r.AmountLock.Lock()
+	defer r.AmountLock.Unlock()
+
+	tried := util.GetMapKeys(r.candidatesTried)
+	sort.Strings(tried)
+	return &node.JobProgress{
+		Amount:           r.amount / 1000,
+		AmountRebalanced: r.AmountRebalanced / 1000,
+		InFlightSplits:   r.splitsInFlight,
+		Attempts:         r.TotalAttempts,
+		CandidatesTried:  tried,
+	}
+}
@@ -0,0 +1,56 @@
+package parallel
+
+import (
+	"circular/node"
+	"circular/simnet"
+	"testing"
+)
+
+// newTestNode returns a node backed by network, wired to its notifications like the plugin does.
+// The aliases are loaded right away, they name the successes of the results
+func newTestNode(t *testing.T, network *simnet.Network) *node.Node {
+	n, err := node.New(network, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := network.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Graph.RefreshAliases(nodes)
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	network.OnSendPaySuccess = n.OnPaymentSuccess
+	network.OnSendPayFailure = n.OnPaymentFailure
+	network.OnHtlcAccepted = n.OnHtlcAccepted
+	return n
+}
+
+// newTestNetwork returns a network where self has a cheap channel with alice, which is full on our side,
+// and an expensive one with bob, which is empty on our side. Carol is cheap but her channel is depleted,
+// dave is expensive and his channel is balanced. Alice, carol and dave can forward to bob and alice to dave
+func newTestNetwork() *simnet.Network {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 100)
+	network.AddChannel("4x4x4", "self", "carol", 1000000, 150000, 0, 10)
+	network.AddChannel("6x6x6", "self", "dave", 1000000, 500000, 0, 200)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 900000, 0, 10)
+	network.AddChannel("5x5x5", "carol", "bob", 1000000, 900000, 0, 10)
+	network.AddChannel("7x7x7", "alice", "dave", 1000000, 900000, 0, 10)
+	return network
+}
+
+// previewCandidates returns the status of every candidate of a preview, by the peer of the candidate
+func previewCandidates(preview *Preview, pull bool) map[string]string {
+	candidates := make(map[string]string)
+	for _, candidate := range preview.Candidates {
+		if pull {
+			candidates[candidate.Out] = candidate.Status
+		} else {
+			candidates[candidate.In] = candidate.Status
+		}
+	}
+	return candidates
+}
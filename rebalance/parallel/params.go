@@ -3,6 +3,7 @@ package parallel
 import (
 	"circular/rebalance"
 	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
 )
 
 const (
@@ -40,6 +41,10 @@ func (r *AbstractRebalance) setGenericDefaults() {
 }
 
 func (r *AbstractRebalance) validateGenericParameters() error {
+	// adaptive splits settle the remainder of the amount with a smaller split
+	if r.adaptive() {
+		return nil
+	}
 	if r.amount < r.splitAmount {
 		return util.ErrAmountLessThanSplitAmount
 	}
@@ -48,3 +53,27 @@ func (r *AbstractRebalance) validateGenericParameters() error {
 	}
 	return nil
 }
+
+// setTargetRatio computes the amount that brings the local balance of the target channel to ratio percent
+// of its capacity, without overshooting it. If amount is given (sats), it is the maximum
+func (r *AbstractRebalance) setTargetRatio(ratio, amount uint64) error {
+	needed, err := rebalance.AmountToTargetRatio(r.Node, r.TargetChannel, ratio)
+	if err != nil {
+		return err
+	}
+	r.amount = needed
+	if amount > 0 {
+		r.amount = util.Min(r.amount, amount*1000)
+	}
+	r.amount -= r.amount % 1000
+	if !r.adaptive() {
+		r.amount -= r.amount % r.splitAmount
+	}
+	if r.amount == 0 {
+		return util.ErrTargetReached
+	}
+
+	r.targetRatio = ratio
+	r.Node.Logf(glightning.Info, "%d sats needed to bring %s to %d%%", r.amount/1000, r.TargetChannel.ShortChannelId, ratio)
+	return nil
+}
@@ -0,0 +1,53 @@
+package parallel
+
+import (
+	rebalance2 "circular/rebalance"
+	"github.com/elementsproject/glightning/glightning"
+)
+
+// Preview is the result of a dry run: the candidates that would be used, in the order they would be fired,
+// each with the route that its first split would take
+type Preview struct {
+	RebalanceTarget uint64               `json:"rebalance_target"`
+	SplitAmount     uint64               `json:"split_amount"`
+	Candidates      []*rebalance2.Result `json:"candidates"`
+}
+
+// Preview looks for a route through every candidate without sending anything.
+// Candidates that can't be used right now are listed with the reason why
+func (r *AbstractRebalance) Preview() *Preview {
+	r.QueueLock.Lock()
+	defer r.QueueLock.Unlock()
+
+	preview := &Preview{
+		RebalanceTarget: r.amount / 1000,
+		SplitAmount:     r.splitAmount / 1000,
+		Candidates:      make([]*rebalance2.Result, 0, r.Candidates.Len()),
+	}
+	for i := 0; i < r.Candidates.Len(); i++ {
+		candidate := r.Candidates.At(i)
+		rebalance, err := r.NewRebalance(candidate, r.getSplitAmount(candidate.ShortChannelId))
+		if err != nil {
+			// a sink of a flow that no source can send to is not paired with any
+			result := rebalance2.NewResult("unusable", r.splitAmount/1000, "", candidate.Source)
+			result.Message = candidate.ShortChannelId + ": " + err.Error()
+			preview.Candidates = append(preview.Candidates, result)
+			continue
+		}
+
+		peerChannel, err := r.Node.GetPeerChannelFromGraphChannel(candidate)
+		if err == nil {
+			err = r.CanUseChannel(peerChannel)
+		}
+		if err != nil {
+			r.Node.Logln(glightning.Debug, "channel not usable:", err)
+			result := rebalance2.NewResult("unusable", r.splitAmount/1000, rebalance.OutChannel.Destination, rebalance.InChannel.Source)
+			result.Message = candidate.ShortChannelId + ": " + err.Error()
+			preview.Candidates = append(preview.Candidates, result)
+			continue
+		}
+
+		preview.Candidates = append(preview.Candidates, rebalance.Preview())
+	}
+	return preview
+}
@@ -22,11 +22,20 @@ type RebalancePull struct {
 	MaxPPM             uint64   `json:"maxppm,omitempty"`
 	Splits             int      `json:"splits,omitempty"`
 	SplitAmount        uint64   `json:"splitamount,omitempty"`
+	MinSplitAmount     uint64   `json:"minsplitamount,omitempty"`
+	MaxSplitAmount     uint64   `json:"maxsplitamount,omitempty"`
 	DepleteUpToPercent float64  `json:"depleteuptopercent,omitempty"`
 	DepleteUpToAmount  uint64   `json:"depleteuptoamount,omitempty"`
 	Attempts           int      `json:"attempts,omitempty"`
 	MaxHops            int      `json:"maxhops,omitempty"`
-	AbstractRebalance
+	MaxDelay           int      `json:"maxdelay,omitempty"`
+	ExcludeNodes       []string `json:"excludenodes,omitempty"`
+	ExcludeChannels    []string `json:"excludechannels,omitempty"`
+	ViaNodes           []string `json:"vianodes,omitempty"`
+	TargetRatio        uint64   `json:"targetratio,omitempty"`
+	Async              bool     `json:"async,omitempty"`
+	DryRun             bool     `json:"dryrun,omitempty"`
+	AbstractRebalance  `json:"-"`
 }
 
 func (r *RebalancePull) Name() string {
@@ -42,7 +51,13 @@ func (r *RebalancePull) Call() (jrpc2.Result, error) {
 	if r.InScid == "" {
 		return nil, util.ErrNoRequiredParameter
 	}
-	r.Init(r.Amount, r.MaxPPM, r.SplitAmount, r.Splits, r.Attempts, r.MaxHops)
+	r.Init(r.Amount, r.MaxPPM, r.SplitAmount, r.Splits, r.Attempts, r.MaxHops, r.MaxDelay)
+	if err := r.setFilter(r.ExcludeNodes, r.ExcludeChannels, r.ViaNodes); err != nil {
+		return nil, err
+	}
+	if err := r.setSplitRange(r.MinSplitAmount, r.MaxSplitAmount, r.SplitAmount); err != nil {
+		return nil, err
+	}
 
 	r.CandidatesList = r.OutList
 	if r.CandidatesList != nil {
@@ -64,12 +79,21 @@ func (r *RebalancePull) Call() (jrpc2.Result, error) {
 	}
 	r.TargetChannel = incomingChannel
 
+	if r.TargetRatio > 0 {
+		if err = r.setTargetRatio(r.TargetRatio, r.Amount); err != nil {
+			return nil, err
+		}
+	}
+
 	if err = r.FindCandidates(r.TargetChannel.Source); err != nil {
 		return nil, err
 	}
 
-	r.FireCandidates()
-	return r.WaitForResult()
+	if r.DryRun {
+		return r.Preview(), nil
+	}
+
+	return r.Start(r.Name(), r.Async)
 }
 
 func (r *RebalancePull) IsGoodCandidate(peerChannel *glightning.PeerChannel) bool {
@@ -103,9 +127,10 @@ func (r *RebalancePull) CanUseChannel(channel *glightning.PeerChannel) error {
 	return nil
 }
 
-func (r *RebalancePull) Fire(candidate *graph.Channel) {
-	r.Node.Logln(glightning.Debug, "Firing candidate: ", candidate.ShortChannelId, " for attempts: ", r.attempts)
-	rebalance := rebalance2.NewRebalance(candidate, r.TargetChannel, r.splitAmount, r.maxPPM, r.attempts, r.maxHops)
+func (r *RebalancePull) Fire(candidate *graph.Channel, amount uint64) {
+	r.Node.Logln(glightning.Debug, "Firing candidate: ", candidate.ShortChannelId, " with amount: ", amount/1000, " for attempts: ", r.attempts)
+	rebalance := r.newRebalance(candidate, r.TargetChannel, amount, r.maxPPM)
+	rebalance.Job = r.Job
 
 	go func() {
 		r.RebalanceResultChan <- rebalance.Run()
@@ -127,6 +152,11 @@ func (r *RebalancePull) setDefaults() {
 	r.DepleteUpToAmount *= 1000
 }
 
+// NewRebalance returns the rebalance of one split through candidate
+func (r *RebalancePull) NewRebalance(candidate *graph.Channel, amount uint64) (*rebalance2.Rebalance, error) {
+	return r.newRebalance(candidate, r.TargetChannel, amount, r.maxPPM), nil
+}
+
 func (r *RebalancePull) validateParameters() error {
 	if err := r.validateGenericParameters(); err != nil {
 		return err
@@ -141,9 +171,9 @@ func (r *RebalancePull) GetCandidateDirection(id string) string {
 	return util.GetDirection(r.Node.Id, id)
 }
 
-// EnqueueCandidate puts a candidate at the front of the queue
+// EnqueueCandidate puts the candidate of a rebalance at the front of the queue
 func (r *RebalancePull) EnqueueCandidate(result *rebalance2.Result) {
-	scid := result.Route.Hops[0].ShortChannelId
+	scid := result.OutScid
 	candidate, err := r.Node.GetOutgoingChannelFromScid(scid)
 	if err != nil {
 		r.Node.Logln(glightning.Unusual, err)
@@ -0,0 +1,131 @@
+package parallel
+
+import (
+	"circular/simnet"
+	"circular/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRebalancePull_Candidates(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	r := &RebalancePull{InScid: "2x2x2", MaxPPM: 500, DryRun: true}
+	r.Node = n
+	result, err := r.Call()
+	assert.NoError(t, err)
+
+	// dave is too expensive, carol is cheap but depleted and bob is the target
+	preview := result.(*Preview)
+	assert.Equal(t, map[string]string{"alice": "dryrun", "carol": "unusable"}, previewCandidates(preview, true))
+	assert.Equal(t, uint64(DEFAULT_AMOUNT), preview.RebalanceTarget)
+	assert.Equal(t, uint64(DEFAULT_SPLIT_AMOUNT), preview.SplitAmount)
+	for _, candidate := range preview.Candidates {
+		if candidate.Out == "alice" {
+			assert.Equal(t, "1x1x1", candidate.OutScid)
+			assert.Equal(t, "2x2x2", candidate.InScid)
+			assert.Equal(t, "3x3x3", candidate.Route.Hops[1].ShortChannelId)
+		} else {
+			assert.Equal(t, "4x4x4: "+util.ErrChannelDepleted.Error(), candidate.Message)
+		}
+	}
+
+	// with a higher maxoutppm or an outlist, dave becomes a candidate as well
+	r = &RebalancePull{InScid: "2x2x2", MaxPPM: 500, MaxOutPPM: 300, DryRun: true}
+	r.Node = n
+	result, err = r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "dryrun", "carol": "unusable", "dave": "dryrun"}, previewCandidates(result.(*Preview), true))
+
+	r = &RebalancePull{InScid: "2x2x2", OutList: []string{"dave"}, MaxPPM: 500, DryRun: true}
+	r.Node = n
+	result, err = r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"dave": "dryrun"}, previewCandidates(result.(*Preview), true))
+
+	// a dry run doesn't move anything
+	assert.Equal(t, uint64(100000000), network.Balance("2x2x2", "self"))
+	assert.Equal(t, uint64(900000000), network.Balance("1x1x1", "self"))
+}
+
+func TestRebalancePull_NoCandidates(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+
+	r := &RebalancePull{InScid: "2x2x2", OutList: []string{"bob"}, MaxPPM: 500}
+	r.Node = n
+	_, err := r.Call()
+	assert.Equal(t, util.ErrNoCandidates, err)
+}
+
+func TestRebalancePull_Splits(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	r := &RebalancePull{InScid: "2x2x2", Amount: 300000, SplitAmount: 50000, Splits: 3, MaxPPM: 500}
+	r.Node = n
+	result, err := r.Call()
+	assert.NoError(t, err)
+
+	res := result.(*Result)
+	assert.Equal(t, uint64(300000), res.RebalanceTarget)
+	assert.Equal(t, uint64(300000), res.RebalancedAmount)
+	assert.Equal(t, uint64(300000), sum(res.Successes["alice"]))
+	assert.GreaterOrEqual(t, res.Attempts, uint64(6))
+	assert.Equal(t, uint64(400000000), network.Balance("2x2x2", "self"))
+	assert.Less(t, network.Balance("1x1x1", "self"), uint64(600000000))
+}
+
+func TestRebalancePull_AmountNotMultipleOfSplitAmount(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+
+	r := &RebalancePull{InScid: "2x2x2", Amount: 250000, SplitAmount: 100000, MaxPPM: 500}
+	r.Node = n
+	_, err := r.Call()
+	assert.Equal(t, util.ErrAmountNotMultipleOfSplitAmount, err)
+
+	r = &RebalancePull{InScid: "2x2x2", Amount: 50000, SplitAmount: 100000, MaxPPM: 500}
+	r.Node = n
+	_, err = r.Call()
+	assert.Equal(t, util.ErrAmountLessThanSplitAmount, err)
+}
+
+func TestRebalancePull_StopsAtDepletionThreshold(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 300000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 100)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 900000, 0, 10)
+	n := newTestNode(t, network)
+
+	// alice can't go below 20% of the capacity: after two splits she's at the threshold
+	r := &RebalancePull{InScid: "2x2x2", Amount: 400000, SplitAmount: 100000, Splits: 1, MaxPPM: 500}
+	r.Node = n
+	result, err := r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200000), result.(*Result).RebalancedAmount)
+	assert.Equal(t, uint64(300000000), network.Balance("2x2x2", "self"))
+
+	// depleteuptoamount lowers the threshold
+	r = &RebalancePull{InScid: "2x2x2", Amount: 50000, SplitAmount: 50000, Splits: 1, MaxPPM: 500, DepleteUpToAmount: 50000}
+	r.Node = n
+	result, err = r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50000), result.(*Result).RebalancedAmount)
+
+	// and depleteuptopercent raises it
+	r = &RebalancePull{InScid: "2x2x2", Amount: 10000, SplitAmount: 10000, Splits: 1, MaxPPM: 500, DepleteUpToPercent: 0.06}
+	r.Node = n
+	result, err = r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), result.(*Result).RebalancedAmount)
+	assert.Equal(t, uint64(350000000), network.Balance("2x2x2", "self"))
+}
+
+// sum returns the amount rebalanced at any ppm
+func sum(success Success) uint64 {
+	var total uint64
+	for _, amount := range success {
+		total += amount
+	}
+	return total
+}
@@ -15,18 +15,27 @@ const (
 )
 
 type RebalancePush struct {
-	OutScid         string   `json:"outscid"`
-	InList          []string `json:"inlist,omitempty"`
-	MinOutPPM       uint64   `json:"minoutppm,omitempty"`
-	Amount          uint64   `json:"amount,omitempty"`
-	MaxPPM          uint64   `json:"maxppm,omitempty"`
-	Splits          int      `json:"splits,omitempty"`
-	SplitAmount     uint64   `json:"splitamount,omitempty"`
-	Attempts        int      `json:"attempts,omitempty"`
-	MaxHops         int      `json:"maxhops,omitempty"`
-	FillUpToPercent float64  `json:"filluptopercent,omitempty"`
-	FillUpToAmount  uint64   `json:"filluptoamount,omitempty"`
-	AbstractRebalance
+	OutScid           string   `json:"outscid"`
+	InList            []string `json:"inlist,omitempty"`
+	MinOutPPM         uint64   `json:"minoutppm,omitempty"`
+	Amount            uint64   `json:"amount,omitempty"`
+	MaxPPM            uint64   `json:"maxppm,omitempty"`
+	Splits            int      `json:"splits,omitempty"`
+	SplitAmount       uint64   `json:"splitamount,omitempty"`
+	MinSplitAmount    uint64   `json:"minsplitamount,omitempty"`
+	MaxSplitAmount    uint64   `json:"maxsplitamount,omitempty"`
+	Attempts          int      `json:"attempts,omitempty"`
+	MaxHops           int      `json:"maxhops,omitempty"`
+	MaxDelay          int      `json:"maxdelay,omitempty"`
+	ExcludeNodes      []string `json:"excludenodes,omitempty"`
+	ExcludeChannels   []string `json:"excludechannels,omitempty"`
+	ViaNodes          []string `json:"vianodes,omitempty"`
+	FillUpToPercent   float64  `json:"filluptopercent,omitempty"`
+	FillUpToAmount    uint64   `json:"filluptoamount,omitempty"`
+	TargetRatio       uint64   `json:"targetratio,omitempty"`
+	Async             bool     `json:"async,omitempty"`
+	DryRun            bool     `json:"dryrun,omitempty"`
+	AbstractRebalance `json:"-"`
 }
 
 func (r *RebalancePush) Name() string {
@@ -42,7 +51,13 @@ func (r *RebalancePush) Call() (jrpc2.Result, error) {
 	if r.OutScid == "" {
 		return nil, util.ErrNoRequiredParameter
 	}
-	r.Init(r.Amount, r.MaxPPM, r.SplitAmount, r.Splits, r.Attempts, r.MaxHops)
+	r.Init(r.Amount, r.MaxPPM, r.SplitAmount, r.Splits, r.Attempts, r.MaxHops, r.MaxDelay)
+	if err := r.setFilter(r.ExcludeNodes, r.ExcludeChannels, r.ViaNodes); err != nil {
+		return nil, err
+	}
+	if err := r.setSplitRange(r.MinSplitAmount, r.MaxSplitAmount, r.SplitAmount); err != nil {
+		return nil, err
+	}
 
 	r.CandidatesList = r.InList
 	if r.CandidatesList != nil {
@@ -63,12 +78,21 @@ func (r *RebalancePush) Call() (jrpc2.Result, error) {
 	}
 	r.TargetChannel = outgoingChannel
 
+	if r.TargetRatio > 0 {
+		if err = r.setTargetRatio(r.TargetRatio, r.Amount); err != nil {
+			return nil, err
+		}
+	}
+
 	if err = r.FindCandidates(r.TargetChannel.Destination); err != nil {
 		return nil, err
 	}
 
-	r.FireCandidates()
-	return r.WaitForResult()
+	if r.DryRun {
+		return r.Preview(), nil
+	}
+
+	return r.Start(r.Name(), r.Async)
 }
 
 func (r *RebalancePush) IsGoodCandidate(peerChannel *glightning.PeerChannel) bool {
@@ -112,15 +136,21 @@ func (r *RebalancePush) CanUseChannel(channel *glightning.PeerChannel) error {
 	return nil
 }
 
-func (r *RebalancePush) Fire(candidate *graph.Channel) {
-	r.Node.Logln(glightning.Debug, "Firing candidate: ", candidate.ShortChannelId, " for attempts: ", r.attempts)
-	rebalance := rebalance2.NewRebalance(r.TargetChannel, candidate, r.splitAmount, r.maxPPM, r.attempts, r.maxHops)
+func (r *RebalancePush) Fire(candidate *graph.Channel, amount uint64) {
+	r.Node.Logln(glightning.Debug, "Firing candidate: ", candidate.ShortChannelId, " with amount: ", amount/1000, " for attempts: ", r.attempts)
+	rebalance := r.newRebalance(r.TargetChannel, candidate, amount, r.maxPPM)
+	rebalance.Job = r.Job
 
 	go func() {
 		r.RebalanceResultChan <- rebalance.Run()
 	}()
 }
 
+// NewRebalance returns the rebalance of one split through candidate
+func (r *RebalancePush) NewRebalance(candidate *graph.Channel, amount uint64) (*rebalance2.Rebalance, error) {
+	return r.newRebalance(r.TargetChannel, candidate, amount, r.maxPPM), nil
+}
+
 func (r *RebalancePush) validateParameters() error {
 	if err := r.validateGenericParameters(); err != nil {
 		return err
@@ -150,9 +180,9 @@ func (r *RebalancePush) GetCandidateDirection(id string) string {
 	return util.GetDirection(id, r.Node.Id)
 }
 
-// EnqueueCandidate puts a candidate at the front of the queue
+// EnqueueCandidate puts the candidate of a rebalance at the front of the queue
 func (r *RebalancePush) EnqueueCandidate(result *rebalance2.Result) {
-	scid := result.Route.Hops[len(result.Route.Hops)-1].ShortChannelId
+	scid := result.InScid
 	candidate, err := r.Node.GetIncomingChannelFromScid(scid)
 	if err != nil {
 		r.Node.Logln(glightning.Unusual, err)
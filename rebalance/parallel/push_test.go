@@ -0,0 +1,91 @@
+package parallel
+
+import (
+	"circular/simnet"
+	"circular/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRebalancePush_Candidates(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	r := &RebalancePush{OutScid: "1x1x1", MaxPPM: 500, DryRun: true}
+	r.Node = n
+	result, err := r.Call()
+	assert.NoError(t, err)
+
+	// carol is too cheap, dave already has too much on our side and alice is the target
+	preview := result.(*Preview)
+	assert.Equal(t, map[string]string{"bob": "dryrun", "dave": "unusable"}, previewCandidates(preview, false))
+	for _, candidate := range preview.Candidates {
+		if candidate.In == "bob" {
+			assert.Equal(t, "1x1x1", candidate.OutScid)
+			assert.Equal(t, "2x2x2", candidate.InScid)
+			assert.Equal(t, "3x3x3", candidate.Route.Hops[1].ShortChannelId)
+		} else {
+			assert.Equal(t, "6x6x6: "+util.ErrChannelFilled.Error(), candidate.Message)
+		}
+	}
+
+	// bob and dave charge us more than a lower maxppm
+	r = &RebalancePush{OutScid: "1x1x1", MaxPPM: 50, DryRun: true}
+	r.Node = n
+	_, err = r.Call()
+	assert.Equal(t, util.ErrNoCandidates, err)
+
+	// an inlist restricts the candidates
+	r = &RebalancePush{OutScid: "1x1x1", InList: []string{"bob"}, MaxPPM: 500, DryRun: true}
+	r.Node = n
+	result, err = r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"bob": "dryrun"}, previewCandidates(result.(*Preview), false))
+
+	// a dry run doesn't move anything
+	assert.Equal(t, uint64(900000000), network.Balance("1x1x1", "self"))
+	assert.Equal(t, uint64(100000000), network.Balance("2x2x2", "self"))
+}
+
+func TestRebalancePush_Splits(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	// bob can take 100k sats before reaching the fill threshold
+	r := &RebalancePush{OutScid: "1x1x1", Amount: 100000, SplitAmount: 25000, Splits: 2, MaxPPM: 500}
+	r.Node = n
+	result, err := r.Call()
+	assert.NoError(t, err)
+
+	res := result.(*Result)
+	assert.Equal(t, uint64(100000), res.RebalanceTarget)
+	assert.Equal(t, uint64(100000), res.RebalancedAmount)
+	assert.Equal(t, uint64(100000), sum(res.Successes["bob"]))
+	assert.GreaterOrEqual(t, res.Attempts, uint64(4))
+	assert.Equal(t, uint64(200000000), network.Balance("2x2x2", "self"))
+	assert.Less(t, network.Balance("1x1x1", "self"), uint64(800000000))
+}
+
+func TestRebalancePush_StopsAtFillThreshold(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 100)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 900000, 0, 10)
+	n := newTestNode(t, network)
+
+	// bob must keep 80% of the capacity: after two splits he's at the threshold
+	r := &RebalancePush{OutScid: "1x1x1", Amount: 400000, SplitAmount: 100000, Splits: 1, MaxPPM: 500}
+	r.Node = n
+	result, err := r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200000), result.(*Result).RebalancedAmount)
+	assert.Equal(t, uint64(300000000), network.Balance("2x2x2", "self"))
+
+	// filluptoamount lowers the threshold
+	r = &RebalancePush{OutScid: "1x1x1", Amount: 300000, SplitAmount: 100000, Splits: 1, MaxPPM: 500, FillUpToAmount: 600000}
+	r.Node = n
+	result, err = r.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200000), result.(*Result).RebalancedAmount)
+	assert.Equal(t, uint64(500000000), network.Balance("2x2x2", "self"))
+}
@@ -18,6 +18,8 @@ type Result struct {
 	Attempts         uint64             `json:"attempts"`
 	Time             string             `json:"time"`
 	Successes        map[string]Success `json:"successes"`
+	// Skipped tells why candidates were not fired
+	Skipped []string `json:"skipped,omitempty"`
 }
 
 func NewResult(target uint64) *Result {
@@ -44,13 +46,14 @@ func (r *AbstractRebalance) WaitForResult() (jrpc2.Result, error) {
 	r.Result = NewResult(r.amount)
 
 	// while there's something inflight, wait for results
-	for r.InFlightAmount > 0 {
-		r.Node.Logln(glightning.Debug, "Waiting for result, InFlightAmount:", r.InFlightAmount)
+	for r.splitsInFlight > 0 {
+		r.Node.Logln(glightning.Debug, "Waiting for result, InFlightAmount:", r.InFlightAmount, ", splits in flight:", r.splitsInFlight)
 		rebalanceResult := <-r.RebalanceResultChan
 
-		r.TotalAttempts += rebalanceResult.Attempts
-
-		if rebalanceResult.Status == "success" {
+		if rebalanceResult.Status == "skipped" {
+			r.Node.Logln(glightning.Info, "not firing ", rebalanceResult.Message)
+			r.Result.Skipped = append(r.Result.Skipped, rebalanceResult.Message)
+		} else if rebalanceResult.Status == "success" {
 			r.Node.Logf(glightning.Info, "Successful rebalance: %+v", rebalanceResult)
 
 			// update results data
@@ -64,9 +67,13 @@ func (r *AbstractRebalance) WaitForResult() (jrpc2.Result, error) {
 
 		// update inflight and rebalanced amount
 		r.UpdateAmounts(rebalanceResult)
+		r.adaptSplit(rebalanceResult)
 
 		// now that we had a result, we can fire more candidates
 		r.FireCandidates()
+
+		// checkpoint the progress, so that the job can be resumed if the plugin restarts
+		r.Node.CheckpointJob(r.Job)
 	}
 
 	// rebalance is over
@@ -79,15 +86,15 @@ func (r *AbstractRebalance) UpdateAmounts(result *rebalance.Result) {
 	r.AmountLock.Lock()
 	defer r.AmountLock.Unlock()
 
-	r.InFlightAmount -= r.splitAmount
+	r.InFlightAmount -= result.Amount * 1000
+	r.splitsInFlight--
+	r.TotalAttempts += result.Attempts
 	if result.Status == "success" {
-		r.AmountRebalanced += r.splitAmount
+		r.AmountRebalanced += result.Amount * 1000
 
 		// not really a good way to do it, but we need to do this to make sure we don't
 		// overshoot the Deplete/Fill amount. This is necessary because otherwise the
 		// spendable balance would only be updated on refreshPeers.
-		outScid := result.Route.Hops[0].ShortChannelId
-		inScid := result.Route.Hops[len(result.Route.Hops)-1].ShortChannelId
-		r.Node.UpdateChannelBalance(result.Out, result.In, outScid, inScid, result.Amount)
+		r.Node.UpdateChannelBalance(result.Out, result.In, result.OutScid, result.InScid, result.Amount)
 	}
 }
@@ -0,0 +1,81 @@
+package parallel
+
+import (
+	"circular/node"
+	"circular/util"
+	"encoding/json"
+	"github.com/elementsproject/glightning/jrpc2"
+)
+
+// remainingAmount is the amount (sats) a resumed job still has to rebalance. A job that was interrupted
+// before reporting any progress starts over with its original amount. If the amount was computed
+// from a target ratio, it stays 0 so that the ratio is computed again from the current balance
+func remainingAmount(amount, targetRatio uint64, progress *node.JobProgress) (uint64, error) {
+	if progress.Amount == 0 || (amount == 0 && targetRatio > 0) {
+		return amount, nil
+	}
+	if progress.AmountRebalanced >= progress.Amount {
+		return 0, util.ErrTargetReached
+	}
+	return progress.Amount - progress.AmountRebalanced, nil
+}
+
+func resumed(result jrpc2.Result, err error) (*node.JobStarted, error) {
+	if err != nil {
+		return nil, err
+	}
+	started, ok := result.(*node.JobStarted)
+	if !ok {
+		return nil, util.ErrJobNotStarted
+	}
+	return started, nil
+}
+
+// ResumePull starts again a circular-pull job that was interrupted by a restart, for the amount it had left
+func ResumePull(n *node.Node, params json.RawMessage, progress *node.JobProgress) (*node.JobStarted, error) {
+	r := &RebalancePull{}
+	if err := json.Unmarshal(params, r); err != nil {
+		return nil, err
+	}
+	amount, err := remainingAmount(r.Amount, r.TargetRatio, progress)
+	if err != nil {
+		return nil, err
+	}
+	r.Amount = amount
+	r.Async = true
+	r.Node = n
+	return resumed(r.Call())
+}
+
+// ResumePush starts again a circular-push job that was interrupted by a restart, for the amount it had left
+func ResumePush(n *node.Node, params json.RawMessage, progress *node.JobProgress) (*node.JobStarted, error) {
+	r := &RebalancePush{}
+	if err := json.Unmarshal(params, r); err != nil {
+		return nil, err
+	}
+	amount, err := remainingAmount(r.Amount, r.TargetRatio, progress)
+	if err != nil {
+		return nil, err
+	}
+	r.Amount = amount
+	r.Async = true
+	r.Node = n
+	return resumed(r.Call())
+}
+
+// ResumeFlow starts again a circular-flow job that was interrupted by a restart. The total amount is
+// what was left of it, while sources and sinks are set up again from their current balance
+func ResumeFlow(n *node.Node, params json.RawMessage, progress *node.JobProgress) (*node.JobStarted, error) {
+	r := &RebalanceFlow{}
+	if err := json.Unmarshal(params, r); err != nil {
+		return nil, err
+	}
+	amount, err := remainingAmount(r.Amount, 0, progress)
+	if err != nil {
+		return nil, err
+	}
+	r.Amount = amount
+	r.Async = true
+	r.Node = n
+	return resumed(r.Call())
+}
@@ -0,0 +1,54 @@
+package parallel
+
+import (
+	"circular/node"
+	"circular/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestResumePull_WhatIsLeft(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	// 100k sats out of 300k had been rebalanced before the restart
+	params := []byte(`{"inscid":"2x2x2","amount":300000,"splitamount":100000,"splits":1,"maxppm":500}`)
+	started, err := ResumePull(n, params, &node.JobProgress{Amount: 300000, AmountRebalanced: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var job *node.Job
+	assert.Eventually(t, func() bool {
+		job, err = n.GetJob(started.Id)
+		return err == nil && job.Status != node.JOB_RUNNING
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, node.JOB_COMPLETED, job.Status, job.Error)
+	assert.Equal(t, uint64(200000), job.Result.(*Result).RebalancedAmount)
+	assert.Equal(t, uint64(300000000), network.Balance("2x2x2", "self"))
+
+	// a job that was over when it was interrupted is not started again
+	_, err = ResumePull(n, params, &node.JobProgress{Amount: 300000, AmountRebalanced: 300000})
+	assert.Equal(t, util.ErrTargetReached, err)
+}
+
+func TestResumePush_WhatIsLeft(t *testing.T) {
+	network := newTestNetwork()
+	n := newTestNode(t, network)
+
+	params := []byte(`{"outscid":"1x1x1","amount":100000,"splitamount":25000,"splits":1,"maxppm":500}`)
+	started, err := ResumePush(n, params, &node.JobProgress{Amount: 100000, AmountRebalanced: 50000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var job *node.Job
+	assert.Eventually(t, func() bool {
+		job, err = n.GetJob(started.Id)
+		return err == nil && job.Status != node.JOB_RUNNING
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, node.JOB_COMPLETED, job.Status, job.Error)
+	assert.Equal(t, uint64(50000), job.Result.(*Result).RebalancedAmount)
+	assert.Equal(t, uint64(150000000), network.Balance("2x2x2", "self"))
+}
@@ -0,0 +1,117 @@
+package parallel
+
+import (
+	"circular/rebalance"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+)
+
+const (
+	DEFAULT_MIN_SPLIT_AMOUNT = 10000
+)
+
+// setSplitRange enables adaptive splits when min or max is given (sats). Every candidate starts with
+// splitamount, or max if splitamount is not given. Its split is halved after a liquidity failure
+// and doubled after a success, staying between min and max
+func (r *AbstractRebalance) setSplitRange(min, max, splitAmount uint64) error {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if min == 0 {
+		min = DEFAULT_MIN_SPLIT_AMOUNT
+	}
+	if max == 0 {
+		max = DEFAULT_SPLIT_AMOUNT
+	}
+	if splitAmount == 0 {
+		splitAmount = max
+	}
+	if min > max || splitAmount < min || splitAmount > max {
+		return util.ErrInvalidSplitRange
+	}
+
+	// convert to msat
+	r.minSplitAmount = min * 1000
+	r.maxSplitAmount = max * 1000
+	r.splitAmount = splitAmount * 1000
+	r.splitAmounts = make(map[string]uint64)
+	return nil
+}
+
+func (r *AbstractRebalance) adaptive() bool {
+	return r.maxSplitAmount > 0
+}
+
+// getSplitAmount returns the amount of the next split through candidate
+func (r *AbstractRebalance) getSplitAmount(scid string) uint64 {
+	if amount, ok := r.splitAmounts[scid]; ok {
+		return amount
+	}
+	return r.splitAmount
+}
+
+// splitLimit returns the largest split that can be fired without exceeding the amount
+// or overshooting the target ratio, or 0 if no split should be fired.
+// It assumes that the amount lock is held
+func (r *AbstractRebalance) splitLimit() uint64 {
+	if r.AmountRebalanced+r.InFlightAmount >= r.amount {
+		return 0
+	}
+	left := r.amount - r.AmountRebalanced - r.InFlightAmount
+	limit := left
+
+	// the balance is checked live, because the channel may be used by payments in the meantime
+	if r.targetRatio > 0 {
+		needed, err := rebalance.AmountToTargetRatio(r.Node, r.TargetChannel, r.targetRatio)
+		if err != nil {
+			r.Node.Logln(glightning.Unusual, err)
+			return 0
+		}
+		if needed <= r.InFlightAmount {
+			return 0
+		}
+		limit = util.Min(limit, needed-r.InFlightAmount)
+		limit -= limit % 1000
+	}
+
+	// a split smaller than the minimum is only fired to settle what is left of the amount
+	minSplit := r.splitAmount
+	if r.adaptive() {
+		minSplit = r.minSplitAmount
+	}
+	if limit < minSplit && limit < left {
+		return 0
+	}
+	return limit
+}
+
+// adaptSplit grows the split of a candidate after a success and shrinks it after a liquidity failure.
+// A candidate that failed is put back in the queue, unless its split was already at the minimum
+func (r *AbstractRebalance) adaptSplit(result *rebalance.Result) {
+	if !r.adaptive() {
+		return
+	}
+	scid := result.OutScid
+	if scid == r.TargetChannel.ShortChannelId {
+		scid = result.InScid
+	}
+
+	r.AmountLock.Lock()
+	amount := r.getSplitAmount(scid)
+	if result.Status == "success" {
+		r.splitAmounts[scid] = util.Min(amount*2, r.maxSplitAmount)
+		r.AmountLock.Unlock()
+		return
+	}
+	if !result.LiquidityFailure() || amount <= r.minSplitAmount {
+		r.AmountLock.Unlock()
+		return
+	}
+	amount = util.Max(amount/2, r.minSplitAmount)
+	amount -= amount % 1000
+	r.splitAmounts[scid] = amount
+	r.AmountLock.Unlock()
+
+	r.Node.Logln(glightning.Debug, "liquidity failure on ", scid, ", trying again with ", amount/1000, " sats")
+	r.EnqueueCandidate(result)
+}
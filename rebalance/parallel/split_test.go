@@ -0,0 +1,123 @@
+package parallel
+
+import (
+	rebalance2 "circular/rebalance"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAbstractRebalance_AdaptSplit(t *testing.T) {
+	network := newTestNetwork()
+	// carol can't reach bob, a rebalance through her fails for lack of liquidity
+	network.SetActive("5x5x5", false)
+	n := newTestNode(t, network)
+
+	r := &RebalancePull{InScid: "2x2x2", MaxOutPPM: 300, MaxPPM: 500, SplitAmount: 40000, MinSplitAmount: 10000, MaxSplitAmount: 100000, DryRun: true}
+	r.Node = n
+	_, err := r.Call()
+	assert.NoError(t, err)
+
+	success := rebalance2.NewResult("success", 40000, "alice", "bob")
+	success.OutScid, success.InScid = "1x1x1", "2x2x2"
+	carol, err := n.GetOutgoingChannelFromScid("4x4x4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	liquidityFailure := r.newRebalance(carol, r.TargetChannel, 40000000, r.maxPPM).Run()
+	assert.True(t, liquidityFailure.LiquidityFailure())
+	dave, err := n.GetOutgoingChannelFromScid("6x6x6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Stopped = true
+	otherFailure := r.newRebalance(dave, r.TargetChannel, 40000000, r.maxPPM).Run()
+	n.Stopped = false
+	assert.False(t, otherFailure.LiquidityFailure())
+
+	tests := []struct {
+		name     string
+		result   *rebalance2.Result
+		scid     string
+		split    uint64
+		enqueued bool
+	}{
+		{"a success doubles the split", success, "1x1x1", 80000000, false},
+		{"up to the maximum", success, "1x1x1", 100000000, false},
+		{"and no further", success, "1x1x1", 100000000, false},
+		{"a liquidity failure halves the split and tries again", liquidityFailure, "4x4x4", 20000000, true},
+		{"down to the minimum", liquidityFailure, "4x4x4", 10000000, true},
+		{"where the candidate is given up", liquidityFailure, "4x4x4", 10000000, false},
+		{"other failures don't change the split", otherFailure, "6x6x6", 40000000, false},
+		{"nor the splits of the other candidates", success, "1x1x1", 100000000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates := r.Candidates.Len()
+			r.adaptSplit(tt.result)
+			assert.Equal(t, tt.split, r.getSplitAmount(tt.scid))
+			if !tt.enqueued {
+				assert.Equal(t, candidates, r.Candidates.Len())
+				return
+			}
+			assert.Equal(t, candidates+1, r.Candidates.Len())
+			assert.Equal(t, tt.scid, r.Candidates.Front().ShortChannelId)
+		})
+	}
+
+	// without a split range, splits never change
+	r = &RebalancePull{InScid: "2x2x2", MaxOutPPM: 300, MaxPPM: 500, SplitAmount: 40000, DryRun: true}
+	r.Node = n
+	_, err = r.Call()
+	assert.NoError(t, err)
+	r.adaptSplit(success)
+	r.adaptSplit(liquidityFailure)
+	assert.Equal(t, uint64(40000000), r.getSplitAmount("1x1x1"))
+	assert.Equal(t, uint64(40000000), r.getSplitAmount("4x4x4"))
+}
+
+func TestAbstractRebalance_SplitLimit(t *testing.T) {
+	n := newTestNode(t, newTestNetwork())
+	// self has 100k sats of the 1M of the channel with bob
+	target, err := n.GetIncomingChannelFromScid("2x2x2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		minSplit    uint64
+		rebalanced  uint64
+		inFlight    uint64
+		targetRatio uint64
+		limit       uint64
+	}{
+		{"nothing done yet", 0, 0, 0, 0, 400000000},
+		{"what is left", 0, 200000000, 100000000, 0, 100000000},
+		{"less than a split to settle the amount", 0, 350000000, 0, 0, 50000000},
+		{"the amount is reached", 0, 300000000, 100000000, 0, 0},
+		{"adaptive, less than the minimum to settle the amount", 10000000, 395000000, 0, 0, 5000000},
+		{"up to the target ratio", 10000000, 0, 0, 15, 50000000},
+		{"the target ratio counts what is in flight", 10000000, 0, 30000000, 15, 20000000},
+		{"less than the minimum split to the target ratio", 10000000, 0, 45000000, 15, 0},
+		{"less than a split to the target ratio", 0, 0, 0, 15, 0},
+		{"the target ratio is reached", 10000000, 0, 0, 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &AbstractRebalance{
+				Node:             n,
+				TargetChannel:    target,
+				amount:           400000000,
+				splitAmount:      100000000,
+				AmountRebalanced: tt.rebalanced,
+				InFlightAmount:   tt.inFlight,
+				targetRatio:      tt.targetRatio,
+			}
+			if tt.minSplit > 0 {
+				r.minSplitAmount = tt.minSplit
+				r.maxSplitAmount = r.splitAmount
+			}
+			assert.Equal(t, tt.limit, r.splitLimit())
+		})
+	}
+}
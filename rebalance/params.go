@@ -2,6 +2,7 @@ package rebalance
 
 import (
 	"circular/graph"
+	"circular/node"
 	"circular/util"
 	"github.com/elementsproject/glightning/glightning"
 )
@@ -12,6 +13,9 @@ const (
 	DEFAULT_MAXPPM   = 10
 	DEFAULT_ATTEMPTS = 1
 	DEFAULT_MAXHOPS  = 8
+	DEFAULT_PARTS    = 1
+
+	MAX_ALTERNATIVE_ROUTES = 5 // how many routes are found at once for the attempts of a rebalance
 )
 
 func (r *Rebalance) checkConnections(inChannel, outChannel *glightning.PeerChannel) error {
@@ -95,4 +99,44 @@ func (r *Rebalance) setDefaults() {
 		r.MaxHops = DEFAULT_MAXHOPS
 		r.Node.Logln(glightning.Debug, "maxHops not provided, using default value", r.MaxHops)
 	}
+	if r.Parts <= 0 {
+		r.Parts = DEFAULT_PARTS
+	}
+}
+
+// AmountToTargetRatio returns how many msat must be moved into the channel, if it is incoming,
+// or out of it, if it is outgoing, to bring its local balance to ratio percent of its capacity
+func AmountToTargetRatio(n *node.Node, channel *graph.Channel, ratio uint64) (uint64, error) {
+	if ratio > 100 {
+		return 0, util.ErrInvalidTarget
+	}
+	peerChannel, err := n.GetPeerChannelFromGraphChannel(channel)
+	if err != nil {
+		return 0, err
+	}
+
+	toUs := peerChannel.ToUsMsat.MSat()
+	target := peerChannel.TotalMsat.MSat() * ratio / 100
+	incoming := channel.Destination == n.Id
+	if incoming && target > toUs {
+		return target - toUs, nil
+	}
+	if !incoming && toUs > target {
+		return toUs - target, nil
+	}
+	return 0, nil
+}
+
+// pathMaxDelay returns how many blocks of delay the path between the peers can add,
+// once the final cltv and the delay of the incoming channel are taken from MaxDelay.
+// 0 means that the path is not limited, because MaxDelay was not given
+func (r *Rebalance) pathMaxDelay() (uint, error) {
+	if r.MaxDelay <= 0 {
+		return 0, nil
+	}
+	fixed := r.Node.FinalDelay + r.InChannel.Delay
+	if uint(r.MaxDelay) <= fixed {
+		return 0, util.ErrMaxDelayTooLow
+	}
+	return uint(r.MaxDelay) - fixed, nil
 }
@@ -0,0 +1,44 @@
+package rebalance
+
+import (
+	"circular/graph"
+	"circular/util"
+	"errors"
+	"fmt"
+	"github.com/elementsproject/glightning/glightning"
+)
+
+// Preview looks for the route that the rebalance would take, the same way Run does,
+// without generating a preimage and without sending anything
+func (r *Rebalance) Preview() *Result {
+	var lastError error = util.ErrNoRoute
+	for maxHops := 3; maxHops <= r.MaxHops; maxHops++ {
+		routes, err := r.findRoutes(maxHops)
+		if err == nil {
+			prettyRoutes := make([]*graph.PrettyRoute, len(routes))
+			for i, route := range routes {
+				prettyRoutes[i] = graph.NewPrettyRoute(route, "")
+				r.Node.Logln(glightning.Debug, prettyRoutes[i])
+			}
+
+			result := r.newResult("dryrun")
+			result.setRoutes(prettyRoutes)
+			result.Message = fmt.Sprintf("would rebalance %d sats from %s to %s at %d ppm. Total fees: %.3f sats",
+				result.Amount, r.Node.Graph.GetAlias(r.OutChannel.Destination), r.Node.Graph.GetAlias(r.InChannel.Source),
+				result.PPM, float64(result.Fee)/1000)
+			if len(result.Parts) > 1 {
+				result.Message += fmt.Sprintf(", split in %d parts", len(result.Parts))
+			}
+			return result
+		}
+		lastError = err
+		if err != util.ErrNoRoute && !errors.As(err, &util.ErrRouteTooExpensive{}) {
+			break
+		}
+	}
+
+	failure := r.newResult("failure")
+	failure.err = lastError
+	failure.Message = "no route found: " + lastError.Error()
+	return failure
+}
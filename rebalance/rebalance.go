@@ -7,7 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
 	"strconv"
+	"sync/atomic"
 )
 
 type Rebalance struct {
@@ -17,10 +19,18 @@ type Rebalance struct {
 	MaxPPM     uint64
 	Attempts   int
 	MaxHops    int
+	MaxDelay   int
+	Parts      int
+	Filter     *graph.Filter
 	Node       *node.Node
+	Job        *node.Job
+	attempt    atomic.Uint64
+	// routes are the alternatives left to try, found for routesMaxHops hops
+	routes        []*graph.Route
+	routesMaxHops int
 }
 
-func NewRebalance(outChannel, inChannel *graph.Channel, amount, maxppm uint64, attempts, maxHops int) *Rebalance {
+func NewRebalance(outChannel, inChannel *graph.Channel, amount, maxppm uint64, attempts, maxHops, maxDelay int) *Rebalance {
 	return &Rebalance{
 		OutChannel: outChannel,
 		InChannel:  inChannel,
@@ -28,6 +38,7 @@ func NewRebalance(outChannel, inChannel *graph.Channel, amount, maxppm uint64, a
 		MaxPPM:     maxppm,
 		Attempts:   attempts,
 		MaxHops:    maxHops,
+		MaxDelay:   maxDelay,
 		Node:       node.GetNode(),
 	}
 }
@@ -47,6 +58,7 @@ func (r *Rebalance) Run() *Result {
 		maxHops   = 3
 		i         = 1
 		lastError = ""
+		lastErr   error
 	)
 	for i <= r.Attempts {
 		if maxHops > r.MaxHops {
@@ -55,8 +67,10 @@ func (r *Rebalance) Run() *Result {
 			break
 		}
 		r.Node.Logln(glightning.Debug, "===================== ATTEMPT ", i, " =====================")
+		r.attempt.Store(uint64(i))
 
 		result, err := r.runAttempt(maxHops)
+		lastErr = err
 
 		// success
 		if err == nil {
@@ -102,8 +116,9 @@ func (r *Rebalance) Run() *Result {
 		i++
 	}
 
-	failure := NewResult("failure", r.Amount/1000, r.OutChannel.Destination, r.InChannel.Source)
+	failure := r.newResult("failure")
 	failure.Attempts = uint64(i - 1)
+	failure.err = lastErr
 	failure.Message = "rebalance failed after " + strconv.Itoa(int(failure.Attempts)) + " attempts."
 	failure.Message += lastError
 
@@ -114,25 +129,56 @@ func (r *Rebalance) runAttempt(maxHops int) (*Result, error) {
 	if r.Node.Stopped {
 		return nil, util.ErrCircularStopped
 	}
-	
+	if r.Job.IsCancelled() {
+		return nil, util.ErrJobCancelled
+	}
+
 	if err := r.validateLiquidityParameters(r.OutChannel, r.InChannel); err != nil {
 		return nil, err
 	}
 
-	route, err := r.tryRoute(maxHops)
+	routes, err := r.tryRoute(maxHops)
 	if err != nil {
 		return nil, err
 	}
 
-	result := NewResult("success", r.Amount/1000,
-		r.OutChannel.Destination, r.InChannel.Source)
-
-	result.Fee = route.Fee
-	result.PPM = route.FeePPM
-	result.Route = route
+	result := r.newResult("success")
+	result.setRoutes(routes)
 	result.Message = fmt.Sprintf("successfully rebalanced %d sats from %s to %s at %d ppm. Total fees paid: %.3f sats",
 		result.Amount, r.Node.Graph.GetAlias(r.OutChannel.Destination), r.Node.Graph.GetAlias(r.InChannel.Source),
 		result.PPM, float64(result.Fee)/1000)
+	if len(result.Parts) > 1 {
+		result.Message += fmt.Sprintf(", split in %d parts", len(result.Parts))
+	}
 
 	return result, nil
 }
+
+func (r *Rebalance) newResult(status string) *Result {
+	result := NewResult(status, r.Amount/1000, r.OutChannel.Destination, r.InChannel.Source)
+	result.OutScid = r.OutChannel.ShortChannelId
+	result.InScid = r.InChannel.ShortChannelId
+	return result
+}
+
+// Progress reports how far the rebalance has gone when it runs as a job
+func (r *Rebalance) Progress() *node.JobProgress {
+	return &node.JobProgress{
+		Amount:         r.Amount / 1000,
+		InFlightSplits: 1,
+		Attempts:       r.attempt.Load(),
+	}
+}
+
+// Start runs the rebalance, in the background if async is true.
+// params are the parameters of the RPC call, saved with the job
+func (r *Rebalance) Start(method string, params any, async bool) jrpc2.Result {
+	if !async {
+		return r.Run()
+	}
+	return r.Node.StartJob(method, params, func(job *node.Job) (jrpc2.Result, error) {
+		r.Job = job
+		job.SetProgress(r.Progress)
+		return r.Run(), nil
+	})
+}
@@ -0,0 +1,283 @@
+package rebalance
+
+import (
+	"circular/graph"
+	"circular/node"
+	"circular/simnet"
+	"circular/util"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a node backed by network, wired to its notifications like the plugin does
+func newTestNode(t *testing.T, network *simnet.Network) *node.Node {
+	n, err := node.New(network, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	network.OnSendPaySuccess = n.OnPaymentSuccess
+	network.OnSendPayFailure = n.OnPaymentFailure
+	network.OnHtlcAccepted = n.OnHtlcAccepted
+	return n
+}
+
+func newTestRebalance(t *testing.T, n *node.Node, outScid, inScid string, amount, maxPPM uint64, attempts int) *Rebalance {
+	out, err := n.GetOutgoingChannelFromScid(outScid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := n.GetIncomingChannelFromScid(inScid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRebalance(out, in, amount, maxPPM, attempts, 0, 0)
+	r.Node = n
+	if err = r.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRebalance_LearnsLiquidityAndRetries(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	// the direct channel is the cheapest, but alice has almost nothing on her side
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 10000, 0, 1)
+	network.AddChannel("4x4x4", "alice", "carol", 1000000, 800000, 0, 50)
+	network.AddChannel("5x5x5", "carol", "bob", 1000000, 800000, 0, 50)
+	n := newTestNode(t, network)
+
+	r := newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 5)
+	result := r.Run()
+
+	assert.Equal(t, "success", result.Status, result.Message)
+	assert.GreaterOrEqual(t, result.Attempts, uint64(2))
+	assert.Equal(t, "4x4x4", result.Route.Hops[1].ShortChannelId)
+	assert.Equal(t, uint64(200000000), network.Balance("2x2x2", "self"))
+
+	// the failure taught us that alice can't forward 100k sats to bob
+	channel, err := n.Graph.GetChannel("3x3x3/" + util.GetDirection("alice", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		_, upper := channel.Bounds()
+		return upper < 100000000
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRebalance_FailsWithoutLiquidity(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 10000, 0, 1)
+	n := newTestNode(t, network)
+
+	r := newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 3)
+	result := r.Run()
+
+	assert.Equal(t, "failure", result.Status)
+	assert.True(t, result.LiquidityFailure())
+	assert.Equal(t, "1x1x1", result.OutScid)
+	assert.Equal(t, "2x2x2", result.InScid)
+	assert.Equal(t, uint64(100000000), network.Balance("2x2x2", "self"))
+}
+
+func TestRebalance_PreviewDoesNotSend(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 500000, 0, 1)
+	n := newTestNode(t, network)
+
+	r := newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 1)
+	result := r.Preview()
+
+	assert.Equal(t, "dryrun", result.Status, result.Message)
+	assert.Equal(t, []string{"1x1x1", "3x3x3", "2x2x2"}, []string{
+		result.Route.Hops[0].ShortChannelId,
+		result.Route.Hops[1].ShortChannelId,
+		result.Route.Hops[2].ShortChannelId,
+	})
+	assert.Equal(t, uint64(100000000), network.Balance("2x2x2", "self"))
+}
+
+func TestAmountToTargetRatio(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	n := newTestNode(t, network)
+
+	out, err := n.GetOutgoingChannelFromScid("1x1x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := n.GetIncomingChannelFromScid("1x1x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 900k local: pushing to 50% moves 400k out, pulling to 95% moves 50k in
+	amount, err := AmountToTargetRatio(n, out, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(400000000), amount)
+	amount, err = AmountToTargetRatio(n, in, 95)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50000000), amount)
+
+	// the channel is already past the target
+	amount, err = AmountToTargetRatio(n, in, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), amount)
+
+	_, err = AmountToTargetRatio(n, in, 101)
+	assert.Equal(t, util.ErrInvalidTarget, err)
+}
+
+func TestRebalance_SplitsAcrossRoutes(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	// neither path is big enough for the whole amount
+	network.AddChannel("3x3x3", "alice", "carol", 60000, 60000, 0, 10)
+	network.AddChannel("4x4x4", "carol", "bob", 60000, 60000, 0, 10)
+	network.AddChannel("5x5x5", "alice", "dave", 60000, 60000, 0, 20)
+	network.AddChannel("6x6x6", "dave", "bob", 60000, 60000, 0, 20)
+	n := newTestNode(t, network)
+
+	r := newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 1)
+	result := r.Run()
+	assert.Equal(t, "failure", result.Status, result.Message)
+
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 1)
+	r.Parts = 2
+	result = r.Run()
+
+	assert.Equal(t, "success", result.Status, result.Message)
+	assert.Nil(t, result.Route)
+	assert.Len(t, result.Parts, 2)
+	assert.Equal(t, uint64(200000000), network.Balance("2x2x2", "self"))
+	// both paths carried a part
+	assert.Less(t, network.Balance("3x3x3", "alice"), uint64(60000000))
+	assert.Less(t, network.Balance("5x5x5", "alice"), uint64(60000000))
+}
+
+func TestRebalance_MaxDelay(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 800000, 0, 10)
+	n := newTestNode(t, network)
+
+	// without maxdelay the route is not limited
+	r := newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 1)
+	result := r.Run()
+	assert.Equal(t, "success", result.Status, result.Message)
+
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 1)
+	r.MaxDelay = 2016
+	result = r.Run()
+	assert.Equal(t, "success", result.Status, result.Message)
+	assert.LessOrEqual(t, result.Route.Hops[0].Delay, uint(2016))
+
+	// the final cltv alone doesn't fit
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 1000, 1)
+	r.MaxDelay = int(n.FinalDelay)
+	result = r.Run()
+	assert.Equal(t, "failure", result.Status)
+	assert.ErrorIs(t, result.err, util.ErrMaxDelayTooLow)
+}
+
+func TestRebalance_Filter(t *testing.T) {
+	network := simnet.NewNetwork("self")
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "carol", 1000000, 800000, 0, 10)
+	network.AddChannel("4x4x4", "carol", "bob", 1000000, 800000, 0, 10)
+	network.AddChannel("5x5x5", "alice", "dave", 1000000, 800000, 0, 50)
+	network.AddChannel("6x6x6", "dave", "bob", 1000000, 800000, 0, 50)
+	n := newTestNode(t, network)
+
+	r := newTestRebalance(t, n, "1x1x1", "2x2x2", 10000, 1000, 1)
+	r.Filter, _ = graph.NewFilter([]string{"carol"}, nil, nil)
+	result := r.Preview()
+	assert.Equal(t, "5x5x5", result.Route.Hops[1].ShortChannelId)
+
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 10000, 1000, 1)
+	r.Filter, _ = graph.NewFilter(nil, []string{"3x3x3"}, nil)
+	result = r.Preview()
+	assert.Equal(t, "5x5x5", result.Route.Hops[1].ShortChannelId)
+
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 10000, 1000, 1)
+	r.Filter, _ = graph.NewFilter(nil, nil, []string{"dave"})
+	result = r.Run()
+	assert.Equal(t, "success", result.Status, result.Message)
+	assert.Equal(t, "5x5x5", result.Route.Hops[1].ShortChannelId)
+
+	// the blocklist applies to every rebalance, our channels included
+	if _, err := n.UpdateBlocklist([]string{"dave"}, []string{"1x1x1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 10000, 1000, 1)
+	result = r.Run()
+	assert.ErrorIs(t, result.err, util.ErrChannelExcluded)
+
+	if _, err := n.UpdateBlocklist(nil, []string{"1x1x1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRebalance(t, n, "1x1x1", "2x2x2", 10000, 1000, 1)
+	r.Filter, _ = graph.NewFilter(nil, nil, []string{"dave"})
+	result = r.Run()
+	assert.ErrorIs(t, result.err, util.ErrNoRoute)
+}
+
+// timeoutNetwork is a network where payments are sent but time out, like when a node holds the htlc
+type timeoutNetwork struct {
+	*simnet.Network
+	paymentHash string
+}
+
+func (n *timeoutNetwork) WaitSendPay(paymentHash string, timeout uint) (*glightning.SendPayFields, error) {
+	n.paymentHash = paymentHash
+	return nil, util.ErrSendPayTimeout
+}
+
+func TestRebalance_TimeoutKeepsTheFeeReserved(t *testing.T) {
+	network := &timeoutNetwork{Network: simnet.NewNetwork("self")}
+	network.AddChannel("1x1x1", "self", "alice", 1000000, 900000, 0, 10)
+	network.AddChannel("2x2x2", "self", "bob", 1000000, 100000, 0, 10)
+	network.AddChannel("3x3x3", "alice", "bob", 1000000, 500000, 0, 1000)
+	n, err := node.New(network, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.DB.Close()
+	})
+	spent := func() uint64 {
+		return n.GetBudgetStatus().Windows[0].Spent
+	}
+
+	// the htlc may still settle, the fee stays reserved until we know
+	result := newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 2000, 1).Run()
+	assert.Equal(t, "failure", result.Status)
+	fee := spent()
+	assert.Greater(t, fee, uint64(100000))
+
+	n.OnPaymentFailure(&glightning.SendPayFailure{
+		Data: glightning.SendPayFailureData{PaymentHash: network.paymentHash, ErringNode: n.Id},
+	})
+	assert.Zero(t, spent())
+
+	// once settled, the fee is spent for good
+	result = newTestRebalance(t, n, "1x1x1", "2x2x2", 100000, 2000, 1).Run()
+	assert.Equal(t, "failure", result.Status)
+	n.OnPaymentSuccess(&glightning.SendPaySuccess{PaymentHash: network.paymentHash})
+	assert.Equal(t, fee, spent())
+	assert.Equal(t, fee, n.GetBudgetStatus().Peers[0].Spent)
+}
@@ -1,18 +1,27 @@
 package rebalance
 
-import "circular/graph"
+import (
+	"circular/graph"
+	"circular/util"
+	"errors"
+)
 
 type Result struct {
-	Status     string             `json:"status"`
-	Message    string             `json:"message"`
-	Amount     uint64             `json:"amount"`
-	Out        string             `json:"out"`
-	In         string             `json:"in"`
-	Attempts   uint64             `json:"attempts"`
-	Fee        uint64             `json:"fee,omitempty"`
-	PPM        uint64             `json:"ppm,omitempty"`
-	Route      *graph.PrettyRoute `json:"route,omitempty"`
-	FormatHint string             `json:"format-hint,omitempty"`
+	Status   string             `json:"status"`
+	Message  string             `json:"message"`
+	Amount   uint64             `json:"amount"`
+	Out      string             `json:"out"`
+	In       string             `json:"in"`
+	OutScid  string             `json:"outscid,omitempty"`
+	InScid   string             `json:"inscid,omitempty"`
+	Attempts uint64             `json:"attempts"`
+	Fee      uint64             `json:"fee,omitempty"`
+	PPM      uint64             `json:"ppm,omitempty"`
+	Route    *graph.PrettyRoute `json:"route,omitempty"`
+	// Parts are the routes of a rebalance that was split, each of them carrying a part of the amount
+	Parts      []*graph.PrettyRoute `json:"parts,omitempty"`
+	FormatHint string               `json:"format-hint,omitempty"`
+	err        error
 }
 
 func NewResult(status string, amount uint64, src, dst string) *Result {
@@ -23,3 +32,26 @@ func NewResult(status string, amount uint64, src, dst string) *Result {
 		In:     dst,
 	}
 }
+
+// LiquidityFailure tells whether the rebalance failed because there was not enough liquidity
+// along the routes that were tried, or because no route could carry the amount
+func (r *Result) LiquidityFailure() bool {
+	return errors.Is(r.err, util.ErrTemporaryFailure) || errors.Is(r.err, util.ErrNoRoute)
+}
+
+// setRoutes sets the fee and the route of the result, or its parts if there are several routes
+func (r *Result) setRoutes(routes []*graph.PrettyRoute) {
+	if len(routes) == 1 {
+		r.Fee = routes[0].Fee
+		r.PPM = routes[0].FeePPM
+		r.Route = routes[0]
+		return
+	}
+	var amount uint64
+	for _, route := range routes {
+		r.Fee += route.Fee
+		amount += route.Amount
+	}
+	r.PPM = r.Fee * 1000 / amount
+	r.Parts = routes
+}
@@ -5,25 +5,103 @@ import (
 	"circular/node"
 	"circular/util"
 	"github.com/elementsproject/glightning/glightning"
+	"strconv"
 	"time"
 )
 
+// getRoute returns the next of the alternative routes found for maxHops hops, and looks for new
+// ones when there are none left. Retries move through the alternatives without waiting for the
+// liquidity updates of the failures, skipping the routes that we now know can't carry the amount
 func (r *Rebalance) getRoute(maxHops int) (*graph.Route, error) {
+	if r.routesMaxHops != maxHops {
+		r.routes = nil
+		r.routesMaxHops = maxHops
+	}
+	for len(r.routes) > 0 {
+		route := r.routes[0]
+		r.routes = r.routes[1:]
+		if route.Probability() > 0 {
+			return route, nil
+		}
+	}
+
+	filter, err := r.routeFilter()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := r.findAlternativeRoutes(filter, maxHops)
+	if err != nil {
+		return nil, err
+	}
+	r.routes = routes[1:]
+	return routes[0], nil
+}
+
+// findAlternativeRoutes finds up to one route per attempt left, the best first
+func (r *Rebalance) findAlternativeRoutes(filter *graph.Filter, maxHops int) ([]*graph.Route, error) {
+	defer util.TimeTrack(time.Now(), "rebalance.findAlternativeRoutes", r.Node.Logf)
+
+	// a preview has no attempt yet
+	attempt := util.Max(r.attempt.Load(), 1)
+	k := r.Attempts - int(attempt) + 1
+	if k > MAX_ALTERNATIVE_ROUTES {
+		k = MAX_ALTERNATIVE_ROUTES
+	}
+	if k <= 1 {
+		route, err := r.findRoute(r.Amount, filter, maxHops)
+		if err != nil {
+			return nil, err
+		}
+		return []*graph.Route{route}, nil
+	}
+
+	src := r.OutChannel.Destination
+	dst := r.InChannel.Source
+
+	r.Node.Logln(glightning.Debug, "looking for ", k, " routes from ", r.Node.Graph.GetAlias(src), " to ", r.Node.Graph.GetAlias(dst))
+	maxDelay, err := r.pathMaxDelay()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := r.Node.Graph.GetRoutes(src, dst, r.Amount, filter, maxHops, r.MaxPPM, maxDelay, k)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*graph.Route, 0, len(routes))
+	for _, route := range routes {
+		route.Prepend(r.OutChannel)
+		route.Append(r.InChannel, r.Node.FinalDelay)
+		if route.FeePPM() > r.MaxPPM {
+			// the best route decides the error, like when a single route is found
+			if len(result) == 0 {
+				return nil, util.NewRouteTooExpensiveError(route.FeePPM(), r.MaxPPM)
+			}
+			continue
+		}
+		result = append(result, route)
+	}
+	return result, nil
+}
+
+func (r *Rebalance) findRoute(amount uint64, filter *graph.Filter, maxHops int) (*graph.Route, error) {
 	defer util.TimeTrack(time.Now(), "rebalance.getRoute", r.Node.Logf)
-	exclude := make(map[string]bool)
-	exclude[r.Node.Id] = true
 
 	src := r.OutChannel.Destination
 	dst := r.InChannel.Source
 
 	r.Node.Logln(glightning.Debug, "looking for a route from ", r.Node.Graph.GetAlias(src), " to ", r.Node.Graph.GetAlias(dst))
-	route, err := r.Node.Graph.GetRoute(src, dst, r.Amount, exclude, maxHops)
+	maxDelay, err := r.pathMaxDelay()
+	if err != nil {
+		return nil, err
+	}
+	route, err := r.Node.Graph.GetRoute(src, dst, amount, filter, maxHops, r.MaxPPM, maxDelay)
 	if err != nil {
 		return nil, err
 	}
 
 	route.Prepend(r.OutChannel)
-	route.Append(r.InChannel)
+	route.Append(r.InChannel, r.Node.FinalDelay)
 
 	if route.FeePPM() > r.MaxPPM {
 		return nil, util.NewRouteTooExpensiveError(route.FeePPM(), r.MaxPPM)
@@ -32,32 +110,157 @@ func (r *Rebalance) getRoute(maxHops int) (*graph.Route, error) {
 	return route, nil
 }
 
-func (r *Rebalance) tryRoute(maxHops int) (*graph.PrettyRoute, error) {
-	paymentSecretHash, err := r.Node.GeneratePreimageHashPair()
+// routeFilter returns the filter of the routes of the rebalance, with our node excluded.
+// It fails if our channels or our peers at both ends are excluded or in the blocklist
+func (r *Rebalance) routeFilter() (*graph.Filter, error) {
+	for _, channel := range []*graph.Channel{r.OutChannel, r.InChannel} {
+		if r.Filter.Excludes(channel.ShortChannelId) || r.Node.Graph.Blocked(channel.ShortChannelId) {
+			return nil, util.ErrChannelExcluded
+		}
+	}
+	for _, peer := range []string{r.OutChannel.Destination, r.InChannel.Source} {
+		if r.Filter != nil && r.Filter.ExcludeNodes[peer] || r.Node.Graph.Blocked(peer) {
+			return nil, util.ErrNodeExcluded
+		}
+	}
+
+	// the filter of the rebalance may be shared with other rebalances, and the routes can extend it
+	filter := &graph.Filter{ExcludeNodes: map[string]bool{r.Node.Id: true}}
+	if r.Filter != nil {
+		for id := range r.Filter.ExcludeNodes {
+			filter.ExcludeNodes[id] = true
+		}
+		filter.ExcludeChannels = r.Filter.ExcludeChannels
+		filter.ViaNodes = r.Filter.ViaNodes
+	}
+	return filter, nil
+}
+
+// getRoutes splits the amount in equal parts, and finds a route for each of them. The routes only have
+// our channels and the peers at both ends in common, so that every part relies on different liquidity
+func (r *Rebalance) getRoutes(maxHops, parts int) ([]*graph.Route, error) {
+	filter, err := r.routeFilter()
 	if err != nil {
 		return nil, err
 	}
+	// every part goes through the via nodes
+	via := make(map[string]bool, len(filter.ViaNodes))
+	for _, id := range filter.ViaNodes {
+		via[id] = true
+	}
+	used := make(map[string]bool)
 
-	r.Node.Logln(glightning.Debug, "generating route")
+	partAmount := r.Amount / uint64(parts)
+	routes := make([]*graph.Route, 0, parts)
+	for i := 0; i < parts; i++ {
+		amount := partAmount
+		// the last part carries what is left of the division
+		if i == parts-1 {
+			amount = r.Amount - partAmount*uint64(parts-1)
+		}
+		route, err := r.findRoute(amount, filter, maxHops)
+		if err != nil {
+			return nil, err
+		}
+
+		// the first and the last hops are our channels
+		middle := route.Hops[1 : len(route.Hops)-1]
+		for j, hop := range middle {
+			// peers can be connected directly, and excluding nodes doesn't keep the same channel away
+			if used[hop.ShortChannelId] {
+				return nil, util.ErrNoRoute
+			}
+			used[hop.ShortChannelId] = true
+			if j < len(middle)-1 && !via[hop.Destination] {
+				filter.ExcludeNodes[hop.Destination] = true
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// findRoutes looks for a single route first. If none can carry the amount, and the rebalance can be
+// split, it looks for routes for 2 parts, then 3 and so on
+func (r *Rebalance) findRoutes(maxHops int) ([]*graph.Route, error) {
 	route, err := r.getRoute(maxHops)
+	if err == nil {
+		return []*graph.Route{route}, nil
+	}
+	if err != util.ErrNoRoute || r.Parts <= 1 {
+		return nil, err
+	}
+
+	for parts := 2; parts <= r.Parts; parts++ {
+		r.Node.Logln(glightning.Debug, "no single route found, trying with ", parts, " parts")
+		var routes []*graph.Route
+		routes, err = r.getRoutes(maxHops, parts)
+		if err == nil {
+			return routes, nil
+		}
+	}
+	return nil, err
+}
+
+func partKey(paymentHash string, partId int) string {
+	return paymentHash + "_" + strconv.Itoa(partId)
+}
+
+// tryRoute sends the rebalance along the routes that are found, and returns them.
+// If there are several routes, each of them carries a part of the amount
+func (r *Rebalance) tryRoute(maxHops int) ([]*graph.PrettyRoute, error) {
+	r.Node.Logln(glightning.Debug, "generating route")
+	routes, err := r.findRoutes(maxHops)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentSecretHash, err := r.Node.GeneratePreimageHashPair()
 	if err != nil {
 		return nil, err
 	}
 
-	prettyRoute := graph.NewPrettyRoute(route, paymentSecretHash)
+	// every part is saved on its own, the parts of a single route payment are only the route
+	keys := []string{paymentSecretHash}
+	if len(routes) > 1 {
+		keys = make([]string, len(routes))
+		for i := range routes {
+			keys[i] = partKey(paymentSecretHash, i+1)
+		}
+	}
+
+	prettyRoutes := make([]*graph.PrettyRoute, len(routes))
+	for i, route := range routes {
+		prettyRoutes[i] = graph.NewPrettyRoute(route, paymentSecretHash)
+
+		// save route to DB
+		if err := r.Node.SaveToDb(node.StatKey(node.ROUTE_PREFIX, time.Now().Unix(), keys[i]), prettyRoutes[i]); err != nil {
+			r.Node.Logln(glightning.Unusual, "unable to save route to db: ", err)
+		}
+		r.Node.Logln(glightning.Debug, prettyRoutes[i])
+		r.Node.Logln(glightning.Info, prettyRoutes[i].Simple())
+	}
 
-	// save route to DB
-	if err := r.Node.SaveToDb(node.ROUTE_PREFIX+paymentSecretHash, prettyRoute); err != nil {
-		r.Node.Logln(glightning.Unusual, "unable to save route to db: ", err)
+	// the fee is reserved before sending, so that parallel rebalances can't overshoot the budget
+	for _, route := range routes {
+		if err = r.Node.Budget.Reserve(paymentSecretHash, route); err != nil {
+			r.Node.Budget.Release(paymentSecretHash)
+			return nil, err
+		}
 	}
-	r.Node.Logln(glightning.Debug, prettyRoute)
-	r.Node.Logln(glightning.Info, prettyRoute.Simple())
 
-	_, err = r.Node.SendPay(route, paymentSecretHash)
+	if len(routes) == 1 {
+		_, err = r.Node.SendPay(routes[0], paymentSecretHash)
+	} else {
+		err = r.Node.SendPayParts(routes, paymentSecretHash)
+	}
 	if err != nil {
+		// the htlcs of a payment that timed out are still in flight and may settle:
+		// the node keeps the fee reserved until the outcome is notified
 		if err == util.ErrSendPayTimeout {
 			return nil, err
 		}
+		r.Node.Budget.Release(paymentSecretHash)
 		if err == util.ErrWireFeeInsufficient {
 			return nil, err
 		}
@@ -67,5 +270,9 @@ func (r *Rebalance) tryRoute(maxHops int) (*graph.PrettyRoute, error) {
 		return nil, util.ErrTemporaryFailure
 	}
 
-	return prettyRoute, nil
+	if err = r.Node.Budget.Commit(paymentSecretHash); err != nil {
+		r.Node.Logln(glightning.Unusual, "unable to save spend to db: ", err)
+	}
+
+	return prettyRoutes, nil
 }
@@ -0,0 +1,449 @@
+package simnet
+
+import (
+	"circular/util"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	NORMAL = "CHANNELD_NORMAL"
+	DELAY  = 40
+
+	// failure codes as defined in BOLT 4
+	WIRE_TEMPORARY_CHANNEL_FAILURE            = 0x1007
+	WIRE_FEE_INSUFFICIENT                     = 0x100c
+	WIRE_UNKNOWN_NEXT_PEER                    = 0x400a
+	WIRE_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS = 0x400f
+
+	// tlv types of the onion payload, as defined in BOLT 4
+	TLV_AMT_TO_FORWARD      = 2
+	TLV_OUTGOING_CLTV_VALUE = 4
+)
+
+var failCodeNames = map[int]string{
+	WIRE_TEMPORARY_CHANNEL_FAILURE:            "WIRE_TEMPORARY_CHANNEL_FAILURE",
+	WIRE_FEE_INSUFFICIENT:                     "WIRE_FEE_INSUFFICIENT",
+	WIRE_UNKNOWN_NEXT_PEER:                    "WIRE_UNKNOWN_NEXT_PEER",
+	WIRE_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS: "WIRE_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS",
+}
+
+var (
+	ErrNoSuchPayment = errors.New("no such payment")
+	ErrNoSuchPeer    = errors.New("no such peer")
+)
+
+// channel is a channel of the simulated network. Unlike the channels of the graph,
+// its liquidity is known exactly: it is hidden from the node, which has to learn it
+type channel struct {
+	scid     string
+	node1    string
+	node2    string
+	capacity uint64
+	balance1 uint64 // liquidity on the side of node1, in msat
+	baseFee  uint64
+	feePPM   uint64
+	active   bool
+}
+
+func (c *channel) balance(id string) uint64 {
+	if id == c.node1 {
+		return c.balance1
+	}
+	return c.capacity - c.balance1
+}
+
+func (c *channel) move(from string, amount uint64) {
+	if from == c.node1 {
+		c.balance1 -= amount
+	} else {
+		c.balance1 += amount
+	}
+}
+
+func (c *channel) peer(id string) string {
+	if id == c.node1 {
+		return c.node2
+	}
+	return c.node1
+}
+
+func (c *channel) toLightning(source string) *glightning.Channel {
+	return &glightning.Channel{
+		Source:                   source,
+		Destination:              c.peer(source),
+		ShortChannelId:           c.scid,
+		IsPublic:                 true,
+		Satoshis:                 c.capacity / 1000,
+		AmountMsat:               glightning.AmountFromMSat(c.capacity),
+		IsActive:                 c.active,
+		LastUpdate:               uint(time.Now().Unix()),
+		BaseFeeMillisatoshi:      c.baseFee,
+		FeePerMillionth:          c.feePPM,
+		Delay:                    DELAY,
+		HtlcMinimumMilliSatoshis: glightning.AmountFromMSat(1),
+		HtlcMaximumMilliSatoshis: glightning.AmountFromMSat(c.capacity),
+	}
+}
+
+// Network is an in-process lightning network that implements node.Lightning.
+// Payments are settled or failed hop by hop according to the real balances of the channels,
+// and the outcome is notified through OnSendPaySuccess and OnSendPayFailure like lightningd does.
+// Payments to Self go through OnHtlcAccepted, if it is set, before they are settled
+type Network struct {
+	Self             string
+	OnSendPaySuccess func(*glightning.SendPaySuccess)
+	OnSendPayFailure func(*glightning.SendPayFailure)
+	OnHtlcAccepted   func(*glightning.HtlcAcceptedEvent) *glightning.HtlcAcceptedResponse
+	aliases          map[string]string
+	channels         map[string]*channel
+	payments         map[string][]glightning.RouteHop
+	lock             *sync.Mutex
+}
+
+func NewNetwork(self string) *Network {
+	return &Network{
+		Self:     self,
+		aliases:  map[string]string{self: self},
+		channels: make(map[string]*channel),
+		payments: make(map[string][]glightning.RouteHop),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// AddChannel opens a channel between source and destination, with balance sats on the side of source
+func (n *Network) AddChannel(scid, source, destination string, capacity, balance, baseFee, feePPM uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	c := &channel{
+		scid:     scid,
+		node1:    source,
+		node2:    destination,
+		capacity: capacity * 1000,
+		balance1: balance * 1000,
+		baseFee:  baseFee,
+		feePPM:   feePPM,
+		active:   true,
+	}
+	if destination < source {
+		c.node1, c.node2 = destination, source
+		c.balance1 = c.capacity - c.balance1
+	}
+	n.channels[scid] = c
+	for _, id := range []string{source, destination} {
+		if _, ok := n.aliases[id]; !ok {
+			n.aliases[id] = id
+		}
+	}
+}
+
+// SetActive enables or disables a channel, as if it had been closed or one of the peers went offline
+func (n *Network) SetActive(scid string, active bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if c, ok := n.channels[scid]; ok {
+		c.active = active
+	}
+}
+
+// Balance returns the liquidity that id has in the channel, in msat
+func (n *Network) Balance(scid, id string) uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if c, ok := n.channels[scid]; ok {
+		return c.balance(id)
+	}
+	return 0
+}
+
+func (n *Network) GetInfo() (*glightning.NodeInfo, error) {
+	return &glightning.NodeInfo{
+		Id:    n.Self,
+		Alias: n.aliases[n.Self],
+	}, nil
+}
+
+func (n *Network) ListChannels() ([]*glightning.Channel, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	result := make([]*glightning.Channel, 0, 2*len(n.channels))
+	for _, c := range n.channels {
+		result = append(result, c.toLightning(c.node1), c.toLightning(c.node2))
+	}
+	return result, nil
+}
+
+func (n *Network) GetChannel(shortChanId string) ([]*glightning.Channel, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	c, ok := n.channels[shortChanId]
+	if !ok {
+		return nil, fmt.Errorf("No channel found for short channel id %s", shortChanId)
+	}
+	return []*glightning.Channel{c.toLightning(c.node1), c.toLightning(c.node2)}, nil
+}
+
+func (n *Network) ListNodes() ([]*glightning.Node, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	result := make([]*glightning.Node, 0, len(n.aliases))
+	for id, alias := range n.aliases {
+		result = append(result, &glightning.Node{
+			Id:    id,
+			Alias: alias,
+		})
+	}
+	return result, nil
+}
+
+func (n *Network) ListPeers() ([]*glightning.Peer, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	peers := make(map[string]*glightning.Peer)
+	for _, c := range n.channels {
+		if c.node1 != n.Self && c.node2 != n.Self {
+			continue
+		}
+		id := c.peer(n.Self)
+		if _, ok := peers[id]; !ok {
+			peers[id] = &glightning.Peer{
+				Id:        id,
+				Connected: true,
+				Channels:  make([]*glightning.PeerChannel, 0),
+			}
+		}
+		peers[id].Channels = append(peers[id].Channels, &glightning.PeerChannel{
+			State:          NORMAL,
+			ShortChannelId: c.scid,
+			ChannelId:      c.scid,
+			ToUsMsat:       glightning.AmountFromMSat(c.balance(n.Self)),
+			TotalMsat:      glightning.AmountFromMSat(c.capacity),
+		})
+	}
+
+	result := make([]*glightning.Peer, 0, len(peers))
+	for _, peer := range peers {
+		result = append(result, peer)
+	}
+	return result, nil
+}
+
+func (n *Network) GetPeer(peerId string) (*glightning.Peer, error) {
+	peers, err := n.ListPeers()
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range peers {
+		if peer.Id == peerId {
+			return peer, nil
+		}
+	}
+	return nil, ErrNoSuchPeer
+}
+
+// SendPayLite starts a payment, that is carried out when WaitSendPay is called
+func (n *Network) SendPayLite(route []glightning.RouteHop, paymentHash string) (*glightning.SendPayResult, error) {
+	return n.SendPay(route, paymentHash, "", 0, "", "", 0)
+}
+
+// SendPay starts a payment or one part of it, that is carried out when WaitSendPayPart is called.
+// The parts of a payment to another node are settled independently: the destination doesn't wait
+// for all of them. The parts of a payment to Self are held as long as OnHtlcAccepted holds them
+func (n *Network) SendPay(route []glightning.RouteHop, paymentHash, label string, msat uint64, bolt11 string, paymentSecret string, partId uint64) (*glightning.SendPayResult, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if len(route) == 0 {
+		return nil, errors.New("empty route")
+	}
+	if c, ok := n.channels[route[0].ShortChannelId]; !ok || c.peer(n.Self) != route[0].Id {
+		return nil, ErrNoSuchPeer
+	}
+	n.payments[paymentKey(paymentHash, partId)] = route
+	return &glightning.SendPayResult{
+		Message: "Monitor status with listpays or waitsendpay",
+		SendPayFields: glightning.SendPayFields{
+			PaymentHash: paymentHash,
+			Status:      "pending",
+		},
+	}, nil
+}
+
+func paymentKey(paymentHash string, partId uint64) string {
+	return paymentHash + "/" + strconv.FormatUint(partId, 10)
+}
+
+func (n *Network) WaitSendPay(paymentHash string, timeout uint) (*glightning.SendPayFields, error) {
+	return n.WaitSendPayPart(paymentHash, timeout, 0)
+}
+
+// WaitSendPayPart forwards the payment hop by hop. It fails at the first channel
+// that can't forward the amount, otherwise the balances of every channel are updated.
+// If the payment is to Self, it is settled only if OnHtlcAccepted resolves it: until then the
+// amount stays locked in the channels, and it goes back to the senders if the htlc is not resolved
+func (n *Network) WaitSendPayPart(paymentHash string, timeout uint, partId uint64) (*glightning.SendPayFields, error) {
+	n.lock.Lock()
+	route, ok := n.payments[paymentKey(paymentHash, partId)]
+	if !ok {
+		n.lock.Unlock()
+		return nil, ErrNoSuchPayment
+	}
+	delete(n.payments, paymentKey(paymentHash, partId))
+
+	sender := n.Self
+	for i, hop := range route {
+		c, ok := n.channels[hop.ShortChannelId]
+		if !ok || !c.active || c.peer(sender) != hop.Id {
+			return n.fail(paymentHash, route, i, sender, WIRE_UNKNOWN_NEXT_PEER)
+		}
+		if c.balance(sender) < hop.AmountMsat.MSat() {
+			return n.fail(paymentHash, route, i, sender, WIRE_TEMPORARY_CHANNEL_FAILURE)
+		}
+		// every forwarding node must be paid its fee
+		if i > 0 {
+			fee := c.baseFee + hop.AmountMsat.MSat()*c.feePPM/1000000
+			if route[i-1].AmountMsat.MSat() < hop.AmountMsat.MSat()+fee {
+				return n.fail(paymentHash, route, i, sender, WIRE_FEE_INSUFFICIENT)
+			}
+		}
+		sender = hop.Id
+	}
+
+	sender = n.Self
+	for _, hop := range route {
+		n.channels[hop.ShortChannelId].move(sender, hop.AmountMsat.MSat())
+		sender = hop.Id
+	}
+	n.lock.Unlock()
+
+	if !n.htlcAccepted(paymentHash, route) {
+		n.lock.Lock()
+		sender = n.Self
+		for _, hop := range route {
+			n.channels[hop.ShortChannelId].move(hop.Id, hop.AmountMsat.MSat())
+			sender = hop.Id
+		}
+		return n.fail(paymentHash, route, len(route)-1, sender, WIRE_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS)
+	}
+
+	amount := route[len(route)-1].AmountMsat.MSat()
+	sent := route[0].AmountMsat.MSat()
+	if n.OnSendPaySuccess != nil {
+		n.OnSendPaySuccess(&glightning.SendPaySuccess{
+			PaymentHash:  paymentHash,
+			Destination:  route[len(route)-1].Id,
+			MilliSatoshi: amount,
+			AmountSent:   sent,
+			CreatedAt:    float64(time.Now().Unix()),
+			Status:       "complete",
+		})
+	}
+	return &glightning.SendPayFields{
+		PaymentHash:        paymentHash,
+		Destination:        route[len(route)-1].Id,
+		AmountMilliSatoshi: glightning.AmountFromMSat(amount),
+		MilliSatoshiSent:   glightning.AmountFromMSat(sent),
+		CreatedAt:          float64(time.Now().Unix()),
+		Status:             "complete",
+	}, nil
+}
+
+// htlcAccepted calls OnHtlcAccepted with the htlc that the last hop of route delivers to Self,
+// and returns whether it was resolved. Payments to other nodes are always accepted
+func (n *Network) htlcAccepted(paymentHash string, route []glightning.RouteHop) bool {
+	last := route[len(route)-1]
+	if n.OnHtlcAccepted == nil || last.Id != n.Self {
+		return true
+	}
+
+	// like current versions of lightningd, the amount is only in the onion payload
+	payload := appendTlv(nil, TLV_AMT_TO_FORWARD, last.AmountMsat.MSat())
+	payload = appendTlv(payload, TLV_OUTGOING_CLTV_VALUE, uint64(last.Delay))
+	response := n.OnHtlcAccepted(&glightning.HtlcAcceptedEvent{
+		Onion: glightning.Onion{
+			Payload: hex.EncodeToString(append([]byte{byte(len(payload))}, payload...)),
+			Type:    "tlv",
+		},
+		Htlc: glightning.HtlcOffer{
+			PaymentHash: paymentHash,
+			CltvExpiry:  int(last.Delay),
+		},
+	})
+	return response != nil && response.Result == "resolve"
+}
+
+// appendTlv appends a record with a tu64 value to a tlv stream. Types and lengths must be below 253,
+// so that they fit in a single byte
+func appendTlv(stream []byte, recordType byte, value uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	i := 0
+	for i < len(b) && b[i] == 0 {
+		i++
+	}
+	stream = append(stream, recordType, byte(len(b)-i))
+	return append(stream, b[i:]...)
+}
+
+// fail notifies the failure of a payment and returns the error that lightningd would return.
+// It assumes that the lock is held, and releases it
+func (n *Network) fail(paymentHash string, route []glightning.RouteHop, index int, node string, failCode int) (*glightning.SendPayFields, error) {
+	n.lock.Unlock()
+
+	hop := route[index]
+	failCodeName := failCodeNames[failCode]
+	direction, _ := strconv.Atoi(util.GetDirection(node, hop.Id))
+	message := "failed: " + failCodeName + " (reply from remote)"
+
+	if n.OnSendPayFailure != nil {
+		n.OnSendPayFailure(&glightning.SendPayFailure{
+			Code:    204,
+			Message: message,
+			Data: glightning.SendPayFailureData{
+				PaymentHash:     paymentHash,
+				Destination:     route[len(route)-1].Id,
+				MilliSatoshi:    route[len(route)-1].AmountMsat.MSat(),
+				AmountSent:      route[0].AmountMsat.MSat(),
+				Status:          "failed",
+				CreatedAt:       uint64(time.Now().Unix()),
+				ErringIndex:     uint64(index),
+				FailCode:        failCode,
+				ErringNode:      node,
+				ErringChannel:   hop.ShortChannelId,
+				ErringDirection: direction,
+				FailCodeName:    failCodeName,
+			},
+		})
+	}
+
+	return &glightning.SendPayFields{PaymentHash: paymentHash, Status: "failed"}, &glightning.PaymentError{
+		RpcError: &jrpc2.RpcError{
+			Code:    204,
+			Message: message,
+		},
+		Data: &glightning.PaymentErrorData{
+			ErringIndex:     uint64(index),
+			FailCode:        failCode,
+			ErringNode:      node,
+			ErringChannel:   hop.ShortChannelId,
+			ErringDirection: direction,
+			FailCodeName:    failCodeName,
+		},
+	}
+}
+
+func (n *Network) SetTimeout(secs uint) {}
@@ -21,6 +21,22 @@ func (e ErrRouteTooExpensive) Error() string {
 	return fmt.Sprintf("route too expensive. Cheapest route found was %d ppm, but maxppm is %d", e.FeePPM, e.MaxPPM)
 }
 
+type ErrBudgetExceeded struct {
+	Window string
+	Limit  uint64
+}
+
+func NewBudgetExceededError(window string, limit uint64) ErrBudgetExceeded {
+	return ErrBudgetExceeded{
+		Window: window,
+		Limit:  limit,
+	}
+}
+
+func (e ErrBudgetExceeded) Error() string {
+	return fmt.Sprintf("fee budget exceeded. At most %d msat can be spent in fees per %s", e.Limit, e.Window)
+}
+
 var (
 	ErrSendPayTimeout      = errors.New("200:Timed out while waiting")
 	ErrTemporaryFailure    = errors.New("204:failed: WIRE_TEMPORARY_CHANNEL_FAILURE (reply from remote)")
@@ -35,13 +51,36 @@ var (
 	ErrNoPeer                      = errors.New("no peer")
 	ErrFirstPeerNotReady           = errors.New("first peer not ready")
 	ErrCircularStopped             = errors.New("circular has been stopped. Use 'circular-resume' to resume activity")
+	ErrJobCancelled                = errors.New("job has been cancelled")
+	ErrNoSuchJob                   = errors.New("no such job")
+	ErrJobNotRunning               = errors.New("job is not running")
+	ErrJobNotStarted               = errors.New("the job did not start in the background")
 
 	ErrNoGraphToLoad = errors.New("no graph to load")
 	ErrNoRoute       = errors.New("no route")
 
+	ErrInvalidOnionPayload = errors.New("invalid onion payload")
+	ErrNoHtlcAmount        = errors.New("the htlc tells no amount")
+
+	ErrInvalidDecayModel = errors.New("invalid liquidity decay model, it must be one of none, linear, exponential")
+	ErrInvalidHalfLife   = errors.New("liquidity half-life must be positive")
+
 	ErrAmountLessThanSplitAmount      = errors.New("amount is less than split amount")
 	ErrAmountNotMultipleOfSplitAmount = errors.New("amount is not a multiple of split amount")
+	ErrInvalidSplitRange              = errors.New("invalid split range, minsplitamount must not be greater than splitamount, and splitamount must not be greater than maxsplitamount")
 	ErrDepleteUpToPercentInvalid      = errors.New("deplete up to percent invalid, it must be between 0 and 1")
+	ErrInvalidTargetRatio             = errors.New("invalid target ratio, minratio must be less than maxratio and both must be between 0 and 100")
+	ErrInvalidTarget                  = errors.New("invalid target, it must be between 0 and 100")
+	ErrTargetReached                  = errors.New("channel is already at its target ratio, or less than a split away from it")
+	ErrChannelInSourcesAndSinks       = errors.New("channel is both a source and a sink")
+	ErrNoSource                       = errors.New("no source can send to the sink")
+	ErrInvalidStatus                  = errors.New("invalid status, it must be one of success, failure")
+	ErrInvalidTimeRange               = errors.New("invalid time range, from must not be after to")
+	ErrInvalidPPMRange                = errors.New("invalid ppm range, minppm must not be greater than maxppm")
+	ErrMaxDelayTooLow                 = errors.New("maxdelay is too low, the final cltv and the incoming channel already take it all")
+	ErrInvalidViaNodes                = errors.New("invalid via nodes, they must not repeat or be excluded")
+	ErrChannelExcluded                = errors.New("the channel is excluded or in the blocklist")
+	ErrNodeExcluded                   = errors.New("the node is excluded or in the blocklist")
 
 	ErrNoChannel               = errors.New("no channel")
 	ErrNoCandidates            = errors.New("no candidates")
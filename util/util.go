@@ -72,3 +72,11 @@ func GetMapValues[T any](m map[string]T) []T {
 	}
 	return values
 }
+
+func GetMapKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}